@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/update"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands are one-shot subcommands that run a probe directly, without
+// the controller, and print the result.
+var commands = map[string]func(args []string) error{
+	"ping":              cmdPing,
+	"mtr":               cmdMtr,
+	"speedtest":         cmdSpeedTest,
+	"netinfo":           cmdNetInfo,
+	"sysinfo":           cmdSysInfo,
+	"trafficsim-server": cmdTrafficSimServer,
+	"trafficsim-client": cmdTrafficSimClient,
+	"update-keygen":     cmdUpdateKeygen,
+	"update-sign":       cmdUpdateSign,
+}
+
+var commandNames = []string{"ping", "mtr", "speedtest", "netinfo", "sysinfo", "trafficsim-server", "trafficsim-client", "update-keygen", "update-sign"}
+
+var commandUsage = map[string]string{
+	"ping":              "ping [-count n] [-json] <host>",
+	"mtr":               "mtr [-extended] [-protocol icmp|udp|tcp] [-port n] [-multipath classic|paris|dublin] [-flows n] [-json] <host>[:port]",
+	"speedtest":         "speedtest [-server id] [-json]",
+	"netinfo":           "netinfo [-json]",
+	"sysinfo":           "sysinfo [-json]",
+	"trafficsim-server": "trafficsim-server -port n -agent id -allow id[,id...]",
+	"trafficsim-client": "trafficsim-client -agent id -server-agent id [-json] <host:port>",
+	"update-keygen":     "update-keygen -key file",
+	"update-sign":       "update-sign -key file -version v -url url [-os os] [-arch arch] <binary>",
+}
+
+// runCommand runs os.Args[1] as a subcommand. It returns false when the
+// first argument isn't one, so the agent starts normally.
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	name := os.Args[1]
+	if name == "help" {
+		printCommands()
+		os.Exit(0)
+	}
+
+	run, ok := commands[name]
+	if !ok {
+		return false
+	}
+
+	// probes log their raw results at info level, keep the output to the summary
+	log.SetLevel(log.WarnLevel)
+	err := run(os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+	return true
+}
+
+func printCommands() {
+	fmt.Println("Usage: netwatcher-agent [-config file] [-probes file] [-offline] [-results file]")
+	fmt.Println("       netwatcher-agent <command> [flags]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, n := range commandNames {
+		fmt.Printf("  %s\n", commandUsage[n])
+	}
+}
+
+// parseArgs parses flags that may appear before or after positional
+// arguments, eg. both "ping -json 1.1.1.1" and "ping 1.1.1.1 -json".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: netwatcher-agent %s\n", commandUsage[name])
+		fs.PrintDefaults()
+	}
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	return fs, asJSON
+}
+
+func requireOne(name string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: netwatcher-agent %s", commandUsage[name])
+	}
+	return args[0], nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cmdPing(args []string) error {
+	fs, asJSON := newFlagSet("ping")
+	count := fs.Int("count", 10, "Number of echo requests to send")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	host, err := requireOne("ping", rest)
+	if err != nil {
+		return err
+	}
+
+	probe := probes.Probe{
+		Type:   probes.ProbeType_PING,
+		ID:     primitive.NewObjectID(),
+		Config: probes.ProbeConfig{Target: []probes.ProbeTarget{{Target: host}}, Duration: *count},
+	}
+
+	// Ping reports through the channel from its OnFinish callback
+	results := make(chan probes.ProbeData, 2)
+	err = probes.Ping(&probe, results, probes.Probe{})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case pd := <-results:
+		r := pd.Data.(probes.PingResult)
+		if *asJSON {
+			return printJSON(r)
+		}
+		fmt.Printf("--- %s ping statistics ---\n", r.Addr)
+		fmt.Printf("%d packets transmitted, %d packets received, %d duplicates, %.1f%% packet loss\n",
+			r.PacketsSent, r.PacketsRecv, r.PacketsRecvDuplicates, r.PacketLoss)
+		fmt.Printf("round-trip min/avg/max/stddev = %v/%v/%v/%v\n", r.MinRtt, r.AvgRtt, r.MaxRtt, r.StdDevRtt)
+		return nil
+	default:
+		return errors.New("ping finished without a result")
+	}
+}
+
+func cmdMtr(args []string) error {
+	fs, asJSON := newFlagSet("mtr")
+	triggered := fs.Bool("extended", false, "Run the longer trace used when a probe triggers an MTR")
+	protocol := fs.String("protocol", probes.TraceProtocolICMP, "Probe with icmp, udp or tcp packets")
+	port := fs.Int("port", 0, "Destination port for tcp (default 80), or the first one for udp (default 33434)")
+	multipath := fs.String("multipath", probes.TraceMultipathClassic, "Enumerate ECMP paths with the paris or dublin strategy")
+	flows := fs.Int("flows", 0, "Flows traced by the paris and dublin strategies (default 8)")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	host, err := requireOne("mtr", rest)
+	if err != nil {
+		return err
+	}
+
+	probe := probes.Probe{
+		Type: probes.ProbeType_MTR,
+		ID:   primitive.NewObjectID(),
+		Config: probes.ProbeConfig{
+			Target:    []probes.ProbeTarget{{Target: host}},
+			Protocol:  *protocol,
+			Port:      *port,
+			Multipath: *multipath,
+			Flows:     *flows,
+		},
+	}
+	r, err := probes.Mtr(&probe, *triggered)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+
+	fmt.Printf("Traceroute to %s (%s), %s\n", r.Report.Info.Target.Hostname, r.Report.Info.Target.IP, r.StopTimestamp.Sub(r.StartTimestamp).Round(time.Millisecond))
+	if len(r.Report.Paths) == 0 {
+		return printMtrHops(r.Report.Hops)
+	}
+	for i, path := range r.Report.Paths {
+		fmt.Printf("\nPath %d, flows %v\n", i+1, path.Flows)
+		err = printMtrHops(path.Hops)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printMtrHops(hops []probes.MtrHop) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOP\tHOST\tLOSS%\tSENT\tRECV\tLAST\tAVG\tBEST\tWORST\tSTDEV")
+	for _, hop := range hops {
+		host := "???"
+		if len(hop.Hosts) > 0 {
+			host = hop.Hosts[0].Hostname
+			if host == "" || host == hop.Hosts[0].IP {
+				host = hop.Hosts[0].IP
+			} else {
+				host += " (" + hop.Hosts[0].IP + ")"
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			hop.TTL, host, hop.LossPct, hop.Sent, hop.Recv, hop.Last, hop.Avg, hop.Best, hop.Worst, hop.StdDev)
+	}
+	return tw.Flush()
+}
+
+func cmdSpeedTest(args []string) error {
+	fs, asJSON := newFlagSet("speedtest")
+	server := fs.Int("server", 0, "speedtest.net server ID, the closest server when 0")
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	target := ""
+	if *server > 0 {
+		target = strconv.Itoa(*server)
+	}
+	probe := probes.Probe{
+		Type:   probes.ProbeType_SPEEDTEST,
+		ID:     primitive.NewObjectID(),
+		Config: probes.ProbeConfig{Target: []probes.ProbeTarget{{Target: target}}},
+	}
+
+	// SpeedTest logs its raw result at warn level
+	log.SetLevel(log.ErrorLevel)
+	r, err := probes.SpeedTest(&probe)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+
+	for _, s := range r.TestData {
+		fmt.Printf("Server:   %s - %s (%s) [id %s]\n", s.Sponsor, s.Name, s.Country, s.ID)
+		fmt.Printf("Latency:  %v (jitter %v)\n", s.Latency, s.Jitter)
+		fmt.Printf("Download: %s\n", s.DLSpeed)
+		fmt.Printf("Upload:   %s\n", s.ULSpeed)
+	}
+	return nil
+}
+
+func cmdNetInfo(args []string) error {
+	fs, asJSON := newFlagSet("netinfo")
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	r, err := probes.NetworkInfo()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+
+	fmt.Printf("Local address:     %s\n", r.LocalAddress)
+	fmt.Printf("Default gateway:   %s\n", r.DefaultGateway)
+	fmt.Printf("Public address:    %s\n", r.PublicAddress)
+	fmt.Printf("Internet provider: %s\n", r.InternetProvider)
+	fmt.Printf("Location:          %s, %s\n", r.Lat, r.Long)
+	return nil
+}
+
+func cmdSysInfo(args []string) error {
+	fs, asJSON := newFlagSet("sysinfo")
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	r, err := probes.SystemInfo()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(r)
+	}
+
+	h := r.HostInfo
+	fmt.Printf("Hostname:     %s\n", h.Hostname)
+	fmt.Printf("OS:           %s %s (%s)\n", h.OS.Name, h.OS.Version, h.Architecture)
+	fmt.Printf("Kernel:       %s\n", h.KernelVersion)
+	fmt.Printf("Boot time:    %s\n", h.BootTime.Format(time.RFC3339))
+	fmt.Printf("IPs:          %s\n", strings.Join(h.IPs, ", "))
+	fmt.Printf("Memory:       %d MiB used of %d MiB, %d MiB available\n",
+		r.MemoryInfo.Used>>20, r.MemoryInfo.Total>>20, r.MemoryInfo.Available>>20)
+	fmt.Printf("CPU time:     user %v, system %v, idle %v\n", r.CPUTimes.User, r.CPUTimes.System, r.CPUTimes.Idle)
+	return nil
+}
+
+func parseAgentID(flagName, v string) (primitive.ObjectID, error) {
+	if v == "" {
+		return primitive.ObjectID{}, fmt.Errorf("-%s is required", flagName)
+	}
+	id, err := primitive.ObjectIDFromHex(v)
+	if err != nil {
+		return id, fmt.Errorf("-%s: %v", flagName, err)
+	}
+	return id, nil
+}
+
+func cmdTrafficSimServer(args []string) error {
+	fs, _ := newFlagSet("trafficsim-server")
+	port := fs.Int("port", 0, "UDP port to listen on")
+	agent := fs.String("agent", os.Getenv("ID"), "ID of this agent")
+	allow := fs.String("allow", "", "Comma separated IDs of the client agents allowed to connect")
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *port <= 0 {
+		return errors.New("-port is required")
+	}
+	thisAgent, err := parseAgentID("agent", *agent)
+	if err != nil {
+		return err
+	}
+
+	var allowed []primitive.ObjectID
+	for _, a := range strings.Split(*allow, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		id, err := parseAgentID("allow", a)
+		if err != nil {
+			return err
+		}
+		allowed = append(allowed, id)
+	}
+	if len(allowed) == 0 {
+		return errors.New("-allow needs at least one client agent ID")
+	}
+
+	server := &probes.TrafficSim{
+		Running:       true,
+		IsServer:      true,
+		ThisAgent:     thisAgent,
+		Port:          int64(*port),
+		AllowedAgents: allowed,
+		Probe:         primitive.NewObjectID(),
+	}
+	server.Start(nil)
+	return nil
+}
+
+func cmdTrafficSimClient(args []string) error {
+	fs, asJSON := newFlagSet("trafficsim-client")
+	agent := fs.String("agent", os.Getenv("ID"), "ID of this agent, must be allowed by the server")
+	serverAgent := fs.String("server-agent", "", "ID of the server agent")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	target, err := requireOne("trafficsim-client", rest)
+	if err != nil {
+		return err
+	}
+
+	thisAgent, err := parseAgentID("agent", *agent)
+	if err != nil {
+		return err
+	}
+	otherAgent, err := parseAgentID("server-agent", *serverAgent)
+	if err != nil {
+		return err
+	}
+
+	host, portStr, ok := strings.Cut(target, ":")
+	if !ok {
+		return errors.New("target must be host:port")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	results := make(chan probes.ProbeData)
+	client := &probes.TrafficSim{
+		Running:    true,
+		ThisAgent:  thisAgent,
+		OtherAgent: otherAgent,
+		IPAddress:  host,
+		Port:       int64(port),
+		Probe:      primitive.NewObjectID(),
+		DataChan:   results,
+	}
+	go client.Start(nil)
+
+	for pd := range results {
+		if *asJSON {
+			printJSON(pd.Data)
+			continue
+		}
+		stats, ok := pd.Data.(probes.TrafficSimResult)
+		if !ok {
+			continue
+		}
+		fmt.Printf("%s  sent %d, lost %d (%.1f%%), out of order %d, rtt avg %.1fms min %dms max %dms stddev %.1fms\n",
+			time.Now().Format(time.TimeOnly), stats.TotalPackets, stats.LostPackets, stats.LossPercentage,
+			stats.OutOfSequence, stats.AverageRTT, stats.MinRTT, stats.MaxRTT, stats.StdDevRTT)
+	}
+	return nil
+}
+
+// cmdUpdateKeygen creates the key pair releases are signed with. The public
+// key it prints is built into the agent with UPDATE_PUBLIC_KEY.
+func cmdUpdateKeygen(args []string) error {
+	fs, _ := newFlagSet("update-keygen")
+	keyFile := fs.String("key", "", "File to write the private key to")
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("usage: netwatcher-agent %s", commandUsage["update-keygen"])
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*keyFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+// cmdUpdateSign prints the release document for a build, signed with the
+// private key from update-keygen.
+func cmdUpdateSign(args []string) error {
+	fs, _ := newFlagSet("update-sign")
+	keyFile := fs.String("key", "", "Private key file from update-keygen")
+	version := fs.String("version", "", "Version of the build")
+	url := fs.String("url", "", "URL the build is downloaded from")
+	goos := fs.String("os", runtime.GOOS, "OS the build is for")
+	goarch := fs.String("arch", runtime.GOARCH, "Architecture the build is for")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	binary, err := requireOne("update-sign", rest)
+	if err != nil {
+		return err
+	}
+	if *keyFile == "" || *version == "" || *url == "" {
+		return fmt.Errorf("usage: netwatcher-agent %s", commandUsage["update-sign"])
+	}
+	err = update.CheckVersion(*version)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not a private key from update-keygen", *keyFile)
+	}
+
+	f, err := os.Open(binary)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	file := update.File{
+		OS:     *goos,
+		Arch:   *goarch,
+		URL:    *url,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), update.SignedMessage(*version, file))
+	file.Signature = base64.StdEncoding.EncodeToString(sig)
+	return printJSON(update.Release{Version: *version, Files: []update.File{file}})
+}
@@ -0,0 +1,350 @@
+package deps
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	installedMu sync.RWMutex
+	installed   = map[string]string{}
+)
+
+// Lookup returns the path of a tool the manager installed.
+func Lookup(name string) (string, bool) {
+	installedMu.RLock()
+	defer installedMu.RUnlock()
+	p, ok := installed[name]
+	return p, ok
+}
+
+// Manager installs the tools of a manifest into Dir. What is installed is
+// recorded under Dir/.deps, so a tool is only fetched again when its
+// pinned version or download changes, or the executable was modified.
+type Manager struct {
+	Dir     string
+	Mirror  string // directory searched for downloads by file name before going to the network
+	Offline bool   // only install from Mirror
+	Client  *http.Client
+}
+
+// state is what was installed for a tool.
+type state struct {
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"` // of the download
+	Binary  string `json:"binary"` // sha256 of the installed executable
+}
+
+// Install makes sure every tool of m is installed at its pinned version.
+// A tool that can't be installed is skipped, so the probes that don't
+// need it keep working; the returned error lists all the failures.
+func (mg *Manager) Install(ctx context.Context, m *Manifest) error {
+	var errs []error
+	for _, t := range m.Tools {
+		p, err := mg.ensure(ctx, t)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %v", t.Name, t.Version, err))
+			continue
+		}
+		installedMu.Lock()
+		installed[t.Name] = p
+		installedMu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func (mg *Manager) ensure(ctx context.Context, t Tool) (string, error) {
+	d, ok := t.download(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		return "", fmt.Errorf("no download for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+
+	bin := filepath.Join(mg.Dir, t.Name)
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	statePath := filepath.Join(mg.Dir, ".deps", t.Name+".json")
+
+	var st state
+	if b, err := os.ReadFile(statePath); err == nil && json.Unmarshal(b, &st) == nil {
+		sum, err := fileSHA256(bin)
+		if err == nil && st.Version == t.Version && strings.EqualFold(st.SHA256, d.SHA256) && sum == st.Binary {
+			return bin, nil
+		}
+		if st.Version != t.Version {
+			log.Infof("Upgrading %s from %s to %s", t.Name, st.Version, t.Version)
+		}
+	}
+
+	archive, err := mg.fetch(ctx, d)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive)
+
+	name := d.Binary
+	if name == "" {
+		name = filepath.Base(bin)
+	}
+	sum, err := extract(archive, d.Archive, name, bin)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(state{Version: t.Version, SHA256: strings.ToLower(d.SHA256), Binary: sum})
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(statePath, b, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Installed %s %s to %s", t.Name, t.Version, bin)
+	return bin, nil
+}
+
+// fetch gets a download from the mirror or its URL, resuming a partial
+// download left by an earlier attempt, and returns its path once the
+// checksum matches.
+func (mg *Manager) fetch(ctx context.Context, d Download) (string, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	dir := filepath.Join(mg.Dir, ".deps")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, name+".part")
+
+	src := ""
+	if mg.Mirror != "" {
+		src = filepath.Join(mg.Mirror, name)
+		if _, err := os.Stat(src); err != nil {
+			src = ""
+		}
+	}
+
+	switch {
+	case src != "":
+		err = copyFile(src, dst)
+	case mg.Offline:
+		return "", fmt.Errorf("%s is not in the mirror %q and the agent is offline", name, mg.Mirror)
+	default:
+		err = mg.download(ctx, d.URL, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum, err := fileSHA256(dst)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(sum, d.SHA256) {
+		os.Remove(dst)
+		return "", fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, sum, d.SHA256)
+	}
+	return dst, nil
+}
+
+// download appends the rest of rawURL to dst, asking the server for only
+// the bytes it doesn't have yet.
+func (mg *Manager) download(ctx context.Context, rawURL, dst string) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+
+	client := mg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server ignored the range, start over
+		err = f.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// already complete, the checksum will tell
+		return nil
+	default:
+		return fmt.Errorf("downloading %s: %s", rawURL, resp.Status)
+	}
+
+	if off > 0 && resp.StatusCode == http.StatusPartialContent {
+		log.Infof("Resuming download of %s at %d bytes", rawURL, off)
+	} else {
+		log.Infof("Downloading %s", rawURL)
+	}
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+// extract writes the executable name from an archive to dst, replacing
+// it in one step, and returns its checksum.
+func extract(archive, kind, name, dst string) (string, error) {
+	var r io.Reader
+	switch kind {
+	case "":
+		f, err := os.Open(archive)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+
+	case "tar.gz":
+		f, err := os.Open(archive)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer gzr.Close()
+
+		tr := tar.NewReader(gzr)
+		for r == nil {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return "", fmt.Errorf("%s not found in archive", name)
+			}
+			if err != nil {
+				return "", err
+			}
+			if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+				r = tr
+			}
+		}
+
+	case "zip":
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+
+		for _, file := range zr.File {
+			if path.Base(file.Name) == name {
+				rc, err := file.Open()
+				if err != nil {
+					return "", err
+				}
+				defer rc.Close()
+				r = rc
+				break
+			}
+		}
+		if r == nil {
+			return "", fmt.Errorf("%s not found in archive", name)
+		}
+
+	default:
+		return "", fmt.Errorf("unsupported archive type %q", kind)
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
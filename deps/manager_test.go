@@ -0,0 +1,290 @@
+package deps
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBinary = []byte(strings.Repeat("#!/bin/sh\necho tool\n", 100))
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileServer serves body as tool.bin, recording the Range of every request.
+type fileServer struct {
+	*httptest.Server
+	body        []byte
+	ignoreRange bool
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newFileServer(t *testing.T, body []byte) *fileServer {
+	s := &fileServer{body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		if s.ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "tool.bin", time.Time{}, bytes.NewReader(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fileServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func (s *fileServer) download(sum string) Download {
+	return Download{OS: runtime.GOOS, Arch: runtime.GOARCH, URL: s.URL + "/releases/tool.bin", SHA256: sum}
+}
+
+// partial leaves the first n bytes of body as an interrupted download.
+func partial(t *testing.T, mg *Manager, body []byte, n int) {
+	dir := filepath.Join(mg.Dir, ".deps")
+	os.MkdirAll(dir, 0755)
+	if err := os.WriteFile(filepath.Join(dir, "tool.bin.part"), body[:n], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFetched(t *testing.T, p string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("fetch() = %v", err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testBinary) {
+		t.Errorf("fetched %d bytes that don't match the %d served", len(b), len(testBinary))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := newFileServer(t, testBinary)
+	mg := &Manager{Dir: t.TempDir()}
+
+	p, err := mg.fetch(context.Background(), srv.download(sha256Hex(testBinary)))
+	checkFetched(t, p, err)
+	if got := srv.requests(); len(got) != 1 || got[0] != "" {
+		t.Errorf("requested ranges %q, want the whole file", got)
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	srv := newFileServer(t, testBinary)
+	mg := &Manager{Dir: t.TempDir()}
+
+	_, err := mg.fetch(context.Background(), srv.download(sha256Hex([]byte("something else"))))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("fetch() = %v, want a checksum mismatch", err)
+	}
+	// not resumed from next time
+	if _, err := os.Stat(filepath.Join(mg.Dir, ".deps", "tool.bin.part")); !os.IsNotExist(err) {
+		t.Errorf("download that didn't match was kept: %v", err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	srv := newFileServer(t, testBinary)
+	mg := &Manager{Dir: t.TempDir()}
+	partial(t, mg, testBinary, 100)
+
+	p, err := mg.fetch(context.Background(), srv.download(sha256Hex(testBinary)))
+	checkFetched(t, p, err)
+	if got := srv.requests(); len(got) != 1 || got[0] != "bytes=100-" {
+		t.Errorf("requested ranges %q, want the missing bytes", got)
+	}
+}
+
+func TestFetchRangeIgnored(t *testing.T) {
+	// the server answers 200 with the whole file, which replaces the part
+	srv := newFileServer(t, testBinary)
+	srv.ignoreRange = true
+	mg := &Manager{Dir: t.TempDir()}
+	partial(t, mg, testBinary, 100)
+
+	p, err := mg.fetch(context.Background(), srv.download(sha256Hex(testBinary)))
+	checkFetched(t, p, err)
+}
+
+func TestFetchAlreadyComplete(t *testing.T) {
+	// asking for bytes past the end gets a 416
+	srv := newFileServer(t, testBinary)
+	mg := &Manager{Dir: t.TempDir()}
+	partial(t, mg, testBinary, len(testBinary))
+
+	p, err := mg.fetch(context.Background(), srv.download(sha256Hex(testBinary)))
+	checkFetched(t, p, err)
+}
+
+func TestFetchHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	mg := &Manager{Dir: t.TempDir()}
+
+	d := Download{URL: srv.URL + "/tool.bin", SHA256: sha256Hex(testBinary)}
+	if _, err := mg.fetch(context.Background(), d); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("fetch() = %v, want the 404", err)
+	}
+}
+
+func TestFetchMirror(t *testing.T) {
+	srv := newFileServer(t, testBinary)
+	mirror := t.TempDir()
+	if err := os.WriteFile(filepath.Join(mirror, "tool.bin"), testBinary, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := srv.download(sha256Hex(testBinary))
+
+	for _, offline := range []bool{false, true} {
+		mg := &Manager{Dir: t.TempDir(), Mirror: mirror, Offline: offline}
+		p, err := mg.fetch(context.Background(), d)
+		checkFetched(t, p, err)
+	}
+	if got := srv.requests(); len(got) != 0 {
+		t.Errorf("downloaded %d times with the file in the mirror", len(got))
+	}
+
+	// not in the mirror, from the network unless offline
+	mg := &Manager{Dir: t.TempDir(), Mirror: t.TempDir()}
+	p, err := mg.fetch(context.Background(), d)
+	checkFetched(t, p, err)
+
+	mg = &Manager{Dir: t.TempDir(), Mirror: t.TempDir(), Offline: true}
+	if _, err := mg.fetch(context.Background(), d); err == nil {
+		t.Error("fetch() succeeded offline without the file in the mirror")
+	}
+	if got := srv.requests(); len(got) != 1 {
+		t.Errorf("downloaded %d times, want once", len(got))
+	}
+}
+
+func TestEnsure(t *testing.T) {
+	srv := newFileServer(t, testBinary)
+	mg := &Manager{Dir: t.TempDir()}
+	tool := Tool{Name: "tool", Version: "1.0.0", Files: []Download{srv.download(sha256Hex(testBinary))}}
+
+	bin, err := mg.ensure(context.Background(), tool)
+	if err != nil {
+		t.Fatalf("ensure() = %v", err)
+	}
+	if b, _ := os.ReadFile(bin); !bytes.Equal(b, testBinary) {
+		t.Fatal("installed executable doesn't match the download")
+	}
+
+	// installed already
+	if _, err := mg.ensure(context.Background(), tool); err != nil {
+		t.Fatalf("ensure() = %v", err)
+	}
+	if n := len(srv.requests()); n != 1 {
+		t.Errorf("downloaded %d times, want once", n)
+	}
+
+	// modified since, installed again
+	os.WriteFile(bin, []byte("tampered"), 0755)
+	if _, err := mg.ensure(context.Background(), tool); err != nil {
+		t.Fatalf("ensure() = %v", err)
+	}
+	if b, _ := os.ReadFile(bin); !bytes.Equal(b, testBinary) {
+		t.Error("modified executable wasn't replaced")
+	}
+
+	// no download for this platform
+	tool.Files[0].OS = "plan9"
+	if _, err := mg.ensure(context.Background(), tool); err == nil {
+		t.Error("ensure() succeeded without a download for the platform")
+	}
+}
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, b := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(b)), Typeflag: tar.TypeReg})
+		tw.Write(b)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, b := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	files := map[string][]byte{
+		"tool-1.0.0/README":   []byte("readme"),
+		"tool-1.0.0/bin/tool": testBinary,
+	}
+	archives := map[string][]byte{
+		"":       testBinary,
+		"tar.gz": tarGz(t, files),
+		"zip":    zipArchive(t, files),
+	}
+	for kind, b := range archives {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "download")
+		os.WriteFile(archive, b, 0644)
+
+		dst := filepath.Join(dir, "tool")
+		sum, err := extract(archive, kind, "tool", dst)
+		if err != nil {
+			t.Errorf("%q: extract() = %v", kind, err)
+			continue
+		}
+		if got, _ := os.ReadFile(dst); !bytes.Equal(got, testBinary) || sum != sha256Hex(testBinary) {
+			t.Errorf("%q: extracted %d bytes with checksum %s", kind, len(got), sum)
+		}
+
+		if kind != "" {
+			if _, err := extract(archive, kind, "missing", filepath.Join(dir, "missing")); err == nil {
+				t.Errorf("%q: extracted a file that isn't in the archive", kind)
+			}
+		}
+	}
+
+	if _, err := extract(filepath.Join(t.TempDir(), "x"), "rar", "tool", filepath.Join(t.TempDir(), "tool")); err == nil {
+		t.Error("extracted an unsupported archive type")
+	}
+}
@@ -0,0 +1,106 @@
+package deps
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var toolNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Manifest pins the external tools the agent runs.
+type Manifest struct {
+	Tools []Tool `json:"tools"`
+}
+
+// Tool is one pinned version of a tool, with a download per platform.
+type Tool struct {
+	Name    string     `json:"name"`
+	Version string     `json:"version"`
+	Files   []Download `json:"files"`
+}
+
+// Download is where a tool comes from on one OS and architecture.
+type Download struct {
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`            // of the file at URL
+	Archive string `json:"archive,omitempty"` // tar.gz, zip, or empty for a bare executable
+	Binary  string `json:"binary,omitempty"`  // executable inside the archive, the tool name by default
+}
+
+// LoadManifest reads a manifest from a YAML or JSON file.
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// decode generically first so the json tags apply to YAML too
+		var raw interface{}
+		err = yaml.Unmarshal(b, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		b, err = json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var m Manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, t := range m.Tools {
+		err = t.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return &m, nil
+}
+
+func (t Tool) validate() error {
+	if !toolNameRE.MatchString(t.Name) {
+		return fmt.Errorf("invalid tool name %q", t.Name)
+	}
+	if t.Version == "" {
+		return fmt.Errorf("%s has no version", t.Name)
+	}
+	for _, d := range t.Files {
+		b, err := hex.DecodeString(d.SHA256)
+		if err != nil || len(b) != 32 {
+			return fmt.Errorf("%s %s/%s has an invalid sha256", t.Name, d.OS, d.Arch)
+		}
+		switch d.Archive {
+		case "", "tar.gz", "zip":
+		default:
+			return fmt.Errorf("%s %s/%s has an unsupported archive type %q", t.Name, d.OS, d.Arch, d.Archive)
+		}
+		if d.URL == "" {
+			return fmt.Errorf("%s %s/%s has no url", t.Name, d.OS, d.Arch)
+		}
+	}
+	return nil
+}
+
+// download finds the file for a platform.
+func (t Tool) download(goos, goarch string) (Download, bool) {
+	for _, d := range t.Files {
+		if d.OS == goos && d.Arch == goarch {
+			return d, true
+		}
+	}
+	return Download{}, false
+}
@@ -7,19 +7,37 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	defaultConfig = "HOST=https://api.netwatcher.io\nHOST_WS=wss://api.netwatcher.io/agent_ws\nID=\nPIN=\n"
+	defaultConfig  = "HOST=https://api.netwatcher.io\nHOST_WS=wss://api.netwatcher.io/agent_ws\nID=\nPIN=\n"
+	defaultDataDir = "./data"
 )
 
 var (
 	// This will be set at build time using -ldflags
 	buildDate string
 	VERSION   string
+	// base64 ed25519 key self-updates must be signed with, set at build
+	// time; updates are disabled without it
+	updatePublicKey string
+	// release version of the build, eg. 1.2.0, set at build time; only
+	// newer releases are installed, updates are disabled without it
+	releaseVersion string
 )
 
+// environmentKeys are the keys set by the environment rather than the
+// config file, which the file doesn't override, not even on reload.
+var environmentKeys = map[string]bool{}
+
+// processEnviron is the environment the agent was started with, before
+// the config file was loaded.
+var processEnviron []string
+
 func getExecutableHash() (string, error) {
 	exePath, err := os.Executable()
 	if err != nil {
@@ -69,6 +87,12 @@ func loadConfig(configFile string) error {
 		fmt.Printf("Running in DEVELOPMENT mode.\n")
 	}
 
+	processEnviron = os.Environ()
+	for _, kv := range processEnviron {
+		key, _, _ := strings.Cut(kv, "=")
+		environmentKeys[key] = true
+	}
+
 	err = godotenv.Load(configFile)
 	if err != nil {
 		return err
@@ -76,3 +100,121 @@ func loadConfig(configFile string) error {
 
 	return nil
 }
+
+// readConfigChanges reads the config file again and sets the keys that
+// changed since it was loaded, unsetting those that were removed. It
+// returns the changed keys, sorted; keys empty before and after aren't
+// changes.
+func readConfigChanges(configFile string) ([]string, error) {
+	values, err := godotenv.Read(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for key, v := range values {
+		if environmentKeys[key] {
+			continue
+		}
+		// an unset key and an empty one are the same, eg. the PIN once
+		// the agent has enrolled
+		if os.Getenv(key) == v {
+			continue
+		}
+		err = os.Setenv(key, v)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, key)
+	}
+	for _, kv := range os.Environ() {
+		key, v, _ := strings.Cut(kv, "=")
+		if _, ok := values[key]; ok || environmentKeys[key] {
+			continue
+		}
+		os.Unsetenv(key)
+		if v != "" {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// clearConfigValue empties key in the config file, eg. the PIN once the
+// agent has enrolled and logs in with its own secret.
+func clearConfigValue(configFile, key string) error {
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		name, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		if ok && strings.TrimSpace(name) == key {
+			lines[i] = key + "="
+		}
+	}
+
+	tmp := configFile + ".tmp"
+	err = os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, configFile)
+}
+
+// dataDir is where the agent keeps state that must survive restarts.
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return defaultDataDir
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %q, using %s\n", key, v, def)
+		return def
+	}
+	return d
+}
+
+func envInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %q, using %d\n", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envList splits a comma separated config key, eg. "zstd, gzip".
+func envList(key, def string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		v = def
+	}
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestClearConfigValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.conf")
+	config := "# agent\nHOST=https://api.netwatcher.io\nID=agent\nPIN=123456\nPINNED=keep\nexport PIN = 654321\n"
+	if err := os.WriteFile(path, []byte(config), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clearConfigValue(path, "PIN"); err != nil {
+		t.Fatalf("clearConfigValue() = %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# agent\nHOST=https://api.netwatcher.io\nID=agent\nPIN=\nPINNED=keep\nPIN=\n"
+	if string(b) != want {
+		t.Errorf("config after clearing the PIN:\n%s\nwant:\n%s", b, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm != 0640 {
+		t.Errorf("config mode changed to %o", perm)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := clearConfigValue(filepath.Join(t.TempDir(), "missing.conf"), "PIN"); err == nil {
+		t.Error("clearConfigValue() succeeded without a config file")
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	tests := map[string]float64{
+		"":     0.1,
+		"0":    0,
+		"25":   0.25,
+		"100":  1,
+		"-1":   0.1,
+		"101":  0.1,
+		"lots": 0.1,
+	}
+	for v, want := range tests {
+		t.Setenv("SCHEDULE_JITTER", v)
+		if got := scheduleJitter(); got != want {
+			t.Errorf("SCHEDULE_JITTER=%q: scheduleJitter() = %v, want %v", v, got, want)
+		}
+	}
+}
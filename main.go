@@ -1,56 +1,113 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/deps"
 	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/proxy"
+	"github.com/netwatcherio/netwatcher-agent/status"
+	"github.com/netwatcherio/netwatcher-agent/update"
 	"github.com/netwatcherio/netwatcher-agent/workers"
 	"github.com/netwatcherio/netwatcher-agent/ws"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const defaultShutdownTimeout = 15 * time.Second
+
 func main() {
+	if runCommand() {
+		return
+	}
+
 	fmt.Printf("Starting NetWatcher Agent...\n")
 
-	var configPath string
+	var configPath, probesPath, resultsPath string
+	var offline bool
 	flag.StringVar(&configPath, "config", "./config.conf", "Path to the config file")
+	flag.StringVar(&probesPath, "probes", "", "Path to a YAML or JSON file of probe definitions to run locally")
+	flag.BoolVar(&offline, "offline", false, "Run only the probes from -probes without connecting to the controller")
+	flag.StringVar(&resultsPath, "results", "", "Also write results as JSON lines to this file, - for stdout (the default with -offline)")
 	flag.Parse()
 
 	loadConfig(configPath)
 
-	// Download dependency
-	err := downloadTrippyDependency()
+	err := proxy.Configure(os.Getenv("PROXY_URL"), os.Getenv("NO_PROXY"))
 	if err != nil {
-		log.Fatalf("Failed to download dependency: %v", err)
+		log.Fatalf("Invalid proxy configuration: %v", err)
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	workers.SetScheduleJitter(scheduleJitter())
+	workers.SetConcurrencyLimits(concurrencyLimits())
 
-	go func() {
-		for _ = range c {
-			shutdown()
-			return
+	var localProbes []probes.Probe
+	if probesPath != "" {
+		var err error
+		localProbes, err = probes.LoadProbeFile(probesPath)
+		if err != nil {
+			log.Fatalf("Failed to load probes: %v", err)
 		}
-	}()
+		log.Infof("Loaded %d probes from %s", len(localProbes), probesPath)
+	} else if offline {
+		log.Fatal("-offline requires -probes")
+	}
+
+	installDependencies(offline)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(configPath, cancel)
+
+	// the metrics and status APIs keep serving while shutdown drains
+	servers, stopServers := context.WithCancel(context.Background())
+	defer stopServers()
 
 	var probeGetCh = make(chan []probes.Probe)
 	var probeDataCh = make(chan probes.ProbeData)
 
+	// an agent without a valid ID can still run local probes
+	thisAgent, err := primitive.ObjectIDFromHex(os.Getenv("ID"))
+	if err != nil && !offline {
+		return
+	}
+
+	if offline {
+		if resultsPath == "" {
+			resultsPath = "-"
+		}
+		sinks, err := buildSinks(servers, nil, nil, resultsPath)
+		if err != nil {
+			log.Fatalf("Failed to set up sinks: %v", err)
+		}
+
+		log.Info("Running in offline mode, the controller will not be contacted")
+		startStatusServer(servers, nil, nil)
+		stopData := workers.InitProbeDataWorker(probeDataCh, sinks)
+		workers.InitProbeWorker(ctx, probeGetCh, probeDataCh, thisAgent)
+		probeGetCh <- localProbes
+		<-ctx.Done()
+		shutdown(nil, stopData, stopServers)
+		return
+	}
+
+	outbox, err := workers.NewOutbox(filepath.Join(dataDir(), "outbox"), envInt64("OUTBOX_MAX_BYTES", 0), envInt64("OUTBOX_SEGMENT_BYTES", 0))
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+
 	wsH := &ws.WebSocketHandler{
 		Host:         os.Getenv("HOST"),
 		HostWS:       os.Getenv("HOST_WS"),
@@ -58,26 +115,67 @@ func main() {
 		ID:           os.Getenv("ID"),
 		AgentVersion: VERSION,
 		ProbeGetCh:   probeGetCh,
+		ConnectedCh:  make(chan struct{}, 1),
+		ProbeAckCh:   make(chan primitive.ObjectID, 256),
+		UpdateCh:     make(chan update.Release, 1),
+		IdentityPath: filepath.Join(dataDir(), "identity.json"),
+		TLSConfig:    controllerTLSConfig(),
+	}
+	wsH.UploadOptions = uploadOptions()
+	wsH.Enrolled = func() {
+		os.Unsetenv("PIN")
+		err := clearConfigValue(configPath, "PIN")
+		if err != nil {
+			log.Warnf("Failed to remove the PIN from %s: %v", configPath, err)
+		}
 	}
-	wsH.InitWS()
+	gate := newRestartGate(cancel)
+	startUpdater(ctx, wsH, gate)
+	wsH.Commands = remoteCommands(startStatusServer(servers, wsH, outbox))
+
+	if len(localProbes) > 0 {
+		// local probes are merged into every list the controller sends, and
+		// start running straight away rather than waiting for a login
+		var workerCh = make(chan []probes.Probe)
+		workers.MergeProbes(localProbes, probeGetCh, workerCh)
+		workers.InitProbeWorker(ctx, workerCh, probeDataCh, thisAgent)
+		go wsH.InitWS(ctx)
+	} else if wsH.InitWS(ctx) != nil {
+		// stopped before ever connecting, nothing to drain
+		outbox.Close()
+		log.Info("NetWatcher Agent stopped")
+		gate.done()
+		return
+	}
+
 	// init the config getter before starting the probe workers?
-	workers.InitProbeDataWorker(wsH, probeDataCh)
+	sinks, err := buildSinks(servers, wsH, outbox, resultsPath)
+	if err != nil {
+		log.Fatalf("Failed to set up sinks: %v", err)
+	}
+	stopData := workers.InitProbeDataWorker(probeDataCh, sinks)
 
 	go func(ws *ws.WebSocketHandler) {
+		ticker := time.NewTicker(time.Minute * 1)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Minute * 1)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if !ws.IsConnected() {
+				continue
+			}
 			log.Info("Getting probes again...")
-			ws.GetConnection().Emit("probe_get", []byte("please"))
+			ws.RequestProbes()
 		}
 	}(wsH)
 
-	thisAgent, err := primitive.ObjectIDFromHex(wsH.ID)
-	if err != nil {
-		return
+	if len(localProbes) == 0 {
+		workers.InitProbeWorker(ctx, probeGetCh, probeDataCh, thisAgent)
 	}
 
-	workers.InitProbeWorker(probeGetCh, probeDataCh, thisAgent)
-
 	// todo handle if on start it isn't able to pull information from backend??
 	// eg. power goes out but network fails to come up?
 
@@ -85,231 +183,317 @@ func main() {
 	// if a list of probes is received, send it to the channel for inbound probes and such
 	// once receiving probes, have it cycle through, set the unique id for it, if a different one exists as the same ID,
 	//update/remove it, n use the new settings
-	select {}
+	<-ctx.Done()
+	shutdown(wsH, stopData, stopServers)
+	gate.done()
 }
 
-func shutdown() {
-	log.Fatalf("Currently %d threads", runtime.NumGoroutine())
-	log.Fatal("Shutting down NetWatcher Agent...")
+// restartGate lets the updater shut the agent down the usual way before
+// it restarts into another binary.
+type restartGate struct {
+	cancel     context.CancelFunc
+	once       sync.Once
+	restarting chan struct{}
+	stopped    chan struct{}
 }
 
-func downloadTrippyDependency() error {
-	var version = "0.13.0"
-	baseURL := "https://github.com/fujiapple852/trippy/releases/download/" + version + "/"
+func newRestartGate(cancel context.CancelFunc) *restartGate {
+	return &restartGate{
+		cancel:     cancel,
+		restarting: make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
 
-	var fileName, extractedName string
+// stop cancels the agent and waits until main has shut it down.
+func (g *restartGate) stop() {
+	g.once.Do(func() { close(g.restarting) })
+	g.cancel()
+	<-g.stopped
+}
 
-	switch runtime.GOOS {
-	case "windows":
-		if runtime.GOARCH == "amd64" {
-			fileName = "trippy-VER-x86_64-pc-windows-msvc.zip"
-		} else {
-			fileName = "trippy-VER-aarch64-pc-windows-msvc.zip"
-		}
-		extractedName = "trip.exe"
-	case "darwin":
-		fileName = "trippy-VER-x86_64-apple-darwin.tar.gz"
-		extractedName = "trip"
-	case "linux":
-		if runtime.GOARCH == "amd64" {
-			fileName = "trippy-VER-x86_64-unknown-linux-musl.tar.gz"
-		} else if runtime.GOARCH == "arm64" {
-			fileName = "trippy-VER-aarch64-unknown-linux-musl.tar.gz"
-		} else {
-			return fmt.Errorf("unsupported Linux architecture: %s", runtime.GOARCH)
-		}
-		extractedName = "trip"
+// done is called by main once the agent has shut down. While the updater
+// is restarting the agent it never returns, the process is replaced or
+// the updater exits.
+func (g *restartGate) done() {
+	close(g.stopped)
+	select {
+	case <-g.restarting:
+		select {}
 	default:
-		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
+}
 
-	var format = strings.Replace(fileName, "VER", version, -1)
-	url := baseURL + format
-	libPath := filepath.Join(".", "lib")
-	os.MkdirAll(libPath, os.ModePerm)
-	filePath := filepath.Join(libPath, extractedName)
-
-	// Check if file already exists
-	if _, err := os.Stat(filePath); err == nil {
-		log.Printf("Trippy binary already exists: %s\n", filePath)
-		return nil
-	}
+// handleSignals cancels the agent's context on SIGINT or SIGTERM, a second
+// one exits straight away. SIGHUP reloads the config file.
+func handleSignals(configPath string, cancel context.CancelFunc) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	log.Printf("Downloading %s to %s\n", url, filePath)
+	go func() {
+		stopping := false
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				log.Infof("Reloading %s", configPath)
+				err := reloadConfig(configPath)
+				if err != nil {
+					log.Errorf("Failed to reload %s: %v", configPath, err)
+				}
+				continue
+			}
+			if stopping {
+				log.Warnf("Received %s again, exiting without waiting", sig)
+				os.Exit(1)
+			}
+			stopping = true
+			log.Infof("Received %s, shutting down NetWatcher Agent...", sig)
+			cancel()
+		}
+	}()
+}
 
-	// Download file
-	tempFilePath := filePath + ".temp"
-	err := downloadFile(url, tempFilePath)
+// reloadConfig applies the changes to the config file that don't need a
+// restart: the proxy, the schedule jitter, the concurrency limits and the
+// number of results kept for the status API.
+func reloadConfig(configPath string) error {
+	changed, err := readConfigChanges(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to download file: %v", err)
+		return err
+	}
+	if len(changed) == 0 {
+		log.Infof("%s is unchanged", configPath)
+		return nil
 	}
 
-	var newHash string
-	if runtime.GOOS == "windows" {
-		newHash, err = extractZipAndHash(tempFilePath, libPath)
-		if err != nil {
-			os.Remove(tempFilePath)
-			return fmt.Errorf("failed to extract archive: %v", err)
-		}
-		// Remove the temporary zip file
-		os.Remove(tempFilePath)
-	} else {
-		// Extract the tar.gz for Linux and macOS
-		newHash, err = extractTarGzAndHash(tempFilePath, libPath)
-		if err != nil {
-			os.Remove(tempFilePath)
-			return fmt.Errorf("failed to extract archive: %v", err)
+	var restart []string
+	for _, key := range changed {
+		switch {
+		case key == "PROXY_URL" || key == "NO_PROXY":
+			err := proxy.Configure(os.Getenv("PROXY_URL"), os.Getenv("NO_PROXY"))
+			if err != nil {
+				log.Errorf("Invalid proxy configuration, keeping the current proxy: %v", err)
+			}
+		case key == "SCHEDULE_JITTER":
+			workers.SetScheduleJitter(scheduleJitter())
+		case strings.HasPrefix(key, "PROBE_CONCURRENCY"):
+			workers.SetConcurrencyLimits(concurrencyLimits())
+		case key == "STATUS_RESULTS":
+			if n := envInt64("STATUS_RESULTS", 0); n > 0 {
+				workers.SetStatusResultsLimit(int(n))
+			}
+		default:
+			restart = append(restart, key)
+			continue
 		}
-		// Remove the temporary tar.gz file
-		os.Remove(tempFilePath)
+		log.Infof("Reloaded %s", key)
+	}
+	if len(restart) > 0 {
+		log.Warnf("Changes to %s take effect after a restart", strings.Join(restart, ", "))
 	}
+	return nil
+}
 
-	log.Printf("Downloaded trippy binary: %s\n", filePath)
+// shutdown waits for the probes to stop, delivers or spools the results
+// still on their way, stops the metrics and status APIs and disconnects,
+// giving up after SHUTDOWN_TIMEOUT. wsH is nil when running offline.
+func shutdown(wsH *ws.WebSocketHandler, stopData func(ctx context.Context), stopServers context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
 
-	// Make the file executable
-	err = os.Chmod(filePath, 0755)
+	err := workers.Wait(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to make file executable: %v", err)
+		log.Warnf("Shutdown deadline passed before every probe stopped")
 	}
-
-	// Store the hash for future comparisons
-	err = os.WriteFile(filePath+".hash", []byte(newHash), 0644)
-	if err != nil {
-		log.Printf("Failed to write hash file: %v", err)
+	stopData(ctx)
+	stopServers()
+	if wsH != nil {
+		wsH.Close()
 	}
-
-	return nil
+	log.Info("NetWatcher Agent stopped")
 }
 
-func extractTarGzAndHash(archivePath, destPath string) (string, error) {
-	file, err := os.Open(archivePath)
-	if err != nil {
-		return "", err
+// defaultScheduleJitter is SCHEDULE_JITTER when it isn't set, a percentage
+// of a probe's interval.
+const defaultScheduleJitter = 10
+
+// scheduleJitter reads SCHEDULE_JITTER as a fraction of a probe's interval,
+// falling back to the default when it's out of range.
+func scheduleJitter() float64 {
+	pct := envInt64("SCHEDULE_JITTER", defaultScheduleJitter)
+	if pct < 0 || pct > 100 {
+		log.Warnf("SCHEDULE_JITTER must be between 0 and 100, using %d", defaultScheduleJitter)
+		pct = defaultScheduleJitter
 	}
-	defer file.Close()
+	return float64(pct) / 100
+}
 
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		return "", err
+// concurrencyLimits reads PROBE_CONCURRENCY and the per-type
+// PROBE_CONCURRENCY_<TYPE> overrides, eg. PROBE_CONCURRENCY_MTR, on top of
+// the defaults.
+func concurrencyLimits() workers.Limits {
+	limits := workers.Limits{
+		Global:  int(envInt64("PROBE_CONCURRENCY", int64(defaultConcurrencyLimits.Global))),
+		PerType: make(map[probes.ProbeType]int),
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
-
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
-		}
-
-		if header.Typeflag == tar.TypeReg && filepath.Base(header.Name) == "trip" {
-			outPath := filepath.Join(destPath, "trip")
-			outFile, err := os.Create(outPath)
-			if err != nil {
-				return "", err
-			}
-			defer outFile.Close()
-
-			hasher := sha256.New()
-			writer := io.MultiWriter(outFile, hasher)
-
-			if _, err := io.Copy(writer, tr); err != nil {
-				return "", err
-			}
-
-			log.Printf("Extracted file: %s\n", header.Name)
-			return hex.EncodeToString(hasher.Sum(nil)), nil
-		}
+	for t, n := range defaultConcurrencyLimits.PerType {
+		limits.PerType[t] = n
 	}
 
-	return "", fmt.Errorf("'trip' binary not found in archive")
+	for _, t := range []probes.ProbeType{
+		probes.ProbeType_MTR,
+		probes.ProbeType_PING,
+		probes.ProbeType_SPEEDTEST,
+		probes.ProbeType_SPEEDTEST_SERVERS,
+		probes.ProbeType_NETWORKINFO,
+		probes.ProbeType_SYSTEMINFO,
+	} {
+		limits.PerType[t] = int(envInt64("PROBE_CONCURRENCY_"+string(t), int64(limits.PerType[t])))
+	}
+	return limits
 }
 
-func extractZipAndHash(archivePath, destPath string) (string, error) {
-	reader, err := zip.OpenReader(archivePath)
+// defaultConcurrencyLimits are the limits without any PROBE_CONCURRENCY
+// keys, for reloads to start from.
+var defaultConcurrencyLimits = workers.ConcurrencyLimits
+
+// controllerTLSConfig builds the TLS settings for the controller
+// connections from the TLS_* config keys.
+func controllerTLSConfig() *tls.Config {
+	cfg, err := ws.TLSOptions{
+		CAFile:     os.Getenv("TLS_CA_FILE"),
+		CertFile:   os.Getenv("TLS_CERT_FILE"),
+		KeyFile:    os.Getenv("TLS_KEY_FILE"),
+		ServerName: os.Getenv("TLS_SERVER_NAME"),
+		MinVersion: os.Getenv("TLS_MIN_VERSION"),
+	}.Config()
 	if err != nil {
-		return "", err
+		log.Fatalf("Invalid TLS configuration: %v", err)
 	}
-	defer reader.Close()
-
-	for _, file := range reader.File {
-		if filepath.Base(file.Name) == "trip.exe" {
-			outPath := filepath.Join(destPath, "trip.exe")
-
-			src, err := file.Open()
-			if err != nil {
-				return "", err
-			}
-			defer src.Close()
-
-			dst, err := os.Create(outPath)
-			if err != nil {
-				return "", err
-			}
-			defer dst.Close()
-
-			hasher := sha256.New()
-			writer := io.MultiWriter(dst, hasher)
-
-			if _, err := io.Copy(writer, src); err != nil {
-				return "", err
-			}
+	return cfg
+}
 
-			fmt.Printf("Extracted file: %s\n", file.Name)
-			return hex.EncodeToString(hasher.Sum(nil)), nil
-		}
+// uploadOptions reads the probe_post formats offered to the controller
+// from the UPLOAD_* config keys.
+func uploadOptions() ws.UploadOptions {
+	compressions := envList("UPLOAD_COMPRESSION", "zstd,gzip")
+	if len(compressions) == 1 && compressions[0] == "none" {
+		compressions = nil
 	}
-
-	return "", fmt.Errorf("'netwatcher-agent.exe' not found in archive")
+	opts := ws.UploadOptions{
+		Encodings:    envList("UPLOAD_ENCODINGS", ""),
+		Compressions: compressions,
+		Batch:        envInt64("UPLOAD_BATCH_SIZE", 1) > 1,
+	}
+	err := opts.Validate()
+	if err != nil {
+		log.Fatalf("Invalid upload configuration: %v", err)
+	}
+	return opts
 }
 
-func getFileHash(filePath string) (string, error) {
-	f, err := os.Open(filePath)
+// installDependencies installs the tools pinned in DEPS_MANIFEST. Failures
+// are only logged, the probes needing a missing tool fail on their own.
+func installDependencies(offline bool) {
+	path := os.Getenv("DEPS_MANIFEST")
+	if path == "" {
+		return
+	}
+	manifest, err := deps.LoadManifest(path)
 	if err != nil {
-		return "", err
+		log.Warnf("Failed to load dependency manifest: %v", err)
+		return
 	}
-	defer f.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("DEPS_TIMEOUT", 5*time.Minute))
+	defer cancel()
+	m := deps.Manager{
+		Dir:     filepath.Join(".", "lib"),
+		Mirror:  os.Getenv("DEPS_MIRROR"),
+		Offline: offline,
+		Client:  &http.Client{Transport: proxy.Transport()},
+	}
+	err = m.Install(ctx, manifest)
+	if err != nil {
+		log.Warnf("Failed to install dependencies: %v", err)
 	}
-
-	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func isUpdateNeeded(filePath string) bool {
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return true
+// startUpdater applies the releases the controller advertises, and those
+// published at UPDATE_URL, and watches a freshly updated agent so it is
+// rolled back if it doesn't reconnect.
+func startUpdater(ctx context.Context, wsH *ws.WebSocketHandler, gate *restartGate) {
+	if updatePublicKey == "" || os.Getenv("UPDATE_DISABLED") == "true" {
+		log.Info("Self-update is disabled")
+		wsH.UpdateCh = nil
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		log.Errorf("Invalid update public key, self-update is disabled")
+		wsH.UpdateCh = nil
+		return
+	}
+	err = update.CheckVersion(releaseVersion)
+	if err != nil {
+		log.Errorf("Invalid release version, self-update is disabled: %v", err)
+		wsH.UpdateCh = nil
+		return
 	}
 
-	hashFile := filePath + ".hash"
-	_, err = os.Stat(hashFile)
-	if os.IsNotExist(err) {
-		return true
+	u := &update.Updater{
+		PublicKey:     key,
+		Version:       releaseVersion,
+		StatePath:     filepath.Join(dataDir(), "update.json"),
+		RollbackAfter: envDuration("UPDATE_ROLLBACK_AFTER", 10*time.Minute),
+		Timeout:       envDuration("UPDATE_TIMEOUT", 10*time.Minute),
+		Connected:     wsH.IsConnected,
+		Client:        &http.Client{Transport: proxy.Transport()},
+		Shutdown:      gate.stop,
+		// the config file is read again by the new process, keys from it
+		// mustn't look like they came from the environment
+		Environ: processEnviron,
 	}
+	u.Watch(ctx)
 
-	// If both files exist, assume it's up to date
-	return false
+	go func() {
+		for r := range wsH.UpdateCh {
+			err := u.Apply(ctx, r)
+			if err != nil {
+				log.Errorf("Failed to update to %s: %v", r.Version, err)
+			}
+		}
+	}()
+	if url := os.Getenv("UPDATE_URL"); url != "" {
+		go u.Poll(ctx, url, envDuration("UPDATE_INTERVAL", time.Hour))
+	}
 }
 
-func downloadFile(url string, filePath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+// startStatusServer serves the local status API when STATUS_LISTEN is set,
+// until ctx is done, and returns the server for the reports. wsH is nil
+// when running offline.
+func startStatusServer(ctx context.Context, wsH *ws.WebSocketHandler, outbox *workers.Outbox) *status.Server {
+	if n := envInt64("STATUS_RESULTS", 0); n > 0 {
+		workers.SetStatusResultsLimit(int(n))
 	}
-	defer resp.Body.Close()
 
-	out, err := os.Create(filePath)
-	if err != nil {
-		return err
+	srv := &status.Server{
+		Agent: status.AgentInfo{
+			ID:       os.Getenv("ID"),
+			Version:  VERSION,
+			Hostname: hostname(),
+			Started:  time.Now(),
+		},
+		Outbox:      outbox,
+		AllowRemote: os.Getenv("STATUS_ALLOW_REMOTE") == "true",
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	if wsH != nil {
+		srv.Host = wsH.HostWS
+		srv.Connected = wsH.IsConnected
+	}
+	// the report is also what dump_state answers with, so it is built even
+	// without a listener
+	if addr := os.Getenv("STATUS_LISTEN"); addr != "" {
+		go srv.ListenAndServe(ctx, addr)
+	}
+	return srv
 }
@@ -0,0 +1,255 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOTLPInterval  = 30 * time.Second
+	otlpMaxPendingPoints = 20000
+	otlpScopeName        = "github.com/netwatcherio/netwatcher-agent"
+)
+
+// OTLPExporter pushes probe results as OTLP gauges to a collector using
+// the OTLP/HTTP JSON encoding. Results are batched and sent every
+// Interval; a failed push is retried with the next batch.
+type OTLPExporter struct {
+	Endpoint string            // collector base URL, /v1/metrics is appended
+	Headers  map[string]string // eg. authentication headers
+	Interval time.Duration
+	Resource map[string]string // resource attributes such as host.name
+	Agent    string
+	Version  string
+	Lookup   ProbeLookup
+
+	client  *http.Client
+	mu      sync.Mutex
+	pending []timedSample
+}
+
+type timedSample struct {
+	at     time.Time
+	sample Sample
+}
+
+// NewOTLPExporter returns an exporter pushing to endpoint.
+func NewOTLPExporter(endpoint, agent, version string, resource, headers map[string]string, lookup ProbeLookup) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Headers:  headers,
+		Interval: defaultOTLPInterval,
+		Resource: resource,
+		Agent:    agent,
+		Version:  version,
+		Lookup:   lookup,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Name() string {
+	return "otlp"
+}
+
+func (e *OTLPExporter) Write(pd probes.ProbeData) error {
+	samples := Samples(pd, ProbeLabels(e.Agent, pd, e.Lookup))
+	at := resultTime(pd)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range samples {
+		e.pending = append(e.pending, timedSample{at: at, sample: s})
+	}
+	if over := len(e.pending) - otlpMaxPendingPoints; over > 0 {
+		log.Warnf("OTLP: dropping %d data points, the collector is not keeping up", over)
+		e.pending = e.pending[over:]
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Close() error {
+	return e.flush()
+}
+
+// Run pushes pending data points every Interval, forever.
+func (e *OTLPExporter) Run() {
+	if e.Interval <= 0 {
+		e.Interval = defaultOTLPInterval
+	}
+	log.Infof("Exporting OTLP metrics to %s/v1/metrics every %s", e.Endpoint, e.Interval)
+
+	for {
+		time.Sleep(e.Interval)
+		err := e.flush()
+		if err != nil {
+			log.Errorf("OTLP: %v", err)
+		}
+	}
+}
+
+func (e *OTLPExporter) flush() error {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(e.buildRequest(batch))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.Endpoint+"/v1/metrics", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			err = fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+	}
+	if err != nil {
+		// put the batch back in front of anything written meanwhile
+		e.mu.Lock()
+		e.pending = append(batch, e.pending...)
+		if over := len(e.pending) - otlpMaxPendingPoints; over > 0 {
+			e.pending = e.pending[over:]
+		}
+		e.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// The types below follow the JSON mapping of the OTLP metrics protobuf.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func (e *OTLPExporter) buildRequest(batch []timedSample) otlpRequest {
+	byName := make(map[string]*otlpMetric)
+	var names []string
+
+	for _, ts := range batch {
+		m, ok := byName[ts.sample.Name]
+		if !ok {
+			m = &otlpMetric{Name: ts.sample.Name, Description: ts.sample.Help}
+			byName[ts.sample.Name] = m
+			names = append(names, ts.sample.Name)
+		}
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpDataPoint{
+			Attributes:   otlpAttributes(ts.sample.Labels),
+			TimeUnixNano: strconv.FormatInt(ts.at.UnixNano(), 10),
+			AsDouble:     ts.sample.Value,
+		})
+	}
+	sort.Strings(names)
+
+	metrics := make([]otlpMetric, 0, len(names))
+	for _, n := range names {
+		metrics = append(metrics, *byName[n])
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: otlpAttributes(e.Resource)},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: otlpScopeName, Version: e.Version},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+func otlpAttributes(labels map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: labels[k]}})
+	}
+	return attrs
+}
+
+// ParseHeaders reads a comma separated list of key=value pairs, the
+// format of OTEL_EXPORTER_OTLP_HEADERS.
+func ParseHeaders(v string) map[string]string {
+	h := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		h[strings.TrimSpace(k)] = strings.TrimSpace(val)
+	}
+	return h
+}
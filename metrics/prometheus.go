@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rttBuckets are the upper bounds, in seconds, of the round trip time histograms.
+var rttBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// PrometheusExporter keeps the latest value of every probe result and
+// serves them in the Prometheus text format. It is a workers.Sink so it
+// only ever sees results that were already produced for the controller.
+type PrometheusExporter struct {
+	Agent  string
+	Lookup ProbeLookup
+
+	mu         sync.Mutex
+	series     map[string]*series
+	histograms map[string]*histogram
+}
+
+type series struct {
+	probe  primitive.ObjectID
+	sample Sample
+}
+
+type histogram struct {
+	probe   primitive.ObjectID
+	name    string
+	help    string
+	labels  map[string]string
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewPrometheusExporter returns an empty exporter for agent.
+func NewPrometheusExporter(agent string, lookup ProbeLookup) *PrometheusExporter {
+	return &PrometheusExporter{
+		Agent:      agent,
+		Lookup:     lookup,
+		series:     make(map[string]*series),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (e *PrometheusExporter) Name() string {
+	return "prometheus"
+}
+
+func (e *PrometheusExporter) Write(pd probes.ProbeData) error {
+	labels := ProbeLabels(e.Agent, pd, e.Lookup)
+	samples := Samples(pd, labels)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if prefix := replacedSeries(pd.Data); prefix != "" {
+		for k, s := range e.series {
+			if s.probe == pd.ProbeID && strings.HasPrefix(s.sample.Name, prefix) && s.sample.Labels["triggered"] == labels["triggered"] {
+				delete(e.series, k)
+			}
+		}
+	}
+
+	for _, s := range samples {
+		e.series[seriesKey(s.Name, s.Labels)] = &series{probe: pd.ProbeID, sample: s}
+	}
+
+	switch d := pd.Data.(type) {
+	case probes.PingResult:
+		if d.PacketsRecv > 0 {
+			e.observe(pd.ProbeID, "netwatcher_ping_rtt_seconds", "Distribution of the average round trip time of ping runs.", labels, d.AvgRtt.Seconds())
+		}
+	case probes.TrafficSimResult:
+		if d.TotalPackets > d.LostPackets {
+			e.observe(pd.ProbeID, "netwatcher_trafficsim_rtt_seconds", "Distribution of the average round trip time of TrafficSim cycles.", labels, d.AverageRTT/1000)
+		}
+	}
+
+	return nil
+}
+
+// replacedSeries returns the prefix of the series a result replaces
+// entirely: a new MTR result all hops of the previous one, a new network
+// info result the addresses of the previous one, since they are labels.
+func replacedSeries(data interface{}) string {
+	switch data.(type) {
+	case probes.MtrResult:
+		return "netwatcher_mtr_"
+	case probes.NetworkInfoResult:
+		return "netwatcher_netinfo_"
+	}
+	return ""
+}
+
+func (e *PrometheusExporter) observe(probe primitive.ObjectID, name, help string, labels map[string]string, v float64) {
+	key := seriesKey(name, labels)
+	h, ok := e.histograms[key]
+	if !ok {
+		h = &histogram{probe: probe, name: name, help: help, labels: labels, buckets: make([]uint64, len(rttBuckets))}
+		e.histograms[key] = h
+	}
+	for i, b := range rttBuckets {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (e *PrometheusExporter) Close() error {
+	return nil
+}
+
+// ServeHTTP writes every series in the Prometheus text exposition format.
+// Series of probes that have since been removed from the agent are dropped.
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	e.prune()
+
+	type family struct {
+		help, kind string
+		lines      []string
+	}
+	families := make(map[string]*family)
+	get := func(name, help, kind string) *family {
+		f, ok := families[name]
+		if !ok {
+			f = &family{help: help, kind: kind}
+			families[name] = f
+		}
+		return f
+	}
+
+	for _, s := range e.series {
+		f := get(s.sample.Name, s.sample.Help, "gauge")
+		f.lines = append(f.lines, s.sample.Name+formatLabels(s.sample.Labels)+" "+formatValue(s.sample.Value))
+	}
+	// histogram lines stay in bucket order, the histograms themselves are
+	// sorted by their labels
+	keys := make([]string, 0, len(e.histograms))
+	for k := range e.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := e.histograms[k]
+		f := get(h.name, h.help, "histogram")
+		for i, b := range rttBuckets {
+			f.lines = append(f.lines, h.name+"_bucket"+formatLabels(h.labels, "le", formatValue(b))+" "+strconv.FormatUint(h.buckets[i], 10))
+		}
+		f.lines = append(f.lines,
+			h.name+"_bucket"+formatLabels(h.labels, "le", "+Inf")+" "+strconv.FormatUint(h.count, 10),
+			h.name+"_sum"+formatLabels(h.labels)+" "+formatValue(h.sum),
+			h.name+"_count"+formatLabels(h.labels)+" "+strconv.FormatUint(h.count, 10))
+	}
+	e.mu.Unlock()
+
+	names := make([]string, 0, len(families))
+	for n := range families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, n := range names {
+		f := families[n]
+		if f.kind == "gauge" {
+			sort.Strings(f.lines)
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", n, f.help, n, f.kind)
+		for _, l := range f.lines {
+			buf.WriteString(l)
+			buf.WriteByte('\n')
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (e *PrometheusExporter) prune() {
+	if e.Lookup == nil {
+		return
+	}
+	for k, s := range e.series {
+		if _, ok := e.Lookup(s.probe); !ok {
+			delete(e.series, k)
+		}
+	}
+	for k, h := range e.histograms {
+		if _, ok := e.Lookup(h.probe); !ok {
+			delete(e.histograms, k)
+		}
+	}
+}
+
+// ListenAndServe serves /metrics on addr until ctx is done or the listener
+// fails.
+func (e *PrometheusExporter) ListenAndServe(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			return
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("Serving Prometheus metrics on http://%s/metrics", addr)
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Prometheus exporter stopped: %v", err)
+	}
+}
+
+func seriesKey(name string, labels map[string]string) string {
+	return name + formatLabels(labels)
+}
+
+// formatLabels renders labels sorted by name, with extra name/value pairs appended last.
+func formatLabels(labels map[string]string, extra ...string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+"=\""+escapeLabel(labels[k])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,282 @@
+package metrics
+
+import (
+	"context"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	pingProbe, _ = primitive.ObjectIDFromHex("65a000000000000000000001")
+	mtrProbe, _  = primitive.ObjectIDFromHex("65a000000000000000000002")
+	infoProbe, _ = primitive.ObjectIDFromHex("65a000000000000000000003")
+	resultTime0  = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+)
+
+// lookupOf returns a ProbeLookup over pp.
+func lookupOf(pp map[primitive.ObjectID]probes.Probe) ProbeLookup {
+	return func(id primitive.ObjectID) (probes.Probe, bool) {
+		p, ok := pp[id]
+		return p, ok
+	}
+}
+
+// scrape returns what the exporter serves on /metrics.
+func scrape(t *testing.T, e *PrometheusExporter) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+// scraped returns the lines of a scrape for the given series name, without
+// comments.
+func scraped(body, name string) []string {
+	var lines []string
+	for _, l := range strings.Split(body, "\n") {
+		if strings.HasPrefix(l, name+"{") || strings.HasPrefix(l, name+" ") {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func TestPrometheusServeHTTP(t *testing.T) {
+	pp := map[primitive.ObjectID]probes.Probe{
+		pingProbe: {ID: pingProbe, Type: probes.ProbeType_PING, Config: probes.ProbeConfig{Target: []probes.ProbeTarget{{Target: "host \"a\"\\b\nc"}}}},
+	}
+	e := NewPrometheusExporter("agent-1", lookupOf(pp))
+	e.Write(probes.ProbeData{ProbeID: pingProbe, CreatedAt: resultTime0, Data: probes.PingResult{
+		PacketsSent: 4,
+		PacketsRecv: 3,
+		PacketLoss:  25,
+		MinRtt:      10 * time.Millisecond,
+		AvgRtt:      20 * time.Millisecond,
+		MaxRtt:      30 * time.Millisecond,
+		StdDevRtt:   5 * time.Millisecond,
+	}})
+
+	labels := `agent="agent-1",probe_id="65a000000000000000000001",probe_type="PING",target="host \"a\"\\b\nc"`
+	want := `# HELP netwatcher_ping_packet_loss_percent Packet loss of the last ping run.
+# TYPE netwatcher_ping_packet_loss_percent gauge
+netwatcher_ping_packet_loss_percent{L} 25
+# HELP netwatcher_ping_packets_duplicate Duplicate replies during the last ping run.
+# TYPE netwatcher_ping_packets_duplicate gauge
+netwatcher_ping_packets_duplicate{L} 0
+# HELP netwatcher_ping_packets_received Packets received during the last ping run.
+# TYPE netwatcher_ping_packets_received gauge
+netwatcher_ping_packets_received{L} 3
+# HELP netwatcher_ping_packets_sent Packets sent during the last ping run.
+# TYPE netwatcher_ping_packets_sent gauge
+netwatcher_ping_packets_sent{L} 4
+# HELP netwatcher_ping_rtt_avg_seconds Average round trip time of the last ping run.
+# TYPE netwatcher_ping_rtt_avg_seconds gauge
+netwatcher_ping_rtt_avg_seconds{L} 0.02
+# HELP netwatcher_ping_rtt_max_seconds Maximum round trip time of the last ping run.
+# TYPE netwatcher_ping_rtt_max_seconds gauge
+netwatcher_ping_rtt_max_seconds{L} 0.03
+# HELP netwatcher_ping_rtt_min_seconds Minimum round trip time of the last ping run.
+# TYPE netwatcher_ping_rtt_min_seconds gauge
+netwatcher_ping_rtt_min_seconds{L} 0.01
+# HELP netwatcher_ping_rtt_seconds Distribution of the average round trip time of ping runs.
+# TYPE netwatcher_ping_rtt_seconds histogram
+netwatcher_ping_rtt_seconds_bucket{L,le="0.001"} 0
+netwatcher_ping_rtt_seconds_bucket{L,le="0.005"} 0
+netwatcher_ping_rtt_seconds_bucket{L,le="0.01"} 0
+netwatcher_ping_rtt_seconds_bucket{L,le="0.025"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="0.05"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="0.1"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="0.25"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="0.5"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="1"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="2.5"} 1
+netwatcher_ping_rtt_seconds_bucket{L,le="+Inf"} 1
+netwatcher_ping_rtt_seconds_sum{L} 0.02
+netwatcher_ping_rtt_seconds_count{L} 1
+# HELP netwatcher_ping_rtt_stddev_seconds Standard deviation of the round trip time of the last ping run.
+# TYPE netwatcher_ping_rtt_stddev_seconds gauge
+netwatcher_ping_rtt_stddev_seconds{L} 0.005
+# HELP netwatcher_probe_last_result_timestamp_seconds When the last result of a probe was produced.
+# TYPE netwatcher_probe_last_result_timestamp_seconds gauge
+netwatcher_probe_last_result_timestamp_seconds{L} 1.704164645e+09
+`
+	want = strings.ReplaceAll(want, "{L", "{"+labels)
+	if got := scrape(t, e); got != want {
+		t.Errorf("scrape:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrometheusHistogram(t *testing.T) {
+	e := NewPrometheusExporter("agent-1", nil)
+	for _, rtt := range []time.Duration{500 * time.Microsecond, 7 * time.Millisecond, 10 * time.Millisecond, 3 * time.Second} {
+		e.Write(probes.ProbeData{ProbeID: pingProbe, Data: probes.PingResult{PacketsSent: 1, PacketsRecv: 1, AvgRtt: rtt}})
+	}
+	// runs without a reply have no round trip time
+	e.Write(probes.ProbeData{ProbeID: pingProbe, Data: probes.PingResult{PacketsSent: 1}})
+	// nor do TrafficSim cycles that lost everything
+	e.Write(probes.ProbeData{ProbeID: pingProbe, Data: probes.TrafficSimResult{TotalPackets: 5, LostPackets: 5}})
+	e.Write(probes.ProbeData{ProbeID: pingProbe, Data: probes.TrafficSimResult{TotalPackets: 5, LostPackets: 1, AverageRTT: 40}})
+
+	body := scrape(t, e)
+	want := []string{
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.001"} 1`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.005"} 1`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.01"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.025"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.05"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.1"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.25"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="0.5"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="1"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="2.5"} 3`,
+		`netwatcher_ping_rtt_seconds_bucket{agent="agent-1",probe_id="65a000000000000000000001",le="+Inf"} 4`,
+	}
+	if got := scraped(body, "netwatcher_ping_rtt_seconds_bucket"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("buckets:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := scraped(body, "netwatcher_ping_rtt_seconds_sum"); len(got) != 1 || !strings.HasSuffix(got[0], " 3.0175") {
+		t.Errorf("sum %q, want 3.0175", got)
+	}
+	if got := scraped(body, "netwatcher_trafficsim_rtt_seconds_count"); len(got) != 1 || !strings.HasSuffix(got[0], " 1") {
+		t.Errorf("TrafficSim count %q, want the cycle that got replies", got)
+	}
+}
+
+func TestPrometheusPrune(t *testing.T) {
+	pp := map[primitive.ObjectID]probes.Probe{
+		pingProbe: {ID: pingProbe, Type: probes.ProbeType_PING},
+		mtrProbe:  {ID: mtrProbe, Type: probes.ProbeType_MTR},
+	}
+	e := NewPrometheusExporter("agent-1", lookupOf(pp))
+	e.Write(probes.ProbeData{ProbeID: pingProbe, Data: probes.PingResult{PacketsSent: 1, PacketsRecv: 1, AvgRtt: time.Millisecond}})
+	e.Write(probes.ProbeData{ProbeID: mtrProbe, Data: probes.MtrResult{}})
+	if body := scrape(t, e); !strings.Contains(body, pingProbe.Hex()) || !strings.Contains(body, mtrProbe.Hex()) {
+		t.Fatalf("scrape is missing a probe:\n%s", body)
+	}
+
+	// the ping probe was removed from the agent
+	delete(pp, pingProbe)
+	body := scrape(t, e)
+	if strings.Contains(body, pingProbe.Hex()) || strings.Contains(body, "netwatcher_ping_") {
+		t.Errorf("removed probe still served:\n%s", body)
+	}
+	if !strings.Contains(body, mtrProbe.Hex()) {
+		t.Errorf("pruned a probe that still exists:\n%s", body)
+	}
+}
+
+// mtr returns an MTR result through the given hop addresses, one per TTL.
+func mtr(hosts ...string) probes.MtrResult {
+	var r probes.MtrResult
+	for i, h := range hosts {
+		r.Report.Hops = append(r.Report.Hops, probes.MtrHop{TTL: i + 1, Hosts: []probes.MtrHost{{IP: h}}, LossPct: "0.0%", Sent: 10, Recv: 10, Avg: "12.5"})
+	}
+	return r
+}
+
+func TestPrometheusMtrReplacesHops(t *testing.T) {
+	e := NewPrometheusExporter("agent-1", nil)
+	e.Write(probes.ProbeData{ProbeID: mtrProbe, Data: mtr("192.0.2.1", "198.51.100.1", "203.0.113.1")})
+	e.Write(probes.ProbeData{ProbeID: mtrProbe, Triggered: true, Data: mtr("192.0.2.1", "198.51.100.9")})
+	// the route changed and got shorter
+	e.Write(probes.ProbeData{ProbeID: mtrProbe, Data: mtr("192.0.2.1", "198.51.100.2")})
+
+	body := scrape(t, e)
+	want := []string{
+		`netwatcher_mtr_hop_rtt_avg_seconds{agent="agent-1",hop="1",host="192.0.2.1",probe_id="65a000000000000000000002",triggered="true"} 0.0125`,
+		`netwatcher_mtr_hop_rtt_avg_seconds{agent="agent-1",hop="1",host="192.0.2.1",probe_id="65a000000000000000000002"} 0.0125`,
+		`netwatcher_mtr_hop_rtt_avg_seconds{agent="agent-1",hop="2",host="198.51.100.2",probe_id="65a000000000000000000002"} 0.0125`,
+		`netwatcher_mtr_hop_rtt_avg_seconds{agent="agent-1",hop="2",host="198.51.100.9",probe_id="65a000000000000000000002",triggered="true"} 0.0125`,
+	}
+	if got := scraped(body, "netwatcher_mtr_hop_rtt_avg_seconds"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hops:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := scraped(body, "netwatcher_mtr_hops"); len(got) != 2 {
+		t.Errorf("hop counts %q, want the scheduled and the triggered run", got)
+	}
+}
+
+func TestPrometheusNetInfoReplaced(t *testing.T) {
+	e := NewPrometheusExporter("agent-1", nil)
+	e.Write(probes.ProbeData{ProbeID: infoProbe, Data: probes.NetworkInfoResult{LocalAddress: "10.0.0.2", DefaultGateway: "10.0.0.1", PublicAddress: "192.0.2.10", InternetProvider: "ISP"}})
+	// the agent moved to another network
+	e.Write(probes.ProbeData{ProbeID: infoProbe, Data: probes.NetworkInfoResult{LocalAddress: "10.1.0.2", DefaultGateway: "10.1.0.1", PublicAddress: "198.51.100.20", InternetProvider: "ISP"}})
+
+	want := []string{
+		`netwatcher_netinfo_info{agent="agent-1",default_gateway="10.1.0.1",internet_provider="ISP",local_address="10.1.0.2",probe_id="65a000000000000000000003",public_address="198.51.100.20"} 1`,
+	}
+	if got := scraped(scrape(t, e), "netwatcher_netinfo_info"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("netinfo:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		extra  []string
+		want   string
+	}{
+		{nil, nil, ""},
+		{map[string]string{"b": "2", "a": "1"}, nil, `{a="1",b="2"}`},
+		{map[string]string{"a": `C:\path "x"` + "\nnext"}, nil, `{a="C:\\path \"x\"\nnext"}`},
+		{map[string]string{"a": "1"}, []string{"le", "+Inf"}, `{a="1",le="+Inf"}`},
+		{nil, []string{"le", "0.5", "dangling"}, `{le="0.5"}`},
+	}
+	for _, tt := range tests {
+		if got := formatLabels(tt.labels, tt.extra...); got != tt.want {
+			t.Errorf("formatLabels(%v, %q) = %s, want %s", tt.labels, tt.extra, got, tt.want)
+		}
+	}
+}
+
+func TestPrometheusListenAndServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		NewPrometheusExporter("agent-1", nil).ListenAndServe(ctx, addr)
+		close(done)
+	}()
+
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err = http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("GET /metrics = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics = %d", resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ListenAndServe() kept running after ctx was done")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("still listening after ctx was done")
+	}
+}
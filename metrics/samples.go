@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sample is a single measurement taken from a ProbeData, already named
+// and labelled the way it is exported.
+type Sample struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// ProbeLookup returns the probe definition for a probe ID so samples can
+// be labelled with its type and target.
+type ProbeLookup func(id primitive.ObjectID) (probes.Probe, bool)
+
+type sampleSet struct {
+	base    map[string]string
+	samples []Sample
+}
+
+func (s *sampleSet) add(name, help string, value float64, labels ...string) {
+	l := make(map[string]string, len(s.base)+len(labels)/2)
+	for k, v := range s.base {
+		l[k] = v
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		l[labels[i]] = labels[i+1]
+	}
+	s.samples = append(s.samples, Sample{Name: name, Help: help, Labels: l, Value: value})
+}
+
+// Samples flattens a ProbeData into gauges. baseLabels are added to every
+// sample, typically the agent, probe id, type and target.
+func Samples(pd probes.ProbeData, baseLabels map[string]string) []Sample {
+	s := &sampleSet{base: baseLabels}
+
+	switch d := pd.Data.(type) {
+	case probes.PingResult:
+		s.add("netwatcher_ping_packets_sent", "Packets sent during the last ping run.", float64(d.PacketsSent))
+		s.add("netwatcher_ping_packets_received", "Packets received during the last ping run.", float64(d.PacketsRecv))
+		s.add("netwatcher_ping_packets_duplicate", "Duplicate replies during the last ping run.", float64(d.PacketsRecvDuplicates))
+		s.add("netwatcher_ping_packet_loss_percent", "Packet loss of the last ping run.", d.PacketLoss)
+		s.add("netwatcher_ping_rtt_min_seconds", "Minimum round trip time of the last ping run.", d.MinRtt.Seconds())
+		s.add("netwatcher_ping_rtt_avg_seconds", "Average round trip time of the last ping run.", d.AvgRtt.Seconds())
+		s.add("netwatcher_ping_rtt_max_seconds", "Maximum round trip time of the last ping run.", d.MaxRtt.Seconds())
+		s.add("netwatcher_ping_rtt_stddev_seconds", "Standard deviation of the round trip time of the last ping run.", d.StdDevRtt.Seconds())
+
+	case probes.MtrResult:
+		s.add("netwatcher_mtr_hops", "Number of hops in the last traceroute.", float64(len(d.Report.Hops)))
+		for _, hop := range d.Report.Hops {
+			host := ""
+			if len(hop.Hosts) > 0 {
+				host = hop.Hosts[0].IP
+			}
+			ttl := strconv.Itoa(hop.TTL)
+			s.add("netwatcher_mtr_hop_loss_percent", "Packet loss at a hop of the last traceroute.", parseNumber(hop.LossPct), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_sent", "Probes sent to a hop of the last traceroute.", float64(hop.Sent), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_received", "Replies received from a hop of the last traceroute.", float64(hop.Recv), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_rtt_last_seconds", "Last round trip time to a hop.", parseMillis(hop.Last), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_rtt_avg_seconds", "Average round trip time to a hop.", parseMillis(hop.Avg), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_rtt_best_seconds", "Best round trip time to a hop.", parseMillis(hop.Best), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_rtt_worst_seconds", "Worst round trip time to a hop.", parseMillis(hop.Worst), "hop", ttl, "host", host)
+			s.add("netwatcher_mtr_hop_rtt_stddev_seconds", "Standard deviation of the round trip time to a hop.", parseMillis(hop.StdDev), "hop", ttl, "host", host)
+		}
+
+	case probes.TrafficSimResult:
+		s.add("netwatcher_trafficsim_packets_total", "Packets sent during the last TrafficSim cycle.", float64(d.TotalPackets))
+		s.add("netwatcher_trafficsim_packets_lost", "Packets lost during the last TrafficSim cycle.", float64(d.LostPackets))
+		s.add("netwatcher_trafficsim_packet_loss_percent", "Packet loss of the last TrafficSim cycle.", d.LossPercentage)
+		s.add("netwatcher_trafficsim_out_of_sequence", "Out of order packets during the last TrafficSim cycle.", float64(d.OutOfSequence))
+		s.add("netwatcher_trafficsim_duplicate_packets", "Duplicate packets during the last TrafficSim cycle.", float64(d.DuplicatePackets))
+		s.add("netwatcher_trafficsim_rtt_avg_seconds", "Average round trip time of the last TrafficSim cycle.", d.AverageRTT/1000)
+		s.add("netwatcher_trafficsim_rtt_min_seconds", "Minimum round trip time of the last TrafficSim cycle.", float64(d.MinRTT)/1000)
+		s.add("netwatcher_trafficsim_rtt_max_seconds", "Maximum round trip time of the last TrafficSim cycle.", float64(d.MaxRTT)/1000)
+		s.add("netwatcher_trafficsim_rtt_stddev_seconds", "Standard deviation of the round trip time of the last TrafficSim cycle.", d.StdDevRTT/1000)
+
+	case probes.SpeedTestResult:
+		for _, srv := range d.TestData {
+			s.add("netwatcher_speedtest_download_bytes_per_second", "Download speed measured by the last speed test.", float64(srv.DLSpeed), "server", srv.ID, "server_name", srv.Name)
+			s.add("netwatcher_speedtest_upload_bytes_per_second", "Upload speed measured by the last speed test.", float64(srv.ULSpeed), "server", srv.ID, "server_name", srv.Name)
+			s.add("netwatcher_speedtest_latency_seconds", "Latency measured by the last speed test.", srv.Latency.Seconds(), "server", srv.ID, "server_name", srv.Name)
+			s.add("netwatcher_speedtest_jitter_seconds", "Jitter measured by the last speed test.", srv.Jitter.Seconds(), "server", srv.ID, "server_name", srv.Name)
+		}
+
+	case probes.CompleteSystemInfo:
+		s.add("netwatcher_system_memory_total_bytes", "Total physical memory.", float64(d.MemoryInfo.Total))
+		s.add("netwatcher_system_memory_used_bytes", "Used physical memory.", float64(d.MemoryInfo.Used))
+		s.add("netwatcher_system_memory_available_bytes", "Memory available without swapping.", float64(d.MemoryInfo.Available))
+		s.add("netwatcher_system_memory_free_bytes", "Memory not used by the system.", float64(d.MemoryInfo.Free))
+		s.add("netwatcher_system_cpu_seconds", "CPU time spent in each mode.", d.CPUTimes.User.Seconds(), "mode", "user")
+		s.add("netwatcher_system_cpu_seconds", "CPU time spent in each mode.", d.CPUTimes.System.Seconds(), "mode", "system")
+		s.add("netwatcher_system_cpu_seconds", "CPU time spent in each mode.", d.CPUTimes.Idle.Seconds(), "mode", "idle")
+		s.add("netwatcher_system_cpu_seconds", "CPU time spent in each mode.", d.CPUTimes.IOWait.Seconds(), "mode", "iowait")
+		s.add("netwatcher_system_boot_time_seconds", "Host boot time as a unix timestamp.", float64(d.HostInfo.BootTime.Unix()))
+
+	case probes.NetworkInfoResult:
+		s.add("netwatcher_netinfo_info", "Network information of the agent, the value is always 1.", 1,
+			"local_address", d.LocalAddress,
+			"default_gateway", d.DefaultGateway,
+			"public_address", d.PublicAddress,
+			"internet_provider", d.InternetProvider)
+	}
+
+	if len(s.samples) > 0 {
+		s.add("netwatcher_probe_last_result_timestamp_seconds", "When the last result of a probe was produced.", float64(resultTime(pd).Unix()))
+	}
+
+	return s.samples
+}
+
+// ProbeLabels returns the labels every sample for a probe carries.
+func ProbeLabels(agent string, pd probes.ProbeData, lookup ProbeLookup) map[string]string {
+	l := map[string]string{
+		"agent":    agent,
+		"probe_id": pd.ProbeID.Hex(),
+	}
+	if pd.Triggered {
+		l["triggered"] = "true"
+	}
+	if lookup == nil {
+		return l
+	}
+	if p, ok := lookup(pd.ProbeID); ok {
+		l["probe_type"] = string(p.Type)
+		if len(p.Config.Target) > 0 {
+			l["target"] = p.Config.Target[0].Target
+		}
+	}
+	return l
+}
+
+func resultTime(pd probes.ProbeData) time.Time {
+	if !pd.CreatedAt.IsZero() {
+		return pd.CreatedAt
+	}
+	return time.Now()
+}
+
+// parseNumber reads the numeric strings trippy reports, eg. "12.5" or "-".
+func parseNumber(v string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+func parseMillis(v string) float64 {
+	return parseNumber(v) / 1000
+}
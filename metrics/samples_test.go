@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/showwin/speedtest-go/speedtest"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestSamples(t *testing.T) {
+	base := map[string]string{"agent": "agent-1"}
+
+	// results without metrics, like a probe error, give nothing
+	if got := Samples(probes.ProbeData{ProbeID: pingProbe}, base); len(got) != 0 {
+		t.Errorf("Samples() = %v without data", got)
+	}
+
+	got := Samples(probes.ProbeData{ProbeID: mtrProbe, CreatedAt: resultTime0, Data: mtr("192.0.2.1", "198.51.100.1")}, base)
+	// the hop count, 8 series per hop, and the result timestamp
+	if len(got) != 1+2*8+1 {
+		t.Fatalf("%d MTR samples, want 18", len(got))
+	}
+	last := got[len(got)-1]
+	if last.Name != "netwatcher_probe_last_result_timestamp_seconds" || last.Value != float64(resultTime0.Unix()) {
+		t.Errorf("last sample %+v, want the result's timestamp", last)
+	}
+	for _, s := range got {
+		if s.Labels["agent"] != "agent-1" {
+			t.Errorf("%s has labels %v, want the base labels", s.Name, s.Labels)
+		}
+	}
+	// samples get their own copy of the base labels
+	if len(base) != 1 {
+		t.Errorf("base labels changed to %v", base)
+	}
+
+	got = Samples(probes.ProbeData{Data: probes.SpeedTestResult{TestData: []speedtest.Server{{ID: "42", Name: "Test", Latency: 15 * time.Millisecond}}}}, base)
+	if len(got) != 5 || got[2].Name != "netwatcher_speedtest_latency_seconds" || got[2].Value != 0.015 || got[2].Labels["server"] != "42" || got[2].Labels["server_name"] != "Test" {
+		t.Errorf("speed test samples %+v", got)
+	}
+}
+
+func TestProbeLabels(t *testing.T) {
+	pd := probes.ProbeData{ProbeID: pingProbe, Triggered: true}
+	want := map[string]string{"agent": "agent-1", "probe_id": pingProbe.Hex(), "triggered": "true"}
+	if got := ProbeLabels("agent-1", pd, nil); len(got) != len(want) || got["triggered"] != "true" || got["probe_id"] != want["probe_id"] {
+		t.Errorf("ProbeLabels() = %v, want %v", got, want)
+	}
+
+	lookup := lookupOf(map[primitive.ObjectID]probes.Probe{
+		pingProbe: {Type: probes.ProbeType_PING, Config: probes.ProbeConfig{Target: []probes.ProbeTarget{{Target: "192.0.2.1"}, {Target: "192.0.2.2"}}}},
+	})
+	got := ProbeLabels("agent-1", pd, lookup)
+	if got["probe_type"] != "PING" || got["target"] != "192.0.2.1" {
+		t.Errorf("ProbeLabels() = %v, want the probe's type and first target", got)
+	}
+	if got := ProbeLabels("agent-1", probes.ProbeData{ProbeID: mtrProbe}, lookup); got["probe_type"] != "" || got["triggered"] != "" {
+		t.Errorf("ProbeLabels() = %v for an unknown, scheduled probe", got)
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := map[string]float64{
+		"12.5":   12.5,
+		" 0.0% ": 0,
+		"100%":   100,
+		"-":      0,
+		"":       0,
+	}
+	for v, want := range tests {
+		if got := parseNumber(v); got != want {
+			t.Errorf("parseNumber(%q) = %v, want %v", v, got, want)
+		}
+	}
+	if got := parseMillis("250"); got != 0.25 {
+		t.Errorf("parseMillis(250) = %v", got)
+	}
+}
@@ -0,0 +1,135 @@
+package probes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandStderrLimit is how much of a tool's stderr is kept, from the end
+// where the reason it failed usually is
+const commandStderrLimit = 4096
+
+// hostnameRE matches DNS names as RFC 1123 allows them.
+var hostnameRE = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// ParseTarget checks that a probe target is a hostname or an IP address,
+// optionally followed by a port, so nothing else from the controller ends
+// up in the arguments of a tool. IPv6 addresses with a port go in
+// brackets. The port is 0 when the target has none.
+func ParseTarget(target string) (string, int, error) {
+	host, port := target, 0
+	if net.ParseIP(target) == nil {
+		if h, p, err := net.SplitHostPort(target); err == nil {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 1 || n > 65535 {
+				return "", 0, fmt.Errorf("invalid port in target %q", target)
+			}
+			host, port = h, n
+		}
+	}
+
+	if net.ParseIP(host) == nil && (len(host) > 253 || !hostnameRE.MatchString(host)) {
+		return "", 0, fmt.Errorf("invalid target %q, expected a hostname or IP address", target)
+	}
+	return host, port, nil
+}
+
+// CommandError is returned when an external tool fails or times out.
+type CommandError struct {
+	Name     string
+	ExitCode int // -1 when the tool didn't exit by itself
+	Stderr   string
+	TimedOut bool
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Name, e.Err)
+	if e.TimedOut {
+		msg = e.Name + ": timed out"
+	}
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// runCommand runs an external tool with its arguments handed to it as they
+// are, never through a shell, and kills it once timeout has passed, or only
+// once ctx is done when timeout is 0. It returns what the tool wrote to
+// stdout.
+func runCommand(ctx context.Context, timeout time.Duration, name string, args ...string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// don't wait on children that kept the pipes open after a kill
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+
+	ce := &CommandError{
+		Name:     filepath.Base(name),
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Err:      err,
+	}
+	if len(ce.Stderr) > commandStderrLimit {
+		ce.Stderr = ce.Stderr[len(ce.Stderr)-commandStderrLimit:]
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.Exited() {
+		ce.ExitCode = ee.ExitCode()
+	}
+	return stdout.Bytes(), ce
+}
+
+// ProbeError tells the controller why a probe run failed.
+type ProbeError struct {
+	Message  string `json:"message" bson:"message"`
+	Command  string `json:"command,omitempty" bson:"command,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty" bson:"exit_code,omitempty"`
+	Stderr   string `json:"stderr,omitempty" bson:"stderr,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty" bson:"timed_out,omitempty"`
+}
+
+// NewProbeError describes err for ProbeData, with the details of a failed
+// command when there was one. It returns nil for a nil error.
+func NewProbeError(err error) *ProbeError {
+	if err == nil {
+		return nil
+	}
+
+	pe := &ProbeError{Message: err.Error()}
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		pe.Command = ce.Name
+		pe.ExitCode = ce.ExitCode
+		pe.Stderr = ce.Stderr
+		pe.TimedOut = ce.TimedOut
+	}
+	return pe
+}
@@ -0,0 +1,129 @@
+package probes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+
+	out, err := runCommand(context.Background(), 5*time.Second, "sh", "-c", "echo out; echo warning >&2")
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("runCommand() = %q, %v", out, err)
+	}
+
+	out, err = runCommand(context.Background(), 5*time.Second, "/bin/sh", "-c", `echo partial; echo "no route to host" >&2; exit 3`)
+	var ce *CommandError
+	if !errors.As(err, &ce) {
+		t.Fatalf("runCommand() = %v, want a CommandError", err)
+	}
+	if ce.Name != "sh" || ce.ExitCode != 3 || ce.Stderr != "no route to host" || ce.TimedOut {
+		t.Errorf("CommandError = %+v", ce)
+	}
+	if want := "sh: exit status 3: no route to host"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+	if string(out) != "partial\n" {
+		t.Errorf("stdout of a failed command = %q", out)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sleep")
+	}
+
+	_, err := runCommand(context.Background(), 100*time.Millisecond, "sleep", "5")
+	var ce *CommandError
+	if !errors.As(err, &ce) || !ce.TimedOut || ce.ExitCode != -1 {
+		t.Fatalf("runCommand() = %#v, want a timeout", err)
+	}
+	if want := "sleep: timed out"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+
+	// without a timeout it runs until ctx is done, which isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = runCommand(ctx, 0, "sleep", "5")
+	if !errors.As(err, &ce) || ce.TimedOut {
+		t.Errorf("runCommand() = %v once cancelled", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 4*time.Second {
+		t.Errorf("ran for %s, want until cancelled", d)
+	}
+}
+
+func TestRunCommandStderrLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+
+	script := fmt.Sprintf(`i=0; while [ $i -lt %d ]; do printf x >&2; i=$((i+1)); done; echo END >&2; exit 1`, 2*commandStderrLimit)
+	_, err := runCommand(context.Background(), 10*time.Second, "sh", "-c", script)
+	var ce *CommandError
+	if !errors.As(err, &ce) {
+		t.Fatalf("runCommand() = %v", err)
+	}
+	if len(ce.Stderr) != commandStderrLimit || !strings.HasSuffix(ce.Stderr, "xEND") {
+		t.Errorf("kept %d bytes of stderr ending in %q, want the last %d", len(ce.Stderr), ce.Stderr[len(ce.Stderr)-4:], commandStderrLimit)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	_, err := runCommand(context.Background(), time.Second, "netwatcher-no-such-tool")
+	var ce *CommandError
+	if !errors.As(err, &ce) || ce.ExitCode != -1 || !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("runCommand() = %v, want a CommandError wrapping %v", err, exec.ErrNotFound)
+	}
+}
+
+func TestNewProbeError(t *testing.T) {
+	if pe := NewProbeError(nil); pe != nil {
+		t.Errorf("NewProbeError(nil) = %+v", pe)
+	}
+
+	pe := NewProbeError(errors.New("no target"))
+	if pe.Message != "no target" || pe.Command != "" {
+		t.Errorf("NewProbeError() = %+v", pe)
+	}
+
+	ce := &CommandError{Name: "mtr", ExitCode: 1, Stderr: "unknown host", Err: errors.New("exit status 1")}
+	pe = NewProbeError(fmt.Errorf("mtr to example.net: %w", ce))
+	want := ProbeError{Message: "mtr to example.net: mtr: exit status 1: unknown host", Command: "mtr", ExitCode: 1, Stderr: "unknown host"}
+	if *pe != want {
+		t.Errorf("NewProbeError() = %+v, want %+v", *pe, want)
+	}
+}
+
+func TestRPerfParse(t *testing.T) {
+	out := `connecting to server at 192.0.2.1:5199
+test started
+{
+  "success": true,
+  "config": {"common": {"family": "udp", "length": 1024, "streams": 1}},
+  "summary": {"bytes_sent": 81920, "packets_sent": 80, "packets_received": 78, "packets_lost": 2, "jitter_average": 0.0004}
+}
+`
+	var r RPerfResults
+	if err := r.parse([]byte(out)); err != nil {
+		t.Fatalf("parse() = %v", err)
+	}
+	if !r.Success || r.Config.Common.Family != "udp" || r.Summary.PacketsSent != 80 || r.Summary.PacketsLost != 2 || r.Summary.JitterAverage != 0.0004 {
+		t.Errorf("parsed %+v", r)
+	}
+
+	if err := r.parse([]byte("error: connection refused\n")); err == nil {
+		t.Error("parse() succeeded without a report")
+	}
+}
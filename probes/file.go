@@ -0,0 +1,68 @@
+package probes
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadProbeFile reads a list of probe definitions from a YAML or JSON
+// file. The definitions use the same field names as the controller sends
+// on probe_get; probes without an id are given one derived from their
+// type and targets so it stays the same across reloads.
+func LoadProbeFile(path string) ([]Probe, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// decode generically first so the json tags on Probe apply to YAML too
+		var raw interface{}
+		err = yaml.Unmarshal(b, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		b, err = json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var pp []Probe
+	err = json.Unmarshal(b, &pp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := range pp {
+		if pp[i].Type == "" {
+			return nil, fmt.Errorf("%s: probe %d has no type", path, i)
+		}
+		if pp[i].ID.IsZero() {
+			pp[i].ID = localProbeID(pp[i])
+		}
+	}
+
+	return pp, nil
+}
+
+func localProbeID(p Probe) primitive.ObjectID {
+	h := sha256.New()
+	h.Write([]byte(p.Type))
+	for _, t := range p.Config.Target {
+		h.Write([]byte{0})
+		h.Write([]byte(t.Target))
+		h.Write(t.Agent[:])
+	}
+
+	var id primitive.ObjectID
+	copy(id[:], h.Sum(nil))
+	return id
+}
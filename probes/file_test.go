@@ -0,0 +1,74 @@
+package probes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeProbeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProbeFile(t *testing.T) {
+	yamlFile := writeProbeFile(t, "probes.yaml", `
+- type: PING
+  config:
+    target:
+      - target: 192.0.2.1
+    duration: 60
+- type: MTR
+  id: 65f1c0ffee0000000000abcd
+  config:
+    target:
+      - target: example.net
+    interval_seconds: 300
+`)
+	jsonFile := writeProbeFile(t, "probes.json", `[
+	{"type": "PING", "config": {"target": [{"target": "192.0.2.1"}], "duration": 60}},
+	{"type": "MTR", "id": "65f1c0ffee0000000000abcd", "config": {"target": [{"target": "example.net"}], "interval_seconds": 300}}
+]`)
+
+	fromYAML, err := LoadProbeFile(yamlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := LoadProbeFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromYAML) != 2 || len(fromJSON) != 2 {
+		t.Fatalf("loaded %d and %d probes, want 2", len(fromYAML), len(fromJSON))
+	}
+
+	ping := fromYAML[0]
+	if ping.Type != ProbeType_PING || ping.Config.Duration != 60 || ping.Config.Target[0].Target != "192.0.2.1" {
+		t.Errorf("PING probe read as %+v", ping)
+	}
+	if ping.ID.IsZero() || ping.ID != fromJSON[0].ID {
+		t.Errorf("probe without an id was given %s and %s, want the same ID", ping.ID.Hex(), fromJSON[0].ID.Hex())
+	}
+	if mtr := fromYAML[1]; mtr.ID.Hex() != "65f1c0ffee0000000000abcd" || mtr.Config.IntervalSeconds != 300 {
+		t.Errorf("MTR probe read as %+v", mtr)
+	}
+}
+
+func TestLoadProbeFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"untyped.yaml": "- config:\n    target:\n      - target: 192.0.2.1\n",
+		"broken.json":  `[{"type": "PING"`,
+		"object.json":  `{"type": "PING"}`,
+	}
+	for name, content := range tests {
+		_, err := LoadProbeFile(writeProbeFile(t, name, content))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: LoadProbeFile() = %v, want an error naming the file", name, err)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package probes
 
 import (
-	"encoding/json"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"time"
 )
@@ -17,54 +16,6 @@ type Probe struct {
 	ProbeProcess  int
 }
 
-func (pd *ProbeData) parse(probe *Probe) (interface{}, error) {
-
-	switch probe.Type { // todo
-	case ProbeType_RPERF:
-		var rperfData RPerfResults // Replace with the actual struct for RPERF data
-		err := json.Unmarshal(pd.Data.([]byte), &rperfData)
-		if err != nil {
-			// Handle error
-		}
-		return rperfData, err
-
-	case ProbeType_MTR:
-		var mtrData MtrResult // Replace with the actual struct for MTR data
-		err := json.Unmarshal(pd.Data.([]byte), &mtrData)
-		if err != nil {
-			// Handle error
-		}
-		return mtrData, err
-	case ProbeType_NETWORKINFO:
-		var mtrData NetworkInfoResult // Replace with the actual struct for MTR data
-		err := json.Unmarshal(pd.Data.([]byte), &mtrData)
-		if err != nil {
-			// Handle error
-		}
-		return mtrData, err
-	case ProbeType_PING:
-		var mtrData PingResult // Replace with the actual struct for MTR data
-		err := json.Unmarshal(pd.Data.([]byte), &mtrData)
-		if err != nil {
-			// Handle error
-		}
-		return mtrData, err
-	case ProbeType_SPEEDTEST:
-		var mtrData SpeedTestResult // Replace with the actual struct for MTR data
-		err := json.Unmarshal(pd.Data.([]byte), &mtrData)
-		if err != nil {
-			// Handle error
-		}
-		return mtrData, err
-	// Add cases for other probe types
-
-	default:
-		// Handle unsupported probe types or return an error
-	}
-
-	return nil, nil
-}
-
 type ProbeType string
 
 const (
@@ -79,12 +30,17 @@ const (
 )
 
 type ProbeConfig struct {
-	Target   []ProbeTarget `json:"target" bson:"target"`
-	Duration int           `json:"duration" bson:"duration"`
-	Count    int           `json:"count" bson:"count"`
-	Interval int           `json:"interval" bson:"interval"`
-	Server   bool          `bson:"server" json:"server"`
-	Pending  time.Time     `json:"pending" bson:"pending"` // timestamp of when it was made pending / invalidate it after 10 minutes or so?
+	Target          []ProbeTarget `json:"target" bson:"target"`
+	Duration        int           `json:"duration" bson:"duration"`
+	Count           int           `json:"count" bson:"count"`
+	Interval        int           `json:"interval" bson:"interval"`                                     // minutes between runs
+	IntervalSeconds int           `json:"interval_seconds,omitempty" bson:"interval_seconds,omitempty"` // overrides Interval, for sub-minute schedules
+	Protocol        string        `json:"protocol,omitempty" bson:"protocol,omitempty"`                 // icmp (default), udp or tcp for MTR
+	Port            int           `json:"port,omitempty" bson:"port,omitempty"`                         // tcp port, or first udp port, of an MTR; a "host:port" target works too
+	Multipath       string        `json:"multipath,omitempty" bson:"multipath,omitempty"`               // classic (default), paris or dublin for MTR
+	Flows           int           `json:"flows,omitempty" bson:"flows,omitempty"`                       // flows a multipath MTR enumerates
+	Server          bool          `bson:"server" json:"server"`
+	Pending         time.Time     `json:"pending" bson:"pending"` // timestamp of when it was made pending / invalidate it after 10 minutes or so?
 }
 
 type ProbeTarget struct {
@@ -93,11 +49,53 @@ type ProbeTarget struct {
 	Group  primitive.ObjectID `json:"group,omitempty" bson:"group"`
 }
 
+// NewProbeData wraps a probe result, giving it a unique ID so the
+// controller can acknowledge and de-duplicate it, and the schema version
+// of its type so it can be decoded.
+func NewProbeData(probeID primitive.ObjectID, t ProbeType, triggered bool, data interface{}) ProbeData {
+	now := time.Now()
+	return ProbeData{
+		ID:        primitive.NewObjectID(),
+		ProbeID:   probeID,
+		Type:      t,
+		Schema:    ResultSchemas[t],
+		Triggered: triggered,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Data:      data,
+	}
+}
+
 type ProbeData struct {
 	ID        primitive.ObjectID `json:"id"bson:"_id"`
 	ProbeID   primitive.ObjectID `json:"probe"bson:"probe"`
+	Type      ProbeType          `json:"type,omitempty" bson:"type,omitempty"`
+	Schema    int                `json:"schema,omitempty" bson:"schema,omitempty"` // version of the result's struct, see ResultSchemas
 	Triggered bool               `json:"triggered"bson:"triggered"`
 	CreatedAt time.Time          `bson:"createdAt"json:"createdAt"`
 	UpdatedAt time.Time          `bson:"updatedAt"json:"updatedAt"`
 	Data      interface{}        `json:"data,omitempty"bson:"data,omitempty"`
+	Queue     *QueueStats        `json:"queue,omitempty" bson:"queue,omitempty"`
+	Error     *ProbeError        `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// QueueStats describes the agent's probe queue when a result was produced,
+// so an overloaded agent shows up next to its data.
+type QueueStats struct {
+	Running  int   `json:"running" bson:"running"`
+	Queued   int   `json:"queued" bson:"queued"`
+	WaitedMs int64 `json:"waited_ms" bson:"waited_ms"` // time this run waited for a slot
+}
+
+// AcquireFunc bounds probes triggered by other probes, like the MTR run
+// after packet loss. It blocks until the probe may run and returns a func
+// to call once it's done.
+type AcquireFunc func(t ProbeType) (release func())
+
+// acquire waits for a slot for t, straight away when a is nil.
+func (a AcquireFunc) acquire(t ProbeType) func() {
+	if a == nil {
+		return func() {}
+	}
+	return a(t)
 }
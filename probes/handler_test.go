@@ -0,0 +1,20 @@
+package probes
+
+import "testing"
+
+func TestAcquireFunc(t *testing.T) {
+	// without a limiter triggered probes run straight away
+	var none AcquireFunc
+	none.acquire(ProbeType_MTR)()
+
+	var acquired []ProbeType
+	released := 0
+	acquire := AcquireFunc(func(t ProbeType) func() {
+		acquired = append(acquired, t)
+		return func() { released++ }
+	})
+	acquire.acquire(ProbeType_MTR)()
+	if len(acquired) != 1 || acquired[0] != ProbeType_MTR || released != 1 {
+		t.Errorf("acquired %v, released %d times", acquired, released)
+	}
+}
@@ -2,42 +2,56 @@ package probes
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"os/exec"
-	"path/filepath"
-	"runtime"
-	"strconv"
 	"time"
 )
 
 type MtrResult struct {
 	StartTimestamp time.Time `json:"start_timestamp"bson:"start_timestamp"`
 	StopTimestamp  time.Time `json:"stop_timestamp"bson:"stop_timestamp"`
-	Report         struct {
-		Info struct {
-			Target struct {
-				IP       string `json:"ip"`
-				Hostname string `json:"hostname"`
-			} `json:"target"`
-		} `json:"info"`
-		Hops []struct {
-			TTL   int `json:"ttl"`
-			Hosts []struct {
-				IP       string `json:"ip"`
-				Hostname string `json:"hostname"`
-			} `json:"hosts"`
-			Extensions []string `json:"extensions"`
-			LossPct    string   `json:"loss_pct"`
-			Sent       int      `json:"sent"`
-			Last       string   `json:"last"`
-			Recv       int      `json:"recv"`
-			Avg        string   `json:"avg"`
-			Best       string   `json:"best"`
-			Worst      string   `json:"worst"`
-			StdDev     string   `json:"stddev"`
-		} `json:"hops"`
-	} `json:"report"bson:"report"`
+	Report         MtrReport `json:"report"bson:"report"`
+}
+
+// MtrReport keeps the shape of the JSON report of trippy, which the agent
+// used to run for MTR checks.
+type MtrReport struct {
+	Info struct {
+		Target MtrHost `json:"target"`
+	} `json:"info"`
+	Hops []MtrHop `json:"hops"`
+	// Paths lists the distinct routes of a paris or dublin trace, Hops
+	// then holds the replies of all of them together
+	Paths []MtrPath `json:"paths,omitempty"`
+}
+
+// MtrPath is one route through the ECMP load balancers, with the flows
+// that took it.
+type MtrPath struct {
+	Flows []int    `json:"flows"`
+	Hops  []MtrHop `json:"hops"`
+}
+
+type MtrHost struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+}
+
+// MtrHop holds the statistics of one TTL. Times are in milliseconds.
+type MtrHop struct {
+	TTL        int       `json:"ttl"`
+	Hosts      []MtrHost `json:"hosts"`
+	Extensions []string  `json:"extensions"`
+	LossPct    string    `json:"loss_pct"`
+	Sent       int       `json:"sent"`
+	Last       string    `json:"last"`
+	Recv       int       `json:"recv"`
+	Avg        string    `json:"avg"`
+	Best       string    `json:"best"`
+	Worst      string    `json:"worst"`
+	StdDev     string    `json:"stddev"`
+	Jitter     string    `json:"jitter,omitempty"`
+	Javg       string    `json:"javg,omitempty"`
+	Jmax       string    `json:"jmax,omitempty"`
+	Jinta      string    `json:"jinta,omitempty"`
 }
 
 /*type MtrResult struct {
@@ -76,6 +90,11 @@ type MtrResult struct {
 
 // Mtr run the check for mtr, take input from checkdata for the test, and update the mtrresult object
 func Mtr(cd *Probe, triggered bool) (MtrResult, error) {
+	return MtrContext(context.Background(), cd, triggered)
+}
+
+// MtrContext is Mtr, stopping the trace when ctx is done.
+func MtrContext(ctx context.Context, cd *Probe, triggered bool) (MtrResult, error) {
 	var mtrResult MtrResult
 	mtrResult.StartTimestamp = time.Now()
 
@@ -84,64 +103,24 @@ func Mtr(cd *Probe, triggered bool) (MtrResult, error) {
 		triggeredCount = 15
 	}
 
-	trippyPath := filepath.Join(".", "lib")
-	var trippyBinary string
-
-	switch runtime.GOOS {
-	case "windows":
-		if runtime.GOARCH == "amd64" {
-			trippyBinary = "trip.exe"
-		} else {
-			trippyBinary = "trip.exe"
-		}
-	case "darwin":
-		trippyBinary = "trip"
-	case "linux":
-		if runtime.GOARCH == "amd64" {
-			trippyBinary = "trip"
-		} else if runtime.GOARCH == "arm64" {
-			trippyBinary = "trip"
-		} else {
-			return mtrResult, fmt.Errorf("unsupported Linux architecture: %s", runtime.GOARCH)
-		}
-	default:
-		return mtrResult, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
-	}
-
-	trippyPath = filepath.Join(trippyPath, trippyBinary)
-
-	/*args := []string{
-		"--icmp",
-		"--mode json",
-		"--multipath-strategy dublin",
-		"--dns-resolve-method cloudflare",
-		"--dns-lookup-as-info",
-		"--report-cycles " + strconv.Itoa(triggeredCount),
-		cd.Config.Target[0].Target,
-	}*/
-
-	/*ctx, cancel := context.WithTimeout(context.Background(), time.Duration(60)*time.Second)
-	defer cancel()*/
-
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		shellArgs := append([]string{"/c", trippyPath + " --icmp --mode json --multipath-strategy classic --dns-resolve-method cloudflare --report-cycles " + strconv.Itoa(triggeredCount) + " --dns-lookup-as-info " + cd.Config.Target[0].Target})
-		cmd = exec.CommandContext(context.TODO(), "cmd.exe", shellArgs...)
-	} else {
-		// For Linux and macOS, use /bin/bash
-		shellArgs := append([]string{"-c", trippyPath + " --icmp --mode json --multipath-strategy classic --dns-resolve-method cloudflare --report-cycles " + strconv.Itoa(triggeredCount) + " --dns-lookup-as-info " + cd.Config.Target[0].Target})
-		cmd = exec.CommandContext(context.TODO(), "/bin/bash", shellArgs...)
-	}
-
-	output, err := cmd.CombinedOutput()
+	host, port, err := ParseTarget(cd.Config.Target[0].Target)
 	if err != nil {
 		return mtrResult, err
 	}
-
-	err = json.Unmarshal(output, &mtrResult.Report)
+	if cd.Config.Port > 0 {
+		port = cd.Config.Port
+	}
+	report, err := Trace(ctx, host, TraceOptions{
+		Protocol:  cd.Config.Protocol,
+		Port:      port,
+		Multipath: cd.Config.Multipath,
+		Flows:     cd.Config.Flows,
+		Cycles:    triggeredCount,
+	})
 	if err != nil {
 		return mtrResult, err
 	}
+	mtrResult.Report = report
 
 	mtrResult.StopTimestamp = time.Now()
 	return mtrResult, nil
@@ -36,6 +36,12 @@ type PingResult struct {
 }
 
 func Ping(ac *Probe, pingChan chan ProbeData, mtrProbe Probe) error {
+	return PingContext(context.Background(), ac, pingChan, mtrProbe, nil)
+}
+
+// PingContext is Ping, stopping early when ctx is done. The MTR run after
+// packet loss waits for acquire, when it isn't nil.
+func PingContext(parent context.Context, ac *Probe, pingChan chan ProbeData, mtrProbe Probe, acquire AcquireFunc) error {
 	startTime := time.Now()
 
 	pinger, err := probing.NewPinger(ac.Config.Target[0].Target)
@@ -43,7 +49,7 @@ func Ping(ac *Probe, pingChan chan ProbeData, mtrProbe Probe) error {
 		fmt.Println(err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(2*ac.Config.Duration)*time.Second)
+	ctx, cancel := context.WithTimeout(parent, time.Duration(2*ac.Config.Duration)*time.Second)
 	defer cancel()
 
 	osDetect := runtime.GOOS
@@ -100,10 +106,7 @@ func Ping(ac *Probe, pingChan chan ProbeData, mtrProbe Probe) error {
 
 		log.Info(string(marshal))
 
-		cD := ProbeData{
-			ProbeID: ac.ID,
-			Data:    pingR,
-		}
+		cD := NewProbeData(ac.ID, ProbeType_PING, false, pingR)
 
 		pingChan <- cD
 
@@ -111,7 +114,9 @@ func Ping(ac *Probe, pingChan chan ProbeData, mtrProbe Probe) error {
 		if pingR.PacketLoss > 2 {
 			if len(mtrProbe.Config.Target) > 0 {
 
-				mtr, err := Mtr(&mtrProbe, true)
+				release := acquire.acquire(ProbeType_MTR)
+				mtr, err := MtrContext(parent, &mtrProbe, true)
+				release()
 				if err != nil {
 					fmt.Println(err)
 				}
@@ -121,11 +126,8 @@ func Ping(ac *Probe, pingChan chan ProbeData, mtrProbe Probe) error {
 					fmt.Print(err)
 				}*/
 
-				dC := ProbeData{
-					ProbeID:   mtrProbe.ID,
-					Triggered: true,
-					Data:      mtr,
-				}
+				dC := NewProbeData(mtrProbe.ID, ProbeType_MTR, true, mtr)
+				dC.Error = NewProbeError(err)
 
 				fmt.Println("Triggered MTR for ", mtrProbe.Config.Target[0].Target, "...")
 				pingChan <- dC
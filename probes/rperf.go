@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os/exec"
+	"github.com/netwatcherio/netwatcher-agent/deps"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -92,73 +93,91 @@ type RPerfResults struct {
 
 //./rperf -c 0.0.0.0 -p 5199 -b 8K -t 10 --udp -f json
 
-func (r *RPerfResults) Run(cd *Probe) error {
-	osDetect := runtime.GOOS
-	r.StartTimestamp = time.Now()
+// rperfTimeout is how long rperf may run past the test duration before it
+// is killed
+const rperfTimeout = 30 * time.Second
+
+// rperfBinary finds rperf, preferring the version pinned in the
+// dependency manifest over one copied into ./lib by hand.
+func rperfBinary() (string, error) {
+	if p, ok := deps.Lookup("rperf"); ok {
+		return p, nil
+	}
 
-	var cmd *exec.Cmd
-	switch osDetect {
+	switch runtime.GOOS {
 	case "windows":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-s -p " + targetHost[1]}
-		cmd = exec.CommandContext(context.TODO(), "./lib/rperf_windows-x86_64.exe", args...)
-		break
+		return filepath.Join(".", "lib", "rperf_windows-x86_64.exe"), nil
 	case "darwin":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-c", "./lib/rperf_darwin -s -p " + targetHost[1]}
-		cmd = exec.CommandContext(context.TODO(), "/bin/bash", args...)
-		break
+		return filepath.Join(".", "lib", "rperf_darwin"), nil
 	case "linux":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-c", "./lib/rperf_linux64 -s -p " + targetHost[1]}
-		cmd = exec.CommandContext(context.TODO(), "/bin/bash", args...)
-		break
-	default:
-		log.Print("Unknown OS")
+		return filepath.Join(".", "lib", "rperf_linux64"), nil
 	}
+	return "", fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+}
 
-	out, err := cmd.CombinedOutput()
-	fmt.Printf("%s\n", out)
+// rperfTarget reads the "host:port" target of an rperf probe.
+func rperfTarget(cd *Probe) (string, int, error) {
+	host, port, err := ParseTarget(cd.Config.Target[0].Target)
+	if err != nil {
+		return "", 0, err
+	}
+	if port == 0 {
+		return "", 0, fmt.Errorf("rperf target %q has no port", cd.Config.Target[0].Target)
+	}
+	return host, port, nil
+}
+
+// Run serves rperf tests on the port of the probe's target until ctx is
+// done.
+func (r *RPerfResults) Run(ctx context.Context, cd *Probe) error {
+	r.StartTimestamp = time.Now()
+
+	bin, err := rperfBinary()
+	if err != nil {
+		return err
+	}
+	_, port, err := rperfTarget(cd)
 	if err != nil {
 		return err
 	}
 
+	// a server runs for as long as it is wanted, not for a test duration
+	out, err := runCommand(ctx, 0, bin, "-s", "-p", strconv.Itoa(port))
+	log.Debugf("rperf server on port %d exited: %s", port, out)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
 	return nil
 }
 
 func (r *RPerfResults) Check(cd *Probe) error {
-	osDetect := runtime.GOOS
 	r.StartTimestamp = time.Now()
 
 	// todo make this p2p???
 
-	var cmd *exec.Cmd
-	switch osDetect {
-	case "windows":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-c", targetHost[0], "-p", targetHost[1], "-b", "8K", "-t", strconv.Itoa(cd.Config.Duration), "--udp", "--format", "json"}
-		cmd = exec.CommandContext(context.TODO(), "./lib/rperf_windows-x86_64.exe", args...)
-		break
-	case "darwin":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-c", "./lib/rperf_darwin -c " + targetHost[0] + " -p " + targetHost[1] + " -b 8K -t " + strconv.Itoa(cd.Config.Duration) + " --udp -f json"}
-		cmd = exec.CommandContext(context.TODO(), "/bin/bash", args...)
-		break
-	case "linux":
-		targetHost := strings.Split(cd.Config.Target[0].Target, ":")
-		args := []string{"-c", "./lib/rperf_linux64 -c " + targetHost[0] + " -p " + targetHost[1] + " -b 8K -t " + strconv.Itoa(cd.Config.Duration) + " --udp -f json"}
-		cmd = exec.CommandContext(context.TODO(), "/bin/bash", args...)
-		break
-	default:
-		log.Print("Unknown OS")
+	bin, err := rperfBinary()
+	if err != nil {
+		return err
+	}
+	host, port, err := rperfTarget(cd)
+	if err != nil {
+		return err
 	}
 
-	out, err := cmd.CombinedOutput()
-	fmt.Printf("%s\n", out)
+	args := []string{"-c", host, "-p", strconv.Itoa(port), "-b", "8K", "-t", strconv.Itoa(cd.Config.Duration), "--udp", "--format", "json"}
+	timeout := time.Duration(cd.Config.Duration)*time.Second + rperfTimeout
+	out, err := runCommand(context.TODO(), timeout, bin, args...)
 	if err != nil {
 		return err
 	}
 
+	r.StopTimestamp = time.Now()
+	return r.parse(out)
+}
+
+// parse reads the JSON report rperf prints after its progress lines.
+func (r *RPerfResults) parse(out []byte) error {
 	lineN := -1
 
 	beforeJson := ""
@@ -179,8 +198,7 @@ func (r *RPerfResults) Check(cd *Probe) error {
 
 	justJson := strings.ReplaceAll(string(out), beforeJson, "")
 
-	r.StopTimestamp = time.Now()
-	err = json.Unmarshal([]byte(justJson), &r)
+	err := json.Unmarshal([]byte(justJson), &r)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,143 @@
+package probes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// ResultSchemas lists the probe types this agent runs and the version of
+// the result each one produces. A version is bumped whenever its result
+// struct changes incompatibly, so the controller can tell how to decode
+// the data and which probes an older agent can't run.
+var ResultSchemas = map[ProbeType]int{
+	ProbeType_MTR:               1,
+	ProbeType_PING:              1,
+	ProbeType_SPEEDTEST:         1,
+	ProbeType_SPEEDTEST_SERVERS: 1,
+	ProbeType_NETWORKINFO:       1,
+	ProbeType_SYSTEMINFO:        1,
+	ProbeType_TRAFFICSIM:        1,
+}
+
+// Supported reports whether the agent can run probes of type t.
+func Supported(t ProbeType) bool {
+	_, ok := ResultSchemas[t]
+	return ok
+}
+
+// ErrUnknownResult is returned when decoding the data of a probe type that
+// has no decoder.
+var ErrUnknownResult = errors.New("no decoder for the results of this probe type")
+
+// ResultDecoder decodes the JSON data of a ProbeData into the result the
+// probe produced, eg. a MtrResult.
+type ResultDecoder func(data []byte) (interface{}, error)
+
+// resultDecoders maps every probe type to the result struct it produces.
+var resultDecoders = map[ProbeType]ResultDecoder{
+	ProbeType_RPERF:             decodeAs[RPerfResults],
+	ProbeType_MTR:               decodeAs[MtrResult],
+	ProbeType_PING:              decodeAs[PingResult],
+	ProbeType_SPEEDTEST:         decodeAs[SpeedTestResult],
+	ProbeType_SPEEDTEST_SERVERS: decodeAs[speedtest.Servers],
+	ProbeType_NETWORKINFO:       decodeAs[NetworkInfoResult],
+	ProbeType_SYSTEMINFO:        decodeAs[CompleteSystemInfo],
+	ProbeType_TRAFFICSIM:        decodeAs[TrafficSimResult],
+}
+
+func decodeAs[T any](data []byte) (interface{}, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// RegisterResult sets the decoder for the results of t, for probe types
+// this package doesn't know about. It isn't safe to call while results are
+// being decoded, register decoders from an init func.
+func RegisterResult(t ProbeType, d ResultDecoder) {
+	resultDecoders[t] = d
+}
+
+// DecodeResult decodes the JSON data of a probe of type t.
+func DecodeResult(t ProbeType, data []byte) (interface{}, error) {
+	d, ok := resultDecoders[t]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownResult, t)
+	}
+	v, err := d(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s result: %v", t, err)
+	}
+	return v, nil
+}
+
+// checkSchema refuses results newer than the struct they'd be decoded into.
+func (pd *ProbeData) checkSchema() error {
+	if v, ok := ResultSchemas[pd.Type]; ok && pd.Schema > v {
+		return fmt.Errorf("%s result schema %d is newer than this build's %d", pd.Type, pd.Schema, v)
+	}
+	return nil
+}
+
+// Result returns Data as the result struct of the probe's type. Data that
+// is still JSON, raw or decoded into maps, is decoded first.
+func (pd *ProbeData) Result() (interface{}, error) {
+	var b []byte
+	switch d := pd.Data.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		b = d
+	case json.RawMessage:
+		b = d
+	case map[string]interface{}, []interface{}:
+		var err error
+		b, err = json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return d, nil
+	}
+
+	err := pd.checkSchema()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeResult(pd.Type, b)
+}
+
+// UnmarshalJSON decodes Data into the result struct of the probe's type,
+// so a ProbeData reads back as the probe produced it. The data of types
+// without a decoder, or without a type like the results of older agents,
+// is left as generic JSON.
+func (pd *ProbeData) UnmarshalJSON(b []byte) error {
+	type plain ProbeData
+	var raw struct {
+		plain
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+	*pd = ProbeData(raw.plain)
+	if len(raw.Data) == 0 || string(raw.Data) == "null" {
+		return nil
+	}
+
+	if _, ok := resultDecoders[pd.Type]; !ok {
+		return json.Unmarshal(raw.Data, &pd.Data)
+	}
+	err = pd.checkSchema()
+	if err != nil {
+		return err
+	}
+	pd.Data, err = DecodeResult(pd.Type, raw.Data)
+	return err
+}
@@ -0,0 +1,117 @@
+package probes
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/showwin/speedtest-go/speedtest"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+// sampleResults holds a result of every type in resultDecoders.
+var sampleResults = map[ProbeType]interface{}{
+	ProbeType_RPERF: RPerfResults{StartTimestamp: testTime, StopTimestamp: testTime.Add(10 * time.Second)},
+	ProbeType_MTR: MtrResult{
+		StartTimestamp: testTime,
+		StopTimestamp:  testTime.Add(time.Minute),
+		Report: MtrReport{
+			Hops: []MtrHop{{TTL: 1, Hosts: []MtrHost{{IP: "192.0.2.254", Hostname: "gw"}}, Extensions: []string{"AS64500"}, LossPct: "0.0", Sent: 1, Recv: 1}},
+		},
+	},
+	ProbeType_PING:              PingResult{StartTimestamp: testTime, PacketsSent: 10, PacketsRecv: 9, PacketLoss: 10},
+	ProbeType_SPEEDTEST:         SpeedTestResult{TestData: []speedtest.Server{{ID: "1", Name: "Example", DLSpeed: 1e6}}, Timestamp: testTime},
+	ProbeType_SPEEDTEST_SERVERS: speedtest.Servers{{ID: "1", Name: "Example", Distance: 12.5}},
+	ProbeType_NETWORKINFO:       NetworkInfoResult{LocalAddress: "192.0.2.10", PublicAddress: "198.51.100.10", Timestamp: testTime},
+	ProbeType_SYSTEMINFO:        CompleteSystemInfo{Timestamp: testTime},
+	ProbeType_TRAFFICSIM:        TrafficSimResult{LostPackets: 1, TotalPackets: 100, LossPercentage: 1, ReportTime: testTime},
+}
+
+func TestDecodeResult(t *testing.T) {
+	for typ := range resultDecoders {
+		sample, ok := sampleResults[typ]
+		if !ok {
+			t.Errorf("no sample result for %s", typ)
+			continue
+		}
+		data, err := json.Marshal(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := DecodeResult(typ, data)
+		if err != nil {
+			t.Errorf("DecodeResult(%s): %v", typ, err)
+			continue
+		}
+		if reflect.TypeOf(v) != reflect.TypeOf(sample) {
+			t.Errorf("DecodeResult(%s) = %T, want %T", typ, v, sample)
+		}
+		again, _ := json.Marshal(v)
+		if string(again) != string(data) {
+			t.Errorf("DecodeResult(%s) = %s, want %s", typ, again, data)
+		}
+	}
+}
+
+func TestDecodeResultUnknown(t *testing.T) {
+	_, err := DecodeResult("NOPE", []byte(`{}`))
+	if !errors.Is(err, ErrUnknownResult) {
+		t.Errorf("DecodeResult of an unknown type: %v, want ErrUnknownResult", err)
+	}
+}
+
+func TestProbeDataRoundTrip(t *testing.T) {
+	for typ, sample := range sampleResults {
+		pd := NewProbeData(primitive.NewObjectID(), typ, false, sample)
+		b, err := json.Marshal(pd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got ProbeData
+		err = json.Unmarshal(b, &got)
+		if err != nil {
+			t.Errorf("%s: %v", typ, err)
+			continue
+		}
+		if got.ID != pd.ID || got.Type != typ || got.Schema != ResultSchemas[typ] {
+			t.Errorf("%s: read back as %+v", typ, got)
+		}
+		if reflect.TypeOf(got.Data) != reflect.TypeOf(sample) {
+			t.Errorf("%s: Data is %T, want %T", typ, got.Data, sample)
+		}
+		want, _ := json.Marshal(sample)
+		again, _ := json.Marshal(got.Data)
+		if string(again) != string(want) {
+			t.Errorf("%s: Data = %s, want %s", typ, again, want)
+		}
+
+		r, err := got.Result()
+		if err != nil || reflect.TypeOf(r) != reflect.TypeOf(sample) {
+			t.Errorf("%s: Result() = %T, %v", typ, r, err)
+		}
+	}
+}
+
+func TestProbeDataUntyped(t *testing.T) {
+	var pd ProbeData
+	err := json.Unmarshal([]byte(`{"data":{"a":1}}`), &pd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := pd.Data.(map[string]interface{}); !ok || m["a"] != 1.0 {
+		t.Errorf("Data of an untyped ProbeData = %#v, want generic JSON", pd.Data)
+	}
+}
+
+func TestProbeDataNewerSchema(t *testing.T) {
+	b := []byte(`{"type":"PING","schema":99,"data":{}}`)
+	var pd ProbeData
+	if err := json.Unmarshal(b, &pd); err == nil {
+		t.Error("a result with a newer schema was decoded")
+	}
+}
@@ -1,7 +1,9 @@
 package probes
 
 import (
+	"context"
 	"encoding/json"
+	"github.com/netwatcherio/netwatcher-agent/proxy"
 	"github.com/showwin/speedtest-go/speedtest"
 	"github.com/showwin/speedtest-go/speedtest/transport"
 	log "github.com/sirupsen/logrus"
@@ -49,12 +51,26 @@ type PLoss struct {
 	Max  int `json:"max"`  // The maximum index value received by the remote.
 }
 
+// NewSpeedTestClient returns a speedtest client that goes through the
+// agent's proxy.
+func NewSpeedTestClient() *speedtest.Speedtest {
+	uc := &speedtest.UserConfig{UserAgent: speedtest.DefaultUserAgent}
+	client := speedtest.New(speedtest.WithUserConfig(uc))
+	// UserConfig.Proxy takes a single URL, set the transport's instead so
+	// NO_PROXY is honoured
+	uc.T.Proxy = proxy.HTTP
+	return client
+}
+
 func SpeedTest(cd *Probe) (SpeedTestResult, error) {
-	var s1 []speedtest.Server
-	var speedtestClient = speedtest.New()
+	return SpeedTestContext(context.Background(), cd)
+}
 
-	// Use a proxy for the speedtest. eg: socks://127.0.0.1:7890
-	// speedtest.WithUserConfig(&speedtest.UserConfig{Proxy: "socks://127.0.0.1:7890"})(speedtestClient)
+// SpeedTestContext is SpeedTest, stopping between and during the tests
+// when ctx is done.
+func SpeedTestContext(ctx context.Context, cd *Probe) (SpeedTestResult, error) {
+	var s1 []speedtest.Server
+	var speedtestClient = NewSpeedTestClient()
 
 	// Select a network card as the data interface.
 	// speedtest.WithUserConfig(&speedtest.UserConfig{Source: "192.168.1.101"})(speedtestClient)
@@ -92,18 +108,21 @@ func SpeedTest(cd *Probe) (SpeedTestResult, error) {
 		// Please make sure your host can access this test server,
 		// otherwise you will get an error.
 		// It is recommended to replace a server at this time
-		err := s.PingTest(nil)
+		err := s.PingTestContext(ctx, nil)
 		if err != nil {
 			return SpeedTestResult{}, err
 		}
-		err = s.DownloadTest()
+		err = s.DownloadTestContext(ctx)
 		if err != nil {
 			return SpeedTestResult{}, err
 		}
-		err = s.UploadTest()
+		err = s.UploadTestContext(ctx)
 		if err != nil {
 			return SpeedTestResult{}, err
 		}
+		if ctx.Err() != nil {
+			return SpeedTestResult{}, ctx.Err()
+		}
 
 		s1 = append(s1, *s)
 		s.Context.Reset() // reset counter
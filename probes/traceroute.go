@@ -0,0 +1,904 @@
+package probes
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	TraceProtocolICMP = "icmp"
+	TraceProtocolUDP  = "udp"
+	TraceProtocolTCP  = "tcp"
+)
+
+// Multipath strategies. Classic traces change the fields routers hash for
+// ECMP with every probe, so a path is stitched together from many flows.
+// Paris keeps them fixed per flow, using the source port for UDP and the
+// checksum for ICMP, and Dublin uses the UDP destination port instead.
+const (
+	TraceMultipathClassic = "classic"
+	TraceMultipathParis   = "paris"
+	TraceMultipathDublin  = "dublin"
+)
+
+const (
+	traceDefaultMaxHops  = 30
+	traceDefaultTimeout  = time.Second
+	traceDefaultInterval = time.Second
+	traceDefaultUDPPort  = 33434
+	traceDefaultTCPPort  = 80
+	traceDefaultFlows    = 8
+	tracePayload         = 32
+	// traceSendGap spaces out the probes of a cycle so routers rate
+	// limiting ICMP errors don't show up as loss
+	traceSendGap = 10 * time.Millisecond
+	// traceSeqSpan bounds the sequence numbers used by a trace, which end
+	// up in the UDP destination port or, for multipath, the payload length
+	traceSeqSpan = 1024
+)
+
+// TraceOptions controls a Trace. Zero values pick the defaults.
+type TraceOptions struct {
+	Protocol  string        // icmp (default), udp or tcp
+	Port      int           // tcp destination port, or the first of the udp destination ports
+	Multipath string        // classic (default), paris or dublin
+	Flows     int           // flows traced by paris and dublin, 8 by default
+	Cycles    int           // rounds of probes sent to every hop
+	MaxHops   int           // highest TTL probed
+	Timeout   time.Duration // how long to wait for each reply
+	Interval  time.Duration // shortest time between the start of two cycles
+	NoDNS     bool          // don't look up the hostnames and AS of hops
+}
+
+// Trace runs an MTR style traceroute to host in process. Every cycle sends
+// one probe per TTL, stopping at the destination once it has been found.
+// It needs a raw ICMP socket to see the replies of the hops, so the agent
+// must run as root or with CAP_NET_RAW.
+func Trace(ctx context.Context, host string, opts TraceOptions) (MtrReport, error) {
+	var report MtrReport
+
+	opts = opts.withDefaults()
+	if opts.Protocol != TraceProtocolICMP && opts.Protocol != TraceProtocolUDP && opts.Protocol != TraceProtocolTCP {
+		return report, fmt.Errorf("unsupported traceroute protocol: %s", opts.Protocol)
+	}
+	switch opts.Multipath {
+	case TraceMultipathClassic:
+	case TraceMultipathParis, TraceMultipathDublin:
+		// every TCP probe is a new connection, and so a new source port
+		if opts.Protocol == TraceProtocolTCP {
+			return report, fmt.Errorf("%s traces need the icmp or udp protocol", opts.Multipath)
+		}
+	default:
+		return report, fmt.Errorf("unsupported multipath strategy: %s", opts.Multipath)
+	}
+
+	dst, err := resolveTraceTarget(ctx, host)
+	if err != nil {
+		return report, err
+	}
+	report.Info.Target = MtrHost{IP: dst.String(), Hostname: host}
+
+	t, err := newTracer(dst, opts)
+	if err != nil {
+		return report, err
+	}
+	defer t.close()
+	go t.read()
+
+	// flows stop at the destination independently, the paths through a
+	// load balancer needn't be the same length
+	hops := make([][]hopStats, opts.Flows)
+	last := make([]int, opts.Flows)
+	for f := range hops {
+		hops[f] = make([]hopStats, opts.MaxHops)
+		last[f] = opts.MaxHops
+	}
+	for cycle := 0; cycle < opts.Cycles; cycle++ {
+		if cycle > 0 {
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(time.Until(t.cycleStart.Add(opts.Interval))):
+			}
+		}
+
+		replies, err := t.cycle(ctx, last)
+		if err != nil {
+			return report, err
+		}
+		for f := range replies {
+			for i, r := range replies[f] {
+				hops[f][i].sent++
+				if r == nil {
+					continue
+				}
+				hops[f][i].add(r)
+				if r.final && i+1 < last[f] {
+					last[f] = i + 1
+				}
+			}
+		}
+	}
+
+	// drop the hops past the destination, and the silent ones at the end
+	// of a trace that never got there
+	for f := range hops {
+		for last[f] > 1 && hops[f][last[f]-1].recv == 0 {
+			last[f]--
+		}
+		hops[f] = hops[f][:last[f]]
+	}
+
+	names := hopNames{}
+	if !opts.NoDNS {
+		names = lookupHopNames(ctx, hops)
+	}
+
+	report.Hops = mergedHops(hops, names)
+	if opts.Multipath != TraceMultipathClassic {
+		report.Paths = tracePaths(hops, names)
+	}
+	return report, nil
+}
+
+func (o TraceOptions) withDefaults() TraceOptions {
+	o.Protocol = strings.ToLower(o.Protocol)
+	if o.Protocol == "" {
+		o.Protocol = TraceProtocolICMP
+	}
+	if o.Port <= 0 {
+		o.Port = traceDefaultTCPPort
+		if o.Protocol == TraceProtocolUDP {
+			o.Port = traceDefaultUDPPort
+		}
+	}
+	o.Multipath = strings.ToLower(o.Multipath)
+	if o.Multipath == "" {
+		o.Multipath = TraceMultipathClassic
+	}
+	if o.Multipath == TraceMultipathClassic {
+		o.Flows = 1
+	} else if o.Flows <= 0 {
+		o.Flows = traceDefaultFlows
+	}
+	if o.Cycles <= 0 {
+		o.Cycles = 1
+	}
+	if o.MaxHops <= 0 || o.MaxHops > 255 {
+		o.MaxHops = traceDefaultMaxHops
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = traceDefaultTimeout
+	}
+	if o.Interval <= 0 {
+		o.Interval = traceDefaultInterval
+	}
+	return o
+}
+
+func resolveTraceTarget(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// prefer IPv4, as trippy did
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return a.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	return addrs[0].IP, nil
+}
+
+type traceReply struct {
+	from  net.IP
+	at    time.Time
+	rtt   time.Duration
+	final bool // the reply came from the destination
+}
+
+type traceProbe struct {
+	flow  int
+	sent  time.Time
+	key   int
+	reply chan *traceReply
+}
+
+func (p *traceProbe) answer(from net.IP, at time.Time, final bool) {
+	select {
+	case p.reply <- &traceReply{from: from, at: at, rtt: at.Sub(p.sent), final: final}:
+	default:
+	}
+}
+
+type tracer struct {
+	opts TraceOptions
+	dst  net.IP
+	v6   bool
+
+	conn       *icmp.PacketConn // replies from the hops, and echo requests in icmp mode
+	udp        []net.PacketConn // one per flow for paris, otherwise just one
+	udpPorts   map[int]bool
+	id         int // echo identifier in icmp mode
+	seq        int
+	cycleStart time.Time
+
+	mu      sync.Mutex
+	pending map[int]*traceProbe // by echo sequence, udp destination port or tcp source port
+}
+
+func newTracer(dst net.IP, opts TraceOptions) (*tracer, error) {
+	t := &tracer{
+		opts:     opts,
+		dst:      dst,
+		v6:       dst.To4() == nil,
+		id:       rand.Intn(0xffff) + 1,
+		pending:  map[int]*traceProbe{},
+		udpPorts: map[int]bool{},
+	}
+	if !t.v6 {
+		t.dst = dst.To4()
+	}
+
+	var err error
+	if t.v6 {
+		t.conn, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	} else {
+		t.conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("traceroute needs a raw socket, run as root or with CAP_NET_RAW: %v", err)
+	}
+
+	if opts.Protocol == TraceProtocolUDP {
+		network := "udp4"
+		if t.v6 {
+			network = "udp6"
+		}
+		n := 1
+		if opts.Multipath == TraceMultipathParis {
+			n = opts.Flows
+		}
+		for i := 0; i < n; i++ {
+			c, err := net.ListenPacket(network, ":0")
+			if err != nil {
+				t.close()
+				return nil, err
+			}
+			t.udp = append(t.udp, c)
+			t.udpPorts[c.LocalAddr().(*net.UDPAddr).Port] = true
+		}
+	}
+
+	return t, nil
+}
+
+func (t *tracer) close() {
+	t.conn.Close()
+	for _, c := range t.udp {
+		c.Close()
+	}
+}
+
+// cycle sends a probe to every TTL up to last of each flow and waits for
+// the replies, which are nil for the hops that didn't answer.
+func (t *tracer) cycle(ctx context.Context, last []int) ([][]*traceReply, error) {
+	t.cycleStart = time.Now()
+	replies := make([][]*traceReply, len(last))
+	for f := range replies {
+		replies[f] = make([]*traceReply, last[f])
+	}
+
+	var wg sync.WaitGroup
+	first := true
+	for ttl := 1; ttl <= t.opts.MaxHops; ttl++ {
+		for f := range last {
+			if ttl > last[f] {
+				continue
+			}
+			if !first {
+				time.Sleep(traceSendGap)
+			}
+			first = false
+
+			p := &traceProbe{flow: f, reply: make(chan *traceReply, 1)}
+			err := t.send(ctx, p, ttl)
+			if err != nil {
+				wg.Wait()
+				return nil, err
+			}
+
+			wg.Add(1)
+			go func(f, i int) {
+				defer wg.Done()
+				defer t.forget(p)
+
+				timer := time.NewTimer(t.opts.Timeout)
+				defer timer.Stop()
+				select {
+				case r := <-p.reply:
+					replies[f][i] = r
+				case <-timer.C:
+				case <-ctx.Done():
+				}
+			}(f, ttl-1)
+		}
+	}
+	wg.Wait()
+
+	return replies, ctx.Err()
+}
+
+func (t *tracer) send(ctx context.Context, p *traceProbe, ttl int) error {
+	t.seq = (t.seq + 1) % traceSeqSpan
+
+	switch t.opts.Protocol {
+	case TraceProtocolUDP:
+		// classic traces tell the probes apart by destination port, the
+		// others keep the ports of a flow and change the length instead
+		conn := t.udp[0]
+		port := t.opts.Port
+		payload := tracePayload + t.seq
+		switch t.opts.Multipath {
+		case TraceMultipathClassic:
+			port += t.seq
+			payload = tracePayload
+		case TraceMultipathParis:
+			conn = t.udp[p.flow]
+		case TraceMultipathDublin:
+			port += p.flow
+		}
+		err := t.setHops(conn, ttl)
+		if err != nil {
+			return err
+		}
+		p.sent = time.Now()
+		t.register(t.seq, p)
+		_, err = conn.WriteTo(make([]byte, payload), &net.UDPAddr{IP: t.dst, Port: port})
+		return err
+
+	case TraceProtocolTCP:
+		go t.dialTCP(ctx, p, ttl)
+		return nil
+
+	default:
+		err := t.setHops(nil, ttl)
+		if err != nil {
+			return err
+		}
+		p.sent = time.Now()
+		t.register(t.seq, p)
+		_, err = t.conn.WriteTo(t.echoRequest(t.seq, p.flow), &net.IPAddr{IP: t.dst})
+		return err
+	}
+}
+
+// echoRequest builds an echo request. Outside classic traces the end of
+// the payload is picked so every probe of a flow has the same checksum,
+// which routers hash like the ports of UDP.
+func (t *tracer) echoRequest(seq, flow int) []byte {
+	b := make([]byte, 8+tracePayload)
+	b[0] = byte(ipv4.ICMPTypeEcho)
+	if t.v6 {
+		b[0] = byte(ipv6.ICMPTypeEchoRequest)
+	}
+	binary.BigEndian.PutUint16(b[4:6], uint16(t.id))
+	binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+
+	// the kernel fills in the ICMPv6 checksum, over a pseudo header that
+	// stays the same for the whole trace
+	if t.opts.Multipath == TraceMultipathClassic {
+		if !t.v6 {
+			binary.BigEndian.PutUint16(b[2:4], ^onesSum(b))
+		}
+		return b
+	}
+
+	want := ^uint16(0x8000 + flow)
+	binary.BigEndian.PutUint16(b[len(b)-2:], onesAdd(want, ^onesSum(b)))
+	if !t.v6 {
+		binary.BigEndian.PutUint16(b[2:4], ^want)
+	}
+	return b
+}
+
+// onesSum is the ones' complement sum of b as used by the internet checksum.
+func onesSum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+func onesAdd(a, b uint16) uint16 {
+	s := uint32(a) + uint32(b)
+	return uint16(s&0xffff + s>>16)
+}
+
+func (t *tracer) setHops(conn net.PacketConn, ttl int) error {
+	if conn != nil {
+		if t.v6 {
+			return ipv6.NewPacketConn(conn).SetHopLimit(ttl)
+		}
+		return ipv4.NewPacketConn(conn).SetTTL(ttl)
+	}
+	if t.v6 {
+		return t.conn.IPv6PacketConn().SetHopLimit(ttl)
+	}
+	return t.conn.IPv4PacketConn().SetTTL(ttl)
+}
+
+// dialTCP sends a SYN with the given TTL. A hop on the way answers with
+// an ICMP error, while the destination accepts or refuses the connection.
+func (t *tracer) dialTCP(ctx context.Context, p *traceProbe, ttl int) {
+	network := "tcp4"
+	if t.v6 {
+		network = "tcp6"
+	}
+	d := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var port int
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				port, err = prepareTCPProbe(fd, t.v6, ttl)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return err
+			}
+			p.sent = time.Now()
+			t.register(port, p)
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.opts.Timeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(t.dst.String(), strconv.Itoa(t.opts.Port)))
+	if err == nil {
+		p.answer(t.dst, time.Now(), true)
+		// reset rather than close the connection, the service only needs
+		// to see a SYN
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		p.answer(t.dst, time.Now(), true)
+	}
+}
+
+func (t *tracer) register(key int, p *traceProbe) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.key = key
+	t.pending[key] = p
+}
+
+func (t *tracer) forget(p *traceProbe) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[p.key] == p {
+		delete(t.pending, p.key)
+	}
+}
+
+func (t *tracer) match(key int, from net.IP, at time.Time, final bool) {
+	t.mu.Lock()
+	p := t.pending[key]
+	t.mu.Unlock()
+	if p != nil {
+		p.answer(from, at, final)
+	}
+}
+
+// read hands the ICMP messages meant for this trace to their probes until
+// the socket is closed.
+func (t *tracer) read() {
+	proto := 1
+	if t.v6 {
+		proto = 58
+	}
+
+	b := make([]byte, 1500)
+	for {
+		n, peer, err := t.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+
+		m, err := icmp.ParseMessage(proto, b[:n])
+		if err != nil {
+			continue
+		}
+		var from net.IP
+		if a, ok := peer.(*net.IPAddr); ok {
+			from = a.IP
+		}
+
+		switch body := m.Body.(type) {
+		case *icmp.Echo:
+			if t.opts.Protocol != TraceProtocolICMP || body.ID != t.id {
+				continue
+			}
+			if m.Type == ipv4.ICMPTypeEchoReply || m.Type == ipv6.ICMPTypeEchoReply {
+				t.match(body.Seq, from, at, true)
+			}
+		case *icmp.TimeExceeded:
+			if key, ok := t.quotedKey(body.Data); ok {
+				t.match(key, from, at, false)
+			}
+		case *icmp.DstUnreach:
+			if key, ok := t.quotedKey(body.Data); ok {
+				t.match(key, from, at, from.Equal(t.dst))
+			}
+		}
+	}
+}
+
+// quotedKey finds the probe an ICMP error is about from the start of the
+// datagram it quotes.
+func (t *tracer) quotedKey(b []byte) (int, bool) {
+	var proto int
+	if t.v6 {
+		if len(b) < 40 || !net.IP(b[24:40]).Equal(t.dst) {
+			return 0, false
+		}
+		proto = int(b[6])
+		b = b[40:]
+	} else {
+		if len(b) < 20 {
+			return 0, false
+		}
+		hl := int(b[0]&0x0f) * 4
+		if len(b) < hl || !net.IP(b[16:20]).Equal(t.dst) {
+			return 0, false
+		}
+		proto = int(b[9])
+		b = b[hl:]
+	}
+	if len(b) < 8 {
+		return 0, false
+	}
+
+	switch t.opts.Protocol {
+	case TraceProtocolUDP:
+		if proto != 17 || !t.udpPorts[int(binary.BigEndian.Uint16(b[0:2]))] {
+			return 0, false
+		}
+		if t.opts.Multipath == TraceMultipathClassic {
+			return int(binary.BigEndian.Uint16(b[2:4])) - t.opts.Port, true
+		}
+		return int(binary.BigEndian.Uint16(b[4:6])) - 8 - tracePayload, true
+	case TraceProtocolTCP:
+		if proto != 6 || int(binary.BigEndian.Uint16(b[2:4])) != t.opts.Port {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(b[0:2])), true
+	default:
+		if (proto != 1 && proto != 58) || int(binary.BigEndian.Uint16(b[4:6])) != t.id {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(b[6:8])), true
+	}
+}
+
+// hopStats accumulates the replies of one TTL, in milliseconds.
+type hopStats struct {
+	hosts      []net.IP
+	sent, recv int
+
+	last, best, worst float64
+	lastAt            time.Time // when the last reply arrived
+	sum, sumSq        float64
+
+	jitter, jsum, jmax, jinta float64
+	jn                        int // replies jitter was measured on
+}
+
+func (h *hopStats) addHost(from net.IP) {
+	for _, ip := range h.hosts {
+		if ip.Equal(from) {
+			return
+		}
+	}
+	if from != nil {
+		h.hosts = append(h.hosts, from)
+	}
+}
+
+func (h *hopStats) add(r *traceReply) {
+	h.addHost(r.from)
+
+	rtt := float64(r.rtt) / float64(time.Millisecond)
+	if h.recv > 0 {
+		h.jitter = math.Abs(rtt - h.last)
+		h.jsum += h.jitter
+		h.jn++
+		h.jmax = math.Max(h.jmax, h.jitter)
+		// interarrival jitter as in RFC 3550
+		h.jinta += (h.jitter - h.jinta) / 16
+	}
+	if h.recv == 0 || rtt < h.best {
+		h.best = rtt
+	}
+	h.worst = math.Max(h.worst, rtt)
+	h.last = rtt
+	h.lastAt = r.at
+	h.sum += rtt
+	h.sumSq += rtt * rtt
+	h.recv++
+}
+
+// merge adds the replies of o, which were measured on another flow.
+func (h *hopStats) merge(o *hopStats) {
+	for _, ip := range o.hosts {
+		h.addHost(ip)
+	}
+	if o.recv > 0 {
+		if h.recv == 0 || o.best < h.best {
+			h.best = o.best
+		}
+		h.worst = math.Max(h.worst, o.worst)
+		// last and jitter describe the latest reply of any flow
+		if h.recv == 0 || o.lastAt.After(h.lastAt) {
+			h.last = o.last
+			h.lastAt = o.lastAt
+			h.jitter = o.jitter
+		}
+		h.jmax = math.Max(h.jmax, o.jmax)
+		h.jinta = math.Max(h.jinta, o.jinta)
+	}
+	h.sent += o.sent
+	h.recv += o.recv
+	h.sum += o.sum
+	h.sumSq += o.sumSq
+	h.jsum += o.jsum
+	h.jn += o.jn
+}
+
+func (h *hopStats) hop(ttl int, names hopNames) MtrHop {
+	hop := MtrHop{
+		TTL:        ttl,
+		Hosts:      []MtrHost{},
+		Extensions: []string{},
+		Sent:       h.sent,
+		Recv:       h.recv,
+		LossPct:    formatPercent(0),
+		Last:       formatMillis(h.last),
+		Best:       formatMillis(h.best),
+		Worst:      formatMillis(h.worst),
+		Avg:        formatMillis(0),
+		StdDev:     formatMillis(0),
+	}
+	for _, ip := range h.hosts {
+		name := names.host[ip.String()]
+		if name == "" {
+			name = ip.String()
+		}
+		hop.Hosts = append(hop.Hosts, MtrHost{IP: ip.String(), Hostname: name})
+		if as := names.as[ip.String()]; as != "" && !containsString(hop.Extensions, as) {
+			hop.Extensions = append(hop.Extensions, as)
+		}
+	}
+	if h.sent > 0 {
+		hop.LossPct = formatPercent(float64(h.sent-h.recv) / float64(h.sent) * 100)
+	}
+	if h.recv > 0 {
+		n := float64(h.recv)
+		avg := h.sum / n
+		hop.Avg = formatMillis(avg)
+		hop.StdDev = formatMillis(math.Sqrt(math.Max(h.sumSq/n-avg*avg, 0)))
+		hop.Jitter = formatMillis(h.jitter)
+		hop.Jmax = formatMillis(h.jmax)
+		hop.Jinta = formatMillis(h.jinta)
+		hop.Javg = formatMillis(0)
+		if h.jn > 0 {
+			hop.Javg = formatMillis(h.jsum / float64(h.jn))
+		}
+	}
+	return hop
+}
+
+func formatMillis(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+func formatPercent(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedHops reports every TTL with the replies of all flows together.
+func mergedHops(flows [][]hopStats, names hopNames) []MtrHop {
+	var merged []hopStats
+	for _, hops := range flows {
+		for i := range hops {
+			if i == len(merged) {
+				merged = append(merged, hopStats{})
+			}
+			merged[i].merge(&hops[i])
+		}
+	}
+
+	var out []MtrHop
+	for i := range merged {
+		out = append(out, merged[i].hop(i+1, names))
+	}
+	return out
+}
+
+// tracePaths groups the flows that saw the same hosts at every TTL into
+// the distinct paths of a multipath trace.
+func tracePaths(flows [][]hopStats, names hopNames) []MtrPath {
+	var keys []string
+	paths := map[string]*MtrPath{}
+	merged := map[string][]hopStats{}
+	for f, hops := range flows {
+		var key strings.Builder
+		for _, h := range hops {
+			var hosts []string
+			for _, ip := range h.hosts {
+				hosts = append(hosts, ip.String())
+			}
+			sort.Strings(hosts)
+			key.WriteString(strings.Join(hosts, ","))
+			key.WriteByte('|')
+		}
+
+		k := key.String()
+		if paths[k] == nil {
+			keys = append(keys, k)
+			paths[k] = &MtrPath{}
+			merged[k] = make([]hopStats, len(hops))
+		}
+		paths[k].Flows = append(paths[k].Flows, f)
+		for i := range hops {
+			merged[k][i].merge(&hops[i])
+		}
+	}
+
+	var out []MtrPath
+	for _, k := range keys {
+		path := paths[k]
+		for i := range merged[k] {
+			path.Hops = append(path.Hops, merged[k][i].hop(i+1, names))
+		}
+		out = append(out, *path)
+	}
+	return out
+}
+
+// hopNames are the hostname and the autonomous system, eg. "AS13335
+// CLOUDFLARENET, US", of hop addresses. AS numbers go in the extensions of
+// a hop, as they did with trippy's --dns-lookup-as-info.
+type hopNames struct {
+	host map[string]string
+	as   map[string]string
+}
+
+// lookupHopNames finds the hostnames and AS of every hop address, giving
+// up after a few seconds so a slow resolver doesn't hold the result back.
+func lookupHopNames(ctx context.Context, flows [][]hopStats) hopNames {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	names := hopNames{host: map[string]string{}, as: map[string]string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hops := range flows {
+		for _, h := range hops {
+			for _, ip := range h.hosts {
+				addr := ip.String()
+				mu.Lock()
+				_, ok := names.host[addr]
+				names.host[addr] = ""
+				mu.Unlock()
+				if ok {
+					continue
+				}
+
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					nn, err := net.DefaultResolver.LookupAddr(ctx, addr)
+					if err != nil || len(nn) == 0 {
+						return
+					}
+					mu.Lock()
+					names.host[addr] = strings.TrimSuffix(nn[0], ".")
+					mu.Unlock()
+				}()
+				go func(ip net.IP) {
+					defer wg.Done()
+					as := lookupAS(ctx, ip)
+					mu.Lock()
+					names.as[addr] = as
+					mu.Unlock()
+				}(ip)
+			}
+		}
+	}
+	wg.Wait()
+	return names
+}
+
+// lookupAS finds the autonomous system announcing ip with Team Cymru's DNS
+// service, like trippy does.
+func lookupAS(ctx context.Context, ip net.IP) string {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return ""
+	}
+
+	var q strings.Builder
+	if v4 := ip.To4(); v4 != nil {
+		fmt.Fprintf(&q, "%d.%d.%d.%d.origin.asn.cymru.com", v4[3], v4[2], v4[1], v4[0])
+	} else {
+		const hex = "0123456789abcdef"
+		for i := len(ip) - 1; i >= 0; i-- {
+			q.WriteByte(hex[ip[i]&0xf])
+			q.WriteByte('.')
+			q.WriteByte(hex[ip[i]>>4])
+			q.WriteByte('.')
+		}
+		q.WriteString("origin6.asn.cymru.com")
+	}
+
+	// "13335 | 1.1.1.0/24 | AU | apnic | 2011-08-11", several origins are
+	// listed space separated
+	txt, err := net.DefaultResolver.LookupTXT(ctx, q.String())
+	if err != nil || len(txt) == 0 {
+		return ""
+	}
+	origins := strings.Fields(strings.Split(txt[0], "|")[0])
+	if len(origins) == 0 {
+		return ""
+	}
+	as := "AS" + origins[0]
+
+	// "13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US"
+	txt, err = net.DefaultResolver.LookupTXT(ctx, as+".asn.cymru.com")
+	if err == nil && len(txt) > 0 {
+		if f := strings.Split(txt[0], "|"); len(f) >= 5 {
+			as += " " + strings.TrimSpace(f[4])
+		}
+	}
+	return as
+}
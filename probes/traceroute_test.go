@@ -0,0 +1,190 @@
+package probes
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// quotedIPv4 builds the start of an IPv4 datagram to dst, as quoted by an
+// ICMP error, followed by the first 8 bytes of its transport header.
+func quotedIPv4(dst net.IP, proto byte, transport []byte) []byte {
+	b := make([]byte, 20, 20+len(transport))
+	b[0] = 0x45
+	b[9] = proto
+	copy(b[16:20], dst.To4())
+	return append(b, transport...)
+}
+
+// quotedIPv6 is quotedIPv4 for IPv6.
+func quotedIPv6(dst net.IP, proto byte, transport []byte) []byte {
+	b := make([]byte, 40, 40+len(transport))
+	b[0] = 0x60
+	b[6] = proto
+	copy(b[24:40], dst.To16())
+	return append(b, transport...)
+}
+
+func ports(src, dst, length int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:2], uint16(src))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dst))
+	binary.BigEndian.PutUint16(b[4:6], uint16(length))
+	return b
+}
+
+func echo(id, seq int) []byte {
+	b := make([]byte, 8)
+	b[0] = 8
+	binary.BigEndian.PutUint16(b[4:6], uint16(id))
+	binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+	return b
+}
+
+func TestQuotedKey(t *testing.T) {
+	dst := net.ParseIP("192.0.2.1").To4()
+	dst6 := net.ParseIP("2001:db8::1")
+	other := net.ParseIP("192.0.2.2")
+
+	tests := []struct {
+		name    string
+		opts    TraceOptions
+		dst     net.IP
+		quoted  []byte
+		wantKey int
+		wantOK  bool
+	}{
+		{"icmp", TraceOptions{}, dst, quotedIPv4(dst, 1, echo(42, 7)), 7, true},
+		{"icmp other id", TraceOptions{}, dst, quotedIPv4(dst, 1, echo(43, 7)), 0, false},
+		{"icmp other destination", TraceOptions{}, dst, quotedIPv4(other, 1, echo(42, 7)), 0, false},
+		{"icmp quoting udp", TraceOptions{}, dst, quotedIPv4(dst, 17, echo(42, 7)), 0, false},
+		{"icmpv6", TraceOptions{}, dst6, quotedIPv6(dst6, 58, echo(42, 9)), 9, true},
+		{"truncated", TraceOptions{}, dst, quotedIPv4(dst, 1, nil), 0, false},
+		{"udp", TraceOptions{Protocol: TraceProtocolUDP}, dst, quotedIPv4(dst, 17, ports(40000, 33434+5, 8+tracePayload)), 5, true},
+		{"udp other source port", TraceOptions{Protocol: TraceProtocolUDP}, dst, quotedIPv4(dst, 17, ports(40001, 33434+5, 8+tracePayload)), 0, false},
+		{"udp paris", TraceOptions{Protocol: TraceProtocolUDP, Multipath: TraceMultipathParis}, dst, quotedIPv4(dst, 17, ports(40000, 33434, 8+tracePayload+3)), 3, true},
+		{"tcp", TraceOptions{Protocol: TraceProtocolTCP, Port: 443}, dst, quotedIPv4(dst, 6, ports(51000, 443, 0)), 51000, true},
+		{"tcp other port", TraceOptions{Protocol: TraceProtocolTCP, Port: 443}, dst, quotedIPv4(dst, 6, ports(51000, 80, 0)), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &tracer{
+				opts:     tt.opts.withDefaults(),
+				dst:      tt.dst,
+				v6:       tt.dst.To4() == nil,
+				id:       42,
+				udpPorts: map[int]bool{40000: true},
+			}
+			key, ok := tr.quotedKey(tt.quoted)
+			if ok != tt.wantOK || key != tt.wantKey {
+				t.Errorf("quotedKey() = %d, %v, want %d, %v", key, ok, tt.wantKey, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestEchoRequestChecksum(t *testing.T) {
+	classic := &tracer{opts: TraceOptions{}.withDefaults(), id: 42}
+	for seq := 0; seq < 3; seq++ {
+		b := classic.echoRequest(seq, 0)
+		if onesSum(b) != 0xffff {
+			t.Errorf("classic seq %d: checksum %#04x doesn't verify", seq, binary.BigEndian.Uint16(b[2:4]))
+		}
+	}
+
+	paris := &tracer{opts: TraceOptions{Multipath: TraceMultipathParis}.withDefaults(), id: 42}
+	sums := map[uint16]int{}
+	for flow := 0; flow < 4; flow++ {
+		var sum uint16
+		for seq := 0; seq < 5; seq++ {
+			b := paris.echoRequest(flow*100+seq, flow)
+			if onesSum(b) != 0xffff {
+				t.Errorf("paris flow %d seq %d: checksum doesn't verify", flow, seq)
+			}
+			got := binary.BigEndian.Uint16(b[2:4])
+			if seq > 0 && got != sum {
+				t.Errorf("paris flow %d seq %d: checksum %#04x, earlier probes had %#04x", flow, seq, got, sum)
+			}
+			sum = got
+		}
+		if f, ok := sums[sum]; ok {
+			t.Errorf("flows %d and %d share checksum %#04x", f, flow, sum)
+		}
+		sums[sum] = flow
+	}
+}
+
+func TestOnesSum(t *testing.T) {
+	// the example of RFC 1071
+	b := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := onesSum(b); got != 0xddf2 {
+		t.Errorf("onesSum() = %#04x, want 0xddf2", got)
+	}
+	if got := onesSum([]byte{0x01}); got != 0x0100 {
+		t.Errorf("onesSum() of an odd length = %#04x, want 0x0100", got)
+	}
+}
+
+func TestHopStats(t *testing.T) {
+	start := time.Now()
+	hopA := net.ParseIP("198.51.100.1")
+	hopB := net.ParseIP("198.51.100.2")
+
+	var a hopStats
+	a.sent = 3
+	a.add(&traceReply{from: hopA, at: start, rtt: 10 * time.Millisecond})
+	a.add(&traceReply{from: hopA, at: start.Add(2 * time.Second), rtt: 14 * time.Millisecond})
+
+	var b hopStats
+	b.sent = 3
+	b.add(&traceReply{from: hopB, at: start.Add(time.Second), rtt: 20 * time.Millisecond})
+	b.add(&traceReply{from: hopB, at: start.Add(3 * time.Second), rtt: 30 * time.Millisecond})
+	b.add(&traceReply{from: hopA, at: start.Add(4 * time.Second), rtt: 26 * time.Millisecond})
+
+	var merged hopStats
+	merged.merge(&b)
+	merged.merge(&a)
+
+	names := hopNames{
+		host: map[string]string{hopA.String(): "a.example.net"},
+		as:   map[string]string{hopA.String(): "AS64500 EXAMPLE", hopB.String(): "AS64500 EXAMPLE"},
+	}
+	hop := merged.hop(4, names)
+
+	want := MtrHop{
+		TTL:        4,
+		Sent:       6,
+		Recv:       5,
+		LossPct:    "16.7",
+		Last:       "26.0", // the latest reply, of the second flow
+		Best:       "10.0",
+		Worst:      "30.0",
+		Avg:        "20.0",
+		StdDev:     "7.4",
+		Jitter:     "4.0",
+		Javg:       "6.0",
+		Jmax:       "10.0",
+		Jinta:      "0.8",
+		Extensions: []string{"AS64500 EXAMPLE"},
+	}
+	if hop.TTL != want.TTL || hop.Sent != want.Sent || hop.Recv != want.Recv || hop.LossPct != want.LossPct ||
+		hop.Last != want.Last || hop.Best != want.Best || hop.Worst != want.Worst || hop.Avg != want.Avg ||
+		hop.StdDev != want.StdDev || hop.Jitter != want.Jitter || hop.Javg != want.Javg || hop.Jmax != want.Jmax || hop.Jinta != want.Jinta {
+		t.Errorf("hop() = %+v, want %+v", hop, want)
+	}
+	if len(hop.Extensions) != 1 || hop.Extensions[0] != want.Extensions[0] {
+		t.Errorf("hop().Extensions = %q, want %q", hop.Extensions, want.Extensions)
+	}
+	if len(hop.Hosts) != 2 || hop.Hosts[0].Hostname != "198.51.100.2" || hop.Hosts[1].Hostname != "a.example.net" {
+		t.Errorf("hop().Hosts = %+v", hop.Hosts)
+	}
+}
+
+func TestHopStatsEmpty(t *testing.T) {
+	h := hopStats{sent: 2}
+	hop := h.hop(1, hopNames{})
+	if hop.LossPct != "100.0" || hop.Recv != 0 || hop.Jitter != "" {
+		t.Errorf("hop() of a silent hop = %+v", hop)
+	}
+}
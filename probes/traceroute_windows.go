@@ -0,0 +1,42 @@
+//go:build windows
+
+package probes
+
+import "syscall"
+
+// prepareTCPProbe sets the TTL of a socket about to connect and binds it,
+// returning the source port its SYN will carry.
+func prepareTCPProbe(fd uintptr, v6 bool, ttl int) (int, error) {
+	s := syscall.Handle(fd)
+	if v6 {
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		if err != nil {
+			return 0, err
+		}
+		err = syscall.Bind(s, &syscall.SockaddrInet6{})
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		if err != nil {
+			return 0, err
+		}
+		err = syscall.Bind(s, &syscall.SockaddrInet4{})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sa, err := syscall.Getsockname(s)
+	if err != nil {
+		return 0, err
+	}
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return a.Port, nil
+	case *syscall.SockaddrInet6:
+		return a.Port, nil
+	}
+	return 0, syscall.EWINDOWS
+}
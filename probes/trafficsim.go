@@ -1,6 +1,7 @@
 package probes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -38,6 +39,10 @@ type TrafficSim struct {
 	Probe         primitive.ObjectID
 	localIP       string
 	testComplete  chan bool
+
+	// AcquireTriggered bounds the MTR runs a client triggers after packet
+	// loss, they run straight away when it is nil.
+	AcquireTriggered AcquireFunc
 	sync.Mutex
 }
 
@@ -72,6 +77,21 @@ const (
 
 type TrafficSimMsgType string
 
+// TrafficSimResult is what a TrafficSim client reports after every test
+// cycle. Round trip times are in milliseconds.
+type TrafficSimResult struct {
+	LostPackets      int       `json:"lostPackets" bson:"lostPackets"`
+	LossPercentage   float64   `json:"lossPercentage" bson:"lossPercentage"`
+	OutOfSequence    int       `json:"outOfSequence" bson:"outOfSequence"`
+	DuplicatePackets int       `json:"duplicatePackets" bson:"duplicatePackets"`
+	AverageRTT       float64   `json:"averageRTT" bson:"averageRTT"`
+	MinRTT           int64     `json:"minRTT" bson:"minRTT"`
+	MaxRTT           int64     `json:"maxRTT" bson:"maxRTT"`
+	StdDevRTT        float64   `json:"stdDevRTT" bson:"stdDevRTT"`
+	TotalPackets     int       `json:"totalPackets" bson:"totalPackets"`
+	ReportTime       time.Time `json:"reportTime" bson:"reportTime"`
+}
+
 type TrafficSimMsg struct {
 	Type TrafficSimMsgType  `json:"type"`
 	Data TrafficSimData     `json:"data"`
@@ -348,12 +368,7 @@ func (ts *TrafficSim) runTestCycles(errChan chan<- error, stopChan <-chan struct
 			ts.ClientStats.mu.Unlock()
 
 			if ts.DataChan != nil && ts.Running {
-				ts.DataChan <- ProbeData{
-					ProbeID:   ts.Probe,
-					Triggered: false,
-					CreatedAt: time.Now(),
-					Data:      stats,
-				}
+				ts.DataChan <- NewProbeData(ts.Probe, ProbeType_TRAFFICSIM, false, stats)
 			}
 
 			// Add a small delay before starting the next test cycle
@@ -412,7 +427,9 @@ func (ts *TrafficSim) receiveDataLoop(errChan chan<- error, stopChan <-chan stru
 				}
 				ts.ClientStats.mu.Unlock()
 
+				ts.Mutex.Lock()
 				ts.LastResponse = time.Now()
+				ts.Mutex.Unlock()
 			}
 		}
 	}
@@ -433,7 +450,7 @@ func getLocalIP() (string, error) {
 	return "", fmt.Errorf("no suitable local IP address found")
 }
 
-func (ts *TrafficSim) calculateStats(mtrProbe *Probe) map[string]interface{} {
+func (ts *TrafficSim) calculateStats(mtrProbe *Probe) TrafficSimResult {
 	var totalRTT, minRTT, maxRTT int64
 	var rtts []float64
 	lostPackets := 0
@@ -504,17 +521,16 @@ func (ts *TrafficSim) calculateStats(mtrProbe *Probe) map[string]interface{} {
 	// Trigger MTR if packet loss exceeds threshold percentage
 	if totalPackets > 0 && lossPercentage > 5.0 && ts.Running {
 		if mtrProbe != nil && len(mtrProbe.Config.Target) > 0 {
+			release := ts.AcquireTriggered.acquire(ProbeType_MTR)
 			mtr, err := Mtr(mtrProbe, true)
+			release()
 			if err != nil {
 				log.Errorf("TrafficSim: MTR error: %v", err)
 			}
 
 			if ts.DataChan != nil && ts.Running {
-				dC := ProbeData{
-					ProbeID:   mtrProbe.ID,
-					Triggered: true,
-					Data:      mtr,
-				}
+				dC := NewProbeData(mtrProbe.ID, ProbeType_MTR, true, mtr)
+				dC.Error = NewProbeError(err)
 				log.Infof("TrafficSim: Triggered MTR for %s due to %.2f%% packet loss",
 					mtrProbe.Config.Target[0].Target, lossPercentage)
 				ts.DataChan <- dC
@@ -522,17 +538,17 @@ func (ts *TrafficSim) calculateStats(mtrProbe *Probe) map[string]interface{} {
 		}
 	}
 
-	return map[string]interface{}{
-		"lostPackets":      lostPackets,
-		"lossPercentage":   lossPercentage,
-		"outOfSequence":    outOfOrder,
-		"duplicatePackets": duplicatePackets,
-		"averageRTT":       avgRTT,
-		"minRTT":           minRTT,
-		"maxRTT":           maxRTT,
-		"stdDevRTT":        stdDevRTT,
-		"totalPackets":     totalPackets,
-		"reportTime":       time.Now(),
+	return TrafficSimResult{
+		LostPackets:      lostPackets,
+		LossPercentage:   lossPercentage,
+		OutOfSequence:    outOfOrder,
+		DuplicatePackets: duplicatePackets,
+		AverageRTT:       avgRTT,
+		MinRTT:           minRTT,
+		MaxRTT:           maxRTT,
+		StdDevRTT:        stdDevRTT,
+		TotalPackets:     totalPackets,
+		ReportTime:       time.Now(),
 	}
 }
 
@@ -662,7 +678,9 @@ func (ts *TrafficSim) isAgentAllowed(agentID primitive.ObjectID) bool {
 func (ts *TrafficSim) Start(mtrProbe *Probe) {
 	defer func() {
 		log.Infof("TrafficSim: Start() exiting for probe %s", ts.Probe.Hex())
+		ts.Mutex.Lock()
 		ts.Running = false
+		ts.Mutex.Unlock()
 		if ts.Conn != nil {
 			ts.Conn.Close()
 		}
@@ -695,6 +713,13 @@ func (ts *TrafficSim) Start(mtrProbe *Probe) {
 	}
 }
 
+// StartContext runs Start until ctx is done.
+func (ts *TrafficSim) StartContext(ctx context.Context, mtrProbe *Probe) {
+	stop := context.AfterFunc(ctx, ts.Stop)
+	defer stop()
+	ts.Start(mtrProbe)
+}
+
 // Stop gracefully stops the TrafficSim instance
 func (ts *TrafficSim) Stop() {
 	log.Infof("TrafficSim: Stopping probe %s", ts.Probe.Hex())
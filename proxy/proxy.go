@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	xproxy "golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	mu        sync.RWMutex
+	proxyFunc = httpproxy.FromEnvironment().ProxyFunc()
+)
+
+// Configure sets the proxy the agent's outbound connections go through.
+// rawURL is an http://, https://, socks5:// or socks5h:// URL, with the
+// credentials as user info if the proxy needs them. Without it the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables are used.
+// Hosts matching noProxy are always connected to directly.
+func Configure(rawURL, noProxy string) error {
+	cfg := httpproxy.FromEnvironment()
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		case "socks5h":
+			// httpproxy only knows socks5, which leaves resolving names to
+			// the proxy as well
+			u.Scheme = "socks5"
+			rawURL = u.String()
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q, expected http, https, socks5 or socks5h", u.Scheme)
+		}
+		cfg.HTTPProxy = rawURL
+		cfg.HTTPSProxy = rawURL
+		cfg.NoProxy = noProxy
+	}
+
+	mu.Lock()
+	proxyFunc = cfg.ProxyFunc()
+	mu.Unlock()
+	return nil
+}
+
+// For returns the proxy to reach u through, or nil to connect directly.
+func For(u *url.URL) (*url.URL, error) {
+	mu.RLock()
+	f := proxyFunc
+	mu.RUnlock()
+	return f(u)
+}
+
+// HTTP is For as an http.Transport.Proxy.
+func HTTP(req *http.Request) (*url.URL, error) {
+	return For(req.URL)
+}
+
+// Transport returns an http.Transport that goes through the proxy.
+func Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = HTTP
+	return t
+}
+
+// Dial connects to addr for a connection that isn't a plain HTTP request,
+// eg. a websocket, tunnelling it through the proxy with CONNECT or SOCKS5.
+// scheme is http or https, to pick the proxy like a request would.
+func Dial(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	p, err := For(&url.URL{Scheme: scheme, Host: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	if p == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if p.User != nil {
+			password, _ := p.User.Password()
+			auth = &xproxy.Auth{User: p.User.Username(), Password: password}
+		}
+		socks, err := xproxy.SOCKS5("tcp", hostPort(p, "1080"), auth, &d)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(xproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http", "https":
+		return dialConnect(ctx, p, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", p.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(ctx context.Context, p *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	port := "80"
+	if p.Scheme == "https" {
+		port = "443"
+	}
+	conn, err := d.DialContext(ctx, "tcp", hostPort(p, port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if p.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.Hostname()})
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", p.Host, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// bufferedConn hands out what was read past the CONNECT response first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
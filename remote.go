@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/status"
+	"github.com/netwatcherio/netwatcher-agent/workers"
+	"github.com/netwatcherio/netwatcher-agent/ws"
+	log "github.com/sirupsen/logrus"
+	"runtime"
+)
+
+// stateDump is the answer to dump_state.
+type stateDump struct {
+	status.Report
+	LogLevel   string `json:"log_level"`
+	Goroutines int    `json:"goroutines"`
+}
+
+// remoteCommands carries out the commands the controller sends over the
+// websocket.
+func remoteCommands(srv *status.Server) map[string]ws.CommandFunc {
+	return map[string]ws.CommandFunc{
+		ws.CommandRunNow: func(ctx context.Context, cmd ws.Command) (interface{}, error) {
+			p, err := commandProbe(cmd)
+			if err != nil {
+				return nil, err
+			}
+			return workers.RunNow(ctx, p)
+		},
+		ws.CommandCancel: func(ctx context.Context, cmd ws.Command) (interface{}, error) {
+			if cmd.ProbeID.IsZero() {
+				return nil, errors.New("probe_id is required")
+			}
+			cancelled, err := workers.Cancel(cmd.ProbeID)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]bool{"cancelled": cancelled}, nil
+		},
+		ws.CommandRestartWorker: func(ctx context.Context, cmd ws.Command) (interface{}, error) {
+			return nil, workers.RestartWorker(cmd.ProbeID)
+		},
+		ws.CommandDumpState: func(ctx context.Context, cmd ws.Command) (interface{}, error) {
+			return stateDump{
+				Report:     srv.Report(),
+				LogLevel:   log.GetLevel().String(),
+				Goroutines: runtime.NumGoroutine(),
+			}, nil
+		},
+		ws.CommandSetLogLevel: func(ctx context.Context, cmd ws.Command) (interface{}, error) {
+			level, err := log.ParseLevel(cmd.Level)
+			if err != nil {
+				return nil, err
+			}
+			previous := log.GetLevel()
+			log.SetLevel(level)
+			log.Infof("Log level changed from %s to %s by the controller", previous, level)
+			return map[string]string{"previous": previous.String(), "level": level.String()}, nil
+		},
+	}
+}
+
+// commandProbe picks the probe a run_now is for: the one-off definition it
+// carries, or a configured probe by ID.
+func commandProbe(cmd ws.Command) (probes.Probe, error) {
+	if cmd.Probe != nil {
+		return *cmd.Probe, nil
+	}
+	if cmd.ProbeID.IsZero() {
+		return probes.Probe{}, errors.New("probe_id or probe is required")
+	}
+	p, ok := workers.GetProbe(cmd.ProbeID)
+	if !ok {
+		return probes.Probe{}, fmt.Errorf("probe %s not found", cmd.ProbeID.Hex())
+	}
+	return p, nil
+}
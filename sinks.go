@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/metrics"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/workers"
+	"github.com/netwatcherio/netwatcher-agent/ws"
+	"os"
+	"path/filepath"
+)
+
+// buildSinks creates the result destinations listed in SINKS. The
+// websocket sink is skipped when wsH is nil, and -results adds a file (or
+// stdout) sink on top of whatever is configured. The metrics endpoint is
+// served until servers is done.
+func buildSinks(servers context.Context, wsH *ws.WebSocketHandler, outbox *workers.Outbox, resultsPath string) ([]workers.Sink, error) {
+	names := workers.ParseSinkNames(os.Getenv("SINKS"))
+	if len(names) == 0 && wsH != nil {
+		names = []string{"websocket"}
+	}
+
+	fileCfg := workers.FileSinkConfig{
+		Path:       os.Getenv("SINK_FILE_PATH"),
+		MaxBytes:   envInt64("SINK_FILE_MAX_BYTES", 0),
+		MaxAge:     envDuration("SINK_FILE_MAX_AGE", 0),
+		MaxBackups: int(envInt64("SINK_FILE_MAX_BACKUPS", 0)),
+	}
+	if fileCfg.Path == "" {
+		fileCfg.Path = filepath.Join(dataDir(), "results.jsonl")
+	}
+
+	switch resultsPath {
+	case "":
+	case "-":
+		names = append(names, "stdout")
+	default:
+		names = append(names, "results")
+	}
+
+	var sinks []workers.Sink
+
+	if addr := os.Getenv("METRICS_LISTEN"); addr != "" {
+		exporter := metrics.NewPrometheusExporter(os.Getenv("ID"), workers.GetProbe)
+		go exporter.ListenAndServe(servers, addr)
+		sinks = append(sinks, exporter)
+	}
+
+	if endpoint := os.Getenv("OTLP_ENDPOINT"); endpoint != "" {
+		resource := map[string]string{
+			"service.name":        "netwatcher-agent",
+			"service.version":     VERSION,
+			"host.name":           hostname(),
+			"netwatcher.agent.id": os.Getenv("ID"),
+		}
+		exporter := metrics.NewOTLPExporter(endpoint, os.Getenv("ID"), VERSION, resource, metrics.ParseHeaders(os.Getenv("OTLP_HEADERS")), workers.GetProbe)
+		exporter.Interval = envDuration("OTLP_INTERVAL", 0)
+		go exporter.Run()
+		sinks = append(sinks, exporter)
+	}
+
+	for _, name := range names {
+		switch name {
+		case "websocket":
+			if wsH == nil {
+				continue
+			}
+			sinks = append(sinks, workers.NewWebSocketSink(wsH, outbox, workers.DeliveryConfig{
+				AckTimeout:  envDuration("ACK_TIMEOUT", 0),
+				MaxAttempts: int(envInt64("ACK_MAX_ATTEMPTS", 0)),
+				Window:      int(envInt64("ACK_WINDOW", 0)),
+				NoAck:       os.Getenv("ACK_DISABLED") == "true",
+
+				BatchSize:     int(envInt64("UPLOAD_BATCH_SIZE", 1)),
+				BatchBytes:    int(envInt64("UPLOAD_BATCH_BYTES", 0)),
+				BatchInterval: envDuration("UPLOAD_BATCH_INTERVAL", 0),
+			}))
+		case "stdout":
+			sinks = append(sinks, workers.NewWriterSink("stdout", os.Stdout))
+		case "file", "results":
+			cfg := fileCfg
+			if name == "results" {
+				cfg.Path = resultsPath
+			}
+			s, err := workers.NewFileSink(cfg)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		default:
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+	}
+
+	return sinks, nil
+}
+
+func hostname() string {
+	info, err := probes.SystemInfo()
+	if err == nil && info.HostInfo.Hostname != "" {
+		return info.HostInfo.Hostname
+	}
+	name, _ := os.Hostname()
+	return name
+}
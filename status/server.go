@@ -0,0 +1,201 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/workers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout is how long requests in flight get to finish once the
+// API is stopped.
+const shutdownTimeout = 5 * time.Second
+
+// AgentInfo identifies the running agent.
+type AgentInfo struct {
+	ID       string    `json:"id"`
+	Version  string    `json:"version"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+}
+
+// ConnectionInfo describes the link to the controller.
+type ConnectionInfo struct {
+	Host      string `json:"host"`
+	Connected bool   `json:"connected"`
+	Offline   bool   `json:"offline"`
+}
+
+// OutboxInfo describes the results waiting to be delivered.
+type OutboxInfo struct {
+	Spooled int    `json:"spooled"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Report is the document served on /status.
+type Report struct {
+	Agent      AgentInfo                `json:"agent"`
+	Connection ConnectionInfo           `json:"connection"`
+	Outbox     *OutboxInfo              `json:"outbox,omitempty"`
+	Probes     []workers.ProbeStatus    `json:"probes"`
+	TrafficSim workers.TrafficSimStatus `json:"trafficsim"`
+}
+
+// Server is a read-only HTTP/JSON API describing what the agent is doing.
+// It only listens on loopback addresses or a unix socket unless
+// AllowRemote is set.
+type Server struct {
+	Agent       AgentInfo
+	Host        string
+	Connected   func() bool // nil when running offline
+	Outbox      *workers.Outbox
+	AllowRemote bool
+}
+
+// Report describes what the agent is doing right now.
+func (s *Server) Report() Report {
+	r := Report{
+		Agent:      s.Agent,
+		Connection: ConnectionInfo{Host: s.Host, Offline: s.Connected == nil},
+		Probes:     workers.ProbeStatuses(),
+		TrafficSim: workers.TrafficSimStatuses(),
+	}
+	if s.Connected != nil {
+		r.Connection.Connected = s.Connected()
+	}
+	if s.Outbox != nil {
+		r.Outbox = &OutboxInfo{Spooled: s.Outbox.Len(), Dropped: s.Outbox.Dropped()}
+	}
+	if r.Probes == nil {
+		r.Probes = []workers.ProbeStatus{}
+	}
+	return r
+}
+
+// Handler returns the routes of the API:
+//
+//	GET /status        everything below in one document
+//	GET /probes        every probe with its last run, error, next run and results
+//	GET /probes/{id}   a single probe
+//	GET /trafficsim    active TrafficSim server and clients
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Report())
+	})
+	mux.HandleFunc("/probes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Report().Probes)
+	})
+	mux.HandleFunc("/probes/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/probes/")
+		for _, p := range workers.ProbeStatuses() {
+			if p.Probe.ID.Hex() == id {
+				writeJSON(w, http.StatusOK, p)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "probe not found"})
+	})
+	mux.HandleFunc("/trafficsim", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, workers.TrafficSimStatuses())
+	})
+
+	return readOnly(mux)
+}
+
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "read only"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// ListenAndServe serves the API on addr, either host:port or
+// unix:/path/to/socket, until ctx is done or the listener fails. A unix
+// socket is removed when it stops.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) {
+	ln, err := listen(addr, s.AllowRemote)
+	if err != nil {
+		log.Errorf("Status API: %v", err)
+		return
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			return
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("Serving status API on %s", addr)
+	err = srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Status API stopped: %v", err)
+	}
+}
+
+func listen(addr string, allowRemote bool) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		if !allowRemote && !loopback(addr) {
+			return nil, fmt.Errorf("%s is not a loopback address, set STATUS_ALLOW_REMOTE=true to serve the API on it", addr)
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	// remove a socket left behind by an unclean exit
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// loopback reports whether addr, a host:port, only accepts local
+// connections. An empty host, eg. ":9106", listens on every interface.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,200 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:9106":   true,
+		"127.1.2.3:9106":   true,
+		"[::1]:9106":       true,
+		"localhost:9106":   true,
+		":9106":            false,
+		"0.0.0.0:9106":     false,
+		"[::]:9106":        false,
+		"192.0.2.10:9106":  false,
+		"example.net:9106": false,
+		"127.0.0.1":        false,
+	}
+	for addr, want := range tests {
+		if got := loopback(addr); got != want {
+			t.Errorf("loopback(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestListenLoopbackOnly(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0"} {
+		if ln, err := listen(addr, false); err == nil {
+			ln.Close()
+			t.Errorf("listen(%q) succeeded without AllowRemote", addr)
+		}
+	}
+
+	ln, err := listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("listen() = %v on loopback", err)
+	}
+	ln.Close()
+
+	ln, err = listen("0.0.0.0:0", true)
+	if err != nil {
+		t.Fatalf("listen() = %v with AllowRemote", err)
+	}
+	ln.Close()
+}
+
+// unixClient returns a client talking to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs unix socket permissions")
+	}
+	// short, socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s.sock")
+
+	// left behind by an unclean exit
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := &Server{Agent: AgentInfo{ID: "agent"}}
+	done := make(chan struct{})
+	go func() {
+		srv.ListenAndServe(ctx, "unix:"+path)
+		close(done)
+	}()
+
+	client := unixClient(path)
+	var resp *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err = client.Get("http://status/status")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET /status = %v", err)
+	}
+	var r Report
+	json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if r.Agent.ID != "agent" || !r.Connection.Offline {
+		t.Errorf("report %+v", r)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode %o, want 0600", perm)
+	}
+
+	// stopping closes the listener and removes the socket
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ListenAndServe() kept running after ctx was done")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Error("socket still accepts connections")
+	}
+}
+
+func TestListenAndServeRefusesRemote(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		(&Server{}).ListenAndServe(context.Background(), "0.0.0.0:0")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() served on every interface")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer((&Server{Connected: func() bool { return true }, Host: "wss://controller.test"}).Handler())
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type %q", path, ct)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	code, body := get("/probes/65a000000000000000000001")
+	if code != http.StatusNotFound || !strings.Contains(body, "probe not found") {
+		t.Errorf("GET /probes/{unknown} = %d %s", code, body)
+	}
+	if code, body := get("/probes"); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("GET /probes = %d %s, want an empty list", code, body)
+	}
+
+	code, body = get("/status")
+	var r Report
+	if err := json.Unmarshal([]byte(body), &r); err != nil || code != http.StatusOK {
+		t.Fatalf("GET /status = %d %s", code, body)
+	}
+	if !r.Connection.Connected || r.Connection.Offline || r.Connection.Host != "wss://controller.test" || r.Outbox != nil {
+		t.Errorf("connection %+v, outbox %+v", r.Connection, r.Outbox)
+	}
+
+	resp, err := http.Post(srv.URL+"/status", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /status = %d, want read only", resp.StatusCode)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package update
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess replaces the running process with exe, keeping its PID so
+// a service manager doesn't notice. It only returns on failure.
+func restartProcess(exe string, env []string) error {
+	return syscall.Exec(exe, os.Args, env)
+}
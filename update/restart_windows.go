@@ -0,0 +1,24 @@
+//go:build windows
+
+package update
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restartProcess starts exe with the same arguments and exits. It only
+// returns on failure.
+func restartProcess(exe string, env []string) error {
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
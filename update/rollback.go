@@ -0,0 +1,185 @@
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxStarts is how often a new version may start without connecting,
+// eg. because it crashes, before it is rolled back.
+const maxStarts = 3
+
+// state is kept across restarts to know whether the running version is
+// still on trial.
+type state struct {
+	Pending *pending `json:"pending,omitempty"`
+	Failed  []string `json:"failed,omitempty"` // sha256 of builds that were rolled back
+}
+
+type pending struct {
+	Version  string    `json:"version"`
+	SHA256   string    `json:"sha256"`
+	Backup   string    `json:"backup"`
+	Deadline time.Time `json:"deadline"`
+	Starts   int       `json:"starts"`
+}
+
+func loadState(path string) (*state, error) {
+	var st state
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (st *state) save(path string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (st *state) failed(sha string) bool {
+	for _, f := range st.Failed {
+		if strings.EqualFold(f, sha) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch is called when the agent starts. After an update it waits for the
+// new version to connect to the controller, keeping it once it does and
+// rolling back to the previous binary if it doesn't in time. It stops
+// waiting once ctx is done.
+func (u *Updater) Watch(ctx context.Context) {
+	st, err := loadState(u.StatePath)
+	if err != nil {
+		log.Warnf("Failed to read update state: %v", err)
+		return
+	}
+	p := st.Pending
+	if p == nil {
+		return
+	}
+
+	exe, err := executable()
+	if err != nil {
+		log.Warnf("Failed to find the agent executable: %v", err)
+		return
+	}
+	sum, err := fileSHA256(exe)
+	if err != nil || !strings.EqualFold(sum, p.SHA256) {
+		// a different binary was put in place since, stop watching
+		st.Pending = nil
+		st.save(u.StatePath)
+		return
+	}
+
+	p.Starts++
+	err = st.save(u.StatePath)
+	if err != nil {
+		log.Warnf("Failed to save update state: %v", err)
+	}
+	if p.Starts > maxStarts || time.Now().After(p.Deadline) {
+		// nothing is running yet, there is nothing to shut down
+		u.rollback(st, exe, false)
+		return
+	}
+
+	log.Infof("Running updated version %s, rolling back unless it connects by %s", p.Version, p.Deadline.Format(time.RFC3339))
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if u.Connected != nil && u.Connected() {
+				u.confirm(st)
+				return
+			}
+			if time.Now().After(p.Deadline) {
+				u.rollback(st, exe, true)
+				return
+			}
+		}
+	}()
+}
+
+func (u *Updater) confirm(st *state) {
+	log.Infof("Updated version %s connected, keeping it", st.Pending.Version)
+	os.Remove(st.Pending.Backup)
+	st.Pending = nil
+	err := st.save(u.StatePath)
+	if err != nil {
+		log.Warnf("Failed to save update state: %v", err)
+	}
+}
+
+// rollback puts the previous binary back and restarts into it, shutting
+// the agent down first if it is running. The build that failed is
+// remembered so it isn't installed again.
+func (u *Updater) rollback(st *state, exe string, running bool) {
+	p := st.Pending
+	log.Errorf("Updated version %s did not connect, rolling back", p.Version)
+
+	// the running binary can be renamed but not always removed, so move it
+	// out of the way before putting the backup in its place
+	failed := exe + ".failed"
+	os.Remove(failed)
+	err := os.Rename(exe, failed)
+	if err != nil {
+		log.Errorf("Failed to roll back: %v", err)
+		return
+	}
+	err = os.Rename(p.Backup, exe)
+	if err != nil {
+		os.Rename(failed, exe)
+		log.Errorf("Failed to roll back: %v", err)
+		return
+	}
+
+	st.Failed = append(st.Failed, p.SHA256)
+	st.Pending = nil
+	err = st.save(u.StatePath)
+	if err != nil {
+		log.Warnf("Failed to save update state: %v", err)
+	}
+
+	if !running {
+		err = restart(exe, u.environ())
+		log.Errorf("Failed to restart after rolling back: %v", err)
+		return
+	}
+	err = u.restart(exe)
+	err = fmt.Errorf("restarting after rolling back: %v", err)
+	log.Error(err)
+	u.exitIfStopped(err)
+}
@@ -0,0 +1,340 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Release is a version of the agent the controller advertises, with a
+// signed build per platform.
+type Release struct {
+	Version string `json:"version"`
+	Files   []File `json:"files"`
+}
+
+// File is the build of a release for one OS and architecture.
+type File struct {
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"` // base64 ed25519 signature of SignedMessage
+}
+
+// SignedMessage is what a release signature covers. It ties the binary to
+// its version and platform, so an old build can't be advertised as new.
+func SignedMessage(version string, f File) []byte {
+	return []byte(fmt.Sprintf("netwatcher-agent\n%s\n%s/%s\n%s\n", version, f.OS, f.Arch, strings.ToLower(f.SHA256)))
+}
+
+// defaultTimeout bounds fetching a release document or build.
+const defaultTimeout = 10 * time.Minute
+
+// Updater replaces the running agent with the releases it is given.
+type Updater struct {
+	PublicKey     ed25519.PublicKey
+	Version       string // release version of the running binary, only newer releases are installed
+	StatePath     string
+	RollbackAfter time.Duration // how long a new version has to connect before it is rolled back
+	Timeout       time.Duration // how long fetching a release document or build may take
+	Connected     func() bool
+	Client        *http.Client
+	// Shutdown stops the agent gracefully before it restarts into another
+	// binary. Once it has been called the agent can't carry on, so a
+	// failed restart exits instead of returning.
+	Shutdown func()
+	// Environ is the environment the new binary is started with, by
+	// default that of the running agent.
+	Environ []string
+
+	mu   sync.Mutex
+	busy bool
+}
+
+// Apply installs r if it is newer than the running binary and restarts
+// into it. It only returns when the release isn't applied; releases older
+// than Version are refused even when they are signed.
+func (u *Updater) Apply(ctx context.Context, r Release) error {
+	u.mu.Lock()
+	if u.busy {
+		u.mu.Unlock()
+		return errors.New("an update is already in progress")
+	}
+	u.busy = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.busy = false
+		u.mu.Unlock()
+	}()
+
+	f, err := u.verifyRelease(r)
+	if err != nil {
+		return err
+	}
+	cmp, err := compareVersions(r.Version, u.Version)
+	if err != nil {
+		return err
+	}
+	if cmp == 0 {
+		return nil
+	}
+	if cmp < 0 {
+		return fmt.Errorf("release %s is older than the running version %s", r.Version, u.Version)
+	}
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	current, err := fileSHA256(exe)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(current, f.SHA256) {
+		return nil
+	}
+
+	st, err := loadState(u.StatePath)
+	if err != nil {
+		return err
+	}
+	if st.failed(f.SHA256) {
+		log.Debugf("Not updating to %s, it was rolled back before", r.Version)
+		return nil
+	}
+
+	log.Infof("Updating to version %s", r.Version)
+	next := exe + ".new"
+	dctx, cancel := context.WithTimeout(ctx, u.timeout())
+	err = u.download(dctx, f, next)
+	cancel()
+	if err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	// keep the running binary to roll back to, then move the new one into
+	// place; renames are atomic, and allowed for a running executable
+	backup := exe + ".old"
+	os.Remove(backup)
+	err = os.Rename(exe, backup)
+	if err != nil {
+		os.Remove(next)
+		return err
+	}
+	err = os.Rename(next, exe)
+	if err != nil {
+		os.Rename(backup, exe)
+		return err
+	}
+
+	st.Pending = &pending{
+		Version:  r.Version,
+		SHA256:   strings.ToLower(f.SHA256),
+		Backup:   backup,
+		Deadline: time.Now().Add(u.RollbackAfter),
+	}
+	err = st.save(u.StatePath)
+	if err != nil {
+		os.Rename(backup, exe)
+		return err
+	}
+
+	log.Infof("Installed version %s, restarting", r.Version)
+	err = u.restart(exe)
+
+	// still here, so the new binary never started
+	st.Pending = nil
+	st.Failed = append(st.Failed, strings.ToLower(f.SHA256))
+	st.save(u.StatePath)
+	os.Rename(backup, exe)
+	err = fmt.Errorf("restarting into version %s: %v", r.Version, err)
+	u.exitIfStopped(err)
+	return err
+}
+
+// restart stops the agent and replaces it with exe. It only returns on
+// failure.
+func (u *Updater) restart(exe string) error {
+	if u.Shutdown != nil {
+		u.Shutdown()
+	}
+	return restart(exe, u.environ())
+}
+
+func (u *Updater) environ() []string {
+	if u.Environ == nil {
+		return os.Environ()
+	}
+	return u.Environ
+}
+
+// exitIfStopped exits after a failed restart once the agent has been shut
+// down, leaving it to the service manager to start the binary in place.
+func (u *Updater) exitIfStopped(err error) {
+	if u.Shutdown == nil {
+		return
+	}
+	log.Errorf("Exiting, the agent was stopped to restart: %v", err)
+	exit(1)
+}
+
+// verifyRelease picks the build for this platform and checks its
+// signature against the embedded public key.
+func (u *Updater) verifyRelease(r Release) (File, error) {
+	if len(u.PublicKey) != ed25519.PublicKeySize {
+		return File{}, errors.New("no update public key is built in")
+	}
+
+	for _, f := range r.Files {
+		if f.OS != runtime.GOOS || f.Arch != runtime.GOARCH {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(f.Signature)
+		if err != nil {
+			return File{}, fmt.Errorf("release %s has an invalid signature: %v", r.Version, err)
+		}
+		if !ed25519.Verify(u.PublicKey, SignedMessage(r.Version, f), sig) {
+			return File{}, fmt.Errorf("release %s is not signed by the update key", r.Version)
+		}
+		return f, nil
+	}
+	return File{}, fmt.Errorf("release %s has no build for %s/%s", r.Version, runtime.GOOS, runtime.GOARCH)
+}
+
+// download fetches the build to dst and checks it is the file that was
+// signed.
+func (u *Updater) download(ctx context.Context, f File, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", f.URL, resp.Status)
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, f.SHA256) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", f.URL, sum, f.SHA256)
+	}
+	return nil
+}
+
+// Poll fetches the release document at url every interval and applies
+// it, for agents whose controller doesn't push updates.
+func (u *Updater) Poll(ctx context.Context, url string, interval time.Duration) {
+	for {
+		r, err := u.fetchRelease(ctx, url)
+		if err != nil {
+			log.Warnf("Failed to check for updates: %v", err)
+		} else if err = u.Apply(ctx, r); err != nil {
+			log.Warnf("Failed to update: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (u *Updater) fetchRelease(ctx context.Context, url string) (Release, error) {
+	var r Release
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return r, err
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return r, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	return r, err
+}
+
+func (u *Updater) timeout() time.Duration {
+	if u.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return u.Timeout
+}
+
+// executable, restart and exit are replaced in tests, which mustn't
+// overwrite, re-exec or stop the test binary.
+var (
+	executable = runningExecutable
+	restart    = restartProcess
+	exit       = os.Exit
+)
+
+func runningExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,325 @@
+package update
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errNoRestart = errors.New("restart disabled in tests")
+
+// testHost serves build as the agent binary and counts the downloads.
+type testHost struct {
+	*httptest.Server
+	build     []byte
+	downloads atomic.Int32
+}
+
+func newTestHost(t *testing.T, build []byte) *testHost {
+	h := &testHost{build: build}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.downloads.Add(1)
+		w.Write(h.build)
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// signedRelease is version of build for this platform, signed with key.
+func signedRelease(key ed25519.PrivateKey, version, url string, build []byte) Release {
+	f := File{OS: runtime.GOOS, Arch: runtime.GOARCH, URL: url, SHA256: sha256Hex(build)}
+	f.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(version, f)))
+	return Release{Version: version, Files: []File{f}}
+}
+
+// testUpdater runs against a fake executable in a temporary directory.
+// restarted is called with the path restart was asked to run.
+func testUpdater(t *testing.T, pub ed25519.PublicKey, restarted func(exe string)) (*Updater, string) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "netwatcher-agent")
+	err := os.WriteFile(exe, []byte("running build"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldExecutable, oldRestart, oldExit := executable, restart, exit
+	executable = func() (string, error) { return exe, nil }
+	restart = func(exe string, env []string) error {
+		if restarted != nil {
+			restarted(exe)
+		}
+		return errNoRestart
+	}
+	exit = func(code int) { t.Fatalf("exited with %d", code) }
+	t.Cleanup(func() { executable, restart, exit = oldExecutable, oldRestart, oldExit })
+
+	return &Updater{
+		PublicKey:     pub,
+		Version:       "1.2.0",
+		StatePath:     filepath.Join(dir, "update.json"),
+		RollbackAfter: time.Minute,
+	}, exe
+}
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, key
+}
+
+func TestVerifyRelease(t *testing.T) {
+	pub, key := generateKey(t)
+	_, otherKey := generateKey(t)
+	build := []byte("new build")
+	u := &Updater{PublicKey: pub}
+
+	r := signedRelease(key, "1.3.0", "https://example.net/agent", build)
+	f, err := u.verifyRelease(r)
+	if err != nil || f.SHA256 != sha256Hex(build) {
+		t.Fatalf("verifyRelease() = %+v, %v", f, err)
+	}
+
+	tests := map[string]func(r *Release){
+		"other key":      func(r *Release) { *r = signedRelease(otherKey, r.Version, r.Files[0].URL, build) },
+		"other version":  func(r *Release) { r.Version = "9.0.0" },
+		"other checksum": func(r *Release) { r.Files[0].SHA256 = sha256Hex([]byte("other build")) },
+		"bad signature":  func(r *Release) { r.Files[0].Signature = "not base64!" },
+		"other platform": func(r *Release) { r.Files[0].OS = "plan9" },
+	}
+	for name, tamper := range tests {
+		r := signedRelease(key, "1.3.0", "https://example.net/agent", build)
+		tamper(&r)
+		if _, err := u.verifyRelease(r); err == nil {
+			t.Errorf("%s: release was verified", name)
+		}
+	}
+
+	if _, err := (&Updater{}).verifyRelease(r); err == nil {
+		t.Error("release was verified without a public key")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"v1.2.0", "1.2.0", 0},
+		{"1.10.0", "1.9.3", 1},
+		{"1.2.0", "1.2.1", -1},
+		{"1.2.0-rc.1", "1.2.0", -1},
+	}
+	for _, tt := range tests {
+		got, err := compareVersions(tt.a, tt.b)
+		if err != nil || got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+
+	for _, v := range []string{"", "dev", "1.2.x"} {
+		if CheckVersion(v) == nil {
+			t.Errorf("CheckVersion(%q) accepted an invalid version", v)
+		}
+	}
+}
+
+func TestApplyRefusesOlderRelease(t *testing.T) {
+	pub, key := generateKey(t)
+	host := newTestHost(t, []byte("old build"))
+	u, exe := testUpdater(t, pub, nil)
+
+	err := u.Apply(context.Background(), signedRelease(key, "1.1.0", host.URL, host.build))
+	if err == nil || !strings.Contains(err.Error(), "older") {
+		t.Errorf("Apply() of an older release = %v", err)
+	}
+	err = u.Apply(context.Background(), signedRelease(key, "1.2.0", host.URL, host.build))
+	if err != nil {
+		t.Errorf("Apply() of the running version = %v", err)
+	}
+	if n := host.downloads.Load(); n != 0 {
+		t.Errorf("downloaded %d times", n)
+	}
+	if b, _ := os.ReadFile(exe); string(b) != "running build" {
+		t.Errorf("executable was replaced with %q", b)
+	}
+}
+
+func TestApplyChecksumMismatch(t *testing.T) {
+	pub, key := generateKey(t)
+	host := newTestHost(t, []byte("new build"))
+	u, exe := testUpdater(t, pub, nil)
+
+	r := signedRelease(key, "1.3.0", host.URL, host.build)
+	host.build = []byte("tampered build")
+	err := u.Apply(context.Background(), r)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Apply() = %v, want a checksum mismatch", err)
+	}
+	if b, _ := os.ReadFile(exe); string(b) != "running build" {
+		t.Errorf("executable was replaced with %q", b)
+	}
+	if _, err := os.Stat(exe + ".new"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("download was left behind: %v", err)
+	}
+}
+
+func TestApplyDownloadTimeout(t *testing.T) {
+	pub, key := generateKey(t)
+	release := make(chan struct{})
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer host.Close()
+	defer close(release)
+
+	u, _ := testUpdater(t, pub, nil)
+	u.Timeout = 100 * time.Millisecond
+	err := u.Apply(context.Background(), signedRelease(key, "1.3.0", host.URL, []byte("new build")))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Apply() = %v, want a timeout", err)
+	}
+}
+
+func TestApplyRestoresWhenRestartFails(t *testing.T) {
+	pub, key := generateKey(t)
+	host := newTestHost(t, []byte("new build"))
+	var installed []byte
+	u, exe := testUpdater(t, pub, func(exe string) {
+		installed, _ = os.ReadFile(exe)
+	})
+
+	r := signedRelease(key, "1.3.0", host.URL, host.build)
+	err := u.Apply(context.Background(), r)
+	if err == nil || !strings.Contains(err.Error(), errNoRestart.Error()) {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if !bytes.Equal(installed, host.build) {
+		t.Errorf("restarted into %q, want the new build", installed)
+	}
+	if b, _ := os.ReadFile(exe); string(b) != "running build" {
+		t.Errorf("executable is %q after the failed restart, want the running build back", b)
+	}
+
+	st, err := loadState(u.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pending != nil || !st.failed(sha256Hex(host.build)) {
+		t.Errorf("state after the failed restart = %+v", st)
+	}
+
+	// the build that failed isn't tried again
+	err = u.Apply(context.Background(), r)
+	if err != nil || host.downloads.Load() != 1 {
+		t.Errorf("Apply() again = %v after %d downloads", err, host.downloads.Load())
+	}
+}
+
+func TestWatchRollsBack(t *testing.T) {
+	pub, _ := generateKey(t)
+	var restarted []byte
+	u, exe := testUpdater(t, pub, func(exe string) {
+		restarted, _ = os.ReadFile(exe)
+	})
+
+	backup := exe + ".old"
+	err := os.WriteFile(backup, []byte("previous build"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256Hex([]byte("running build"))
+	st := &state{Pending: &pending{
+		Version:  "1.3.0",
+		SHA256:   sum,
+		Backup:   backup,
+		Deadline: time.Now().Add(-time.Second),
+	}}
+	err = st.save(u.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.Watch(context.Background())
+
+	if string(restarted) != "previous build" {
+		t.Errorf("restarted into %q, want the previous build", restarted)
+	}
+	if b, _ := os.ReadFile(exe + ".failed"); string(b) != "running build" {
+		t.Errorf("failed build was moved to %q", b)
+	}
+	st, err = loadState(u.StatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pending != nil || !st.failed(sum) {
+		t.Errorf("state after rolling back = %+v", st)
+	}
+}
+
+func TestWatchTooManyStarts(t *testing.T) {
+	pub, _ := generateKey(t)
+	rolledBack := false
+	u, exe := testUpdater(t, pub, func(string) { rolledBack = true })
+
+	os.WriteFile(exe+".old", []byte("previous build"), 0755)
+	st := &state{Pending: &pending{
+		Version:  "1.3.0",
+		SHA256:   sha256Hex([]byte("running build")),
+		Backup:   exe + ".old",
+		Deadline: time.Now().Add(time.Hour),
+		Starts:   maxStarts,
+	}}
+	st.save(u.StatePath)
+
+	u.Watch(context.Background())
+	if !rolledBack {
+		t.Errorf("version that started %d times wasn't rolled back", maxStarts+1)
+	}
+}
+
+func TestApplyShutsDownBeforeRestarting(t *testing.T) {
+	pub, key := generateKey(t)
+	host := newTestHost(t, []byte("new build"))
+	u, _ := testUpdater(t, pub, nil)
+
+	var steps []string
+	u.Shutdown = func() { steps = append(steps, "shutdown") }
+	u.Environ = []string{"HOST=https://controller.example.net"}
+	restart = func(exe string, env []string) error {
+		steps = append(steps, "restart")
+		if len(env) != 1 || env[0] != u.Environ[0] {
+			t.Errorf("restarted with environment %q, want %q", env, u.Environ)
+		}
+		return errNoRestart
+	}
+	exit = func(code int) { steps = append(steps, "exit") }
+
+	u.Apply(context.Background(), signedRelease(key, "1.3.0", host.URL, host.build))
+	if strings.Join(steps, ",") != "shutdown,restart,exit" {
+		t.Errorf("Apply() went through %q, want shutdown, restart and, once that failed, exit", steps)
+	}
+}
@@ -0,0 +1,40 @@
+package update
+
+import (
+	"fmt"
+	"golang.org/x/mod/semver"
+	"strings"
+)
+
+// canonicalVersion turns a release version like 1.2.0 into the v1.2.0
+// form semver compares.
+func canonicalVersion(v string) (string, error) {
+	c := v
+	if !strings.HasPrefix(c, "v") {
+		c = "v" + c
+	}
+	if !semver.IsValid(c) {
+		return "", fmt.Errorf("%q is not a semantic version, eg. 1.2.0", v)
+	}
+	return c, nil
+}
+
+// CheckVersion makes sure v can be compared with other release versions.
+func CheckVersion(v string) error {
+	_, err := canonicalVersion(v)
+	return err
+}
+
+// compareVersions returns -1, 0 or 1 when a is older than, the same as or
+// newer than b.
+func compareVersions(a, b string) (int, error) {
+	ca, err := canonicalVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	cb, err := canonicalVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return semver.Compare(ca, cb), nil
+}
@@ -0,0 +1,124 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+)
+
+// ErrNotRunning is returned by the commands below before InitProbeWorker.
+var ErrNotRunning = errors.New("the probe workers aren't running yet")
+
+// onDemandRuns are the runs started by RunNow, so Cancel can abort them.
+var (
+	onDemandMu   sync.Mutex
+	onDemandSeq  uint64
+	onDemandRuns = map[primitive.ObjectID]map[uint64]context.CancelFunc{}
+)
+
+// RunNow runs p straight away, outside its schedule, and returns what it
+// produced: one result, or more for a ping that triggered an MTR. p can be
+// a configured probe or a one-off definition, eg. an on-demand speed test.
+func RunNow(ctx context.Context, p probes.Probe) ([]probes.ProbeData, error) {
+	if probeLimiter == nil {
+		return nil, ErrNotRunning
+	}
+	if p.Type == probes.ProbeType_TRAFFICSIM {
+		return nil, errors.New("TrafficSim probes run continuously, restart the worker instead")
+	}
+	switch p.Type {
+	case probes.ProbeType_MTR, probes.ProbeType_PING, probes.ProbeType_SPEEDTEST:
+		if len(p.Config.Target) == 0 {
+			return nil, fmt.Errorf("probe %s has no target", p.ID.Hex())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(workerCtx, cancel)
+	defer stop()
+	runningProbes.Add(1)
+	defer runningProbes.Done()
+
+	onDemandMu.Lock()
+	onDemandSeq++
+	seq := onDemandSeq
+	if onDemandRuns[p.ID] == nil {
+		onDemandRuns[p.ID] = map[uint64]context.CancelFunc{}
+	}
+	onDemandRuns[p.ID][seq] = cancel
+	onDemandMu.Unlock()
+	defer func() {
+		onDemandMu.Lock()
+		delete(onDemandRuns[p.ID], seq)
+		if len(onDemandRuns[p.ID]) == 0 {
+			delete(onDemandRuns, p.ID)
+		}
+		onDemandMu.Unlock()
+	}()
+
+	dC := make(chan probes.ProbeData)
+	done := make(chan []probes.ProbeData)
+	go func() {
+		var results []probes.ProbeData
+		for d := range dC {
+			results = append(results, d)
+		}
+		done <- results
+	}()
+
+	err := runProbe(ctx, p, dC, true)
+	close(dC)
+	return <-done, err
+}
+
+// Cancel aborts the runs of a probe that are in progress, scheduled or
+// started by RunNow. It reports whether any was running.
+func Cancel(id primitive.ObjectID) (bool, error) {
+	if probeScheduler == nil {
+		return false, ErrNotRunning
+	}
+	cancelled := probeScheduler.cancel(id)
+
+	onDemandMu.Lock()
+	for _, cancel := range onDemandRuns[id] {
+		cancel()
+		cancelled = true
+	}
+	onDemandMu.Unlock()
+	return cancelled, nil
+}
+
+// RestartWorker stops the worker of a probe and starts it again from
+// scratch, or every worker when id is zero.
+func RestartWorker(id primitive.ObjectID) error {
+	if probeScheduler == nil {
+		return ErrNotRunning
+	}
+
+	var workers []ProbeWorkerS
+	checkWorkers.Range(func(key, value interface{}) bool {
+		pw, ok := value.(ProbeWorkerS)
+		if ok && !pw.ToRemove && (id.IsZero() || pw.Probe.ID == id) {
+			workers = append(workers, pw)
+		}
+		return true
+	})
+	if len(workers) == 0 && !id.IsZero() {
+		return fmt.Errorf("probe %s not found", id.Hex())
+	}
+
+	for _, pw := range workers {
+		if pw.Probe.Type == probes.ProbeType_TRAFFICSIM {
+			restartTrafficSimWorker(pw, pw.Probe, probeDataChan, thisAgentID)
+			continue
+		}
+		probeScheduler.remove(pw.Probe.ID)
+		forgetProbeState(pw.Probe.ID)
+		probeScheduler.add(pw.Probe)
+	}
+	return nil
+}
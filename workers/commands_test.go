@@ -0,0 +1,142 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+// startWorkers sets up what InitProbeWorker does, without running the
+// scheduler.
+func startWorkers(t *testing.T, limits Limits) {
+	probeLimiter = newLimiter(limits)
+	probeScheduler = newScheduler(make(chan probes.ProbeData))
+	t.Cleanup(func() {
+		probeLimiter = nil
+		probeScheduler = nil
+	})
+}
+
+func TestCommandsNotRunning(t *testing.T) {
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SYSTEMINFO}
+	if _, err := RunNow(context.Background(), p); err != ErrNotRunning {
+		t.Errorf("RunNow() = %v", err)
+	}
+	if _, err := Cancel(p.ID); err != ErrNotRunning {
+		t.Errorf("Cancel() = %v", err)
+	}
+	if err := RestartWorker(p.ID); err != ErrNotRunning {
+		t.Errorf("RestartWorker() = %v", err)
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	startWorkers(t, Limits{})
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SYSTEMINFO}
+	t.Cleanup(func() { forgetProbeState(p.ID) })
+
+	results, err := RunNow(context.Background(), p)
+	if err != nil {
+		t.Fatalf("RunNow() = %v", err)
+	}
+	if len(results) != 1 || results[0].ProbeID != p.ID || results[0].Type != p.Type {
+		t.Errorf("RunNow() returned %+v, want one result of the probe", results)
+	}
+
+	invalid := map[string]probes.Probe{
+		"trafficsim": {ID: primitive.NewObjectID(), Type: probes.ProbeType_TRAFFICSIM},
+		"no target":  {ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR},
+	}
+	for name, p := range invalid {
+		if _, err := RunNow(context.Background(), p); err == nil {
+			t.Errorf("%s: RunNow() succeeded", name)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	startWorkers(t, Limits{PerType: map[probes.ProbeType]int{probes.ProbeType_SYSTEMINFO: 1}})
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SYSTEMINFO}
+
+	if cancelled, err := Cancel(p.ID); cancelled || err != nil {
+		t.Errorf("Cancel() = %v, %v with nothing running", cancelled, err)
+	}
+
+	// the run waits for the slot held here until it is cancelled
+	release, _, _ := probeLimiter.acquire(context.Background(), p.Type, priorityNormal)
+	defer release()
+	type result struct {
+		results []probes.ProbeData
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		results, err := RunNow(context.Background(), p)
+		done <- result{results, err}
+	}()
+	waitFor(t, func() bool {
+		onDemandMu.Lock()
+		defer onDemandMu.Unlock()
+		return len(onDemandRuns[p.ID]) == 1
+	})
+
+	if cancelled, err := Cancel(p.ID); !cancelled || err != nil {
+		t.Errorf("Cancel() = %v, %v with a run waiting", cancelled, err)
+	}
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, context.Canceled) || len(r.results) != 0 {
+			t.Errorf("cancelled RunNow() = %d results, %v", len(r.results), r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunNow() wasn't cancelled")
+	}
+
+	onDemandMu.Lock()
+	defer onDemandMu.Unlock()
+	if _, ok := onDemandRuns[p.ID]; ok {
+		t.Error("cancelled run is still tracked")
+	}
+}
+
+func TestRestartWorker(t *testing.T) {
+	noJitter(t)
+	startWorkers(t, Limits{})
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR, Config: probes.ProbeConfig{Interval: 5}}
+	other := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_NETWORKINFO}
+	for _, p := range []probes.Probe{p, other} {
+		storeProbe(t, p)
+		probeScheduler.add(p)
+	}
+	e := probeScheduler.entries[p.ID]
+	e.next = time.Now().Add(time.Hour)
+	markDone(p.ID, errors.New("unreachable"))
+
+	// planned again from scratch, its state forgotten
+	if err := RestartWorker(p.ID); err != nil {
+		t.Fatalf("RestartWorker() = %v", err)
+	}
+	restarted := probeScheduler.entries[p.ID]
+	if restarted == e || restarted.next.After(time.Now()) {
+		t.Error("restarted probe wasn't scheduled again")
+	}
+	if s := stateOf(p.ID); s.lastError != "" {
+		t.Errorf("restarted probe kept its last error %q", s.lastError)
+	}
+
+	// every worker
+	otherEntry := probeScheduler.entries[other.ID]
+	if err := RestartWorker(primitive.NilObjectID); err != nil {
+		t.Fatalf("RestartWorker() = %v", err)
+	}
+	if probeScheduler.entries[other.ID] == otherEntry || probeScheduler.entries[p.ID] == restarted {
+		t.Error("restarting every worker left some alone")
+	}
+
+	if err := RestartWorker(primitive.NewObjectID()); err == nil {
+		t.Error("restarted an unknown probe")
+	}
+}
@@ -0,0 +1,264 @@
+package workers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/netwatcherio/netwatcher-agent/ws"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+const (
+	defaultAckTimeout     = 30 * time.Second
+	defaultAckMaxAttempts = 5
+	defaultAckWindow      = 256
+	maxAckBackoff         = 5 * time.Minute
+	defaultBatchBytes     = 256 * 1024
+	defaultBatchInterval  = 5 * time.Second
+)
+
+var errDeliveryWindowFull = errors.New("too many unacknowledged probe data")
+
+// DeliveryConfig controls how probe_post messages are acknowledged.
+type DeliveryConfig struct {
+	AckTimeout  time.Duration // how long to wait for probe_post_ack before resending
+	MaxAttempts int           // sends before an item is handed back to the outbox
+	Window      int           // maximum number of unacknowledged items on the wire
+	NoAck       bool          // fire-and-forget, for controllers without probe_post_ack
+
+	// Batching sends several results per probe_post frame, when the
+	// controller takes batches. A batch is sent once it holds BatchSize
+	// results or BatchBytes, or BatchInterval after its first result.
+	BatchSize     int // 1 or less sends every result on its own
+	BatchBytes    int
+	BatchInterval time.Duration
+}
+
+// probeDataConn is the part of the websocket handler results are
+// delivered through.
+type probeDataConn interface {
+	IsConnected() bool
+	EmitProbeData(payloads ...[]byte) bool
+	Upload() ws.Upload
+}
+
+type inflightData struct {
+	payload   []byte
+	attempts  int
+	nextRetry time.Time
+}
+
+// delivery tracks probe data that has been emitted but not yet
+// acknowledged by the controller, resending it with backoff.
+type delivery struct {
+	conn     probeDataConn
+	outbox   *Outbox
+	cfg      DeliveryConfig
+	inflight map[primitive.ObjectID]*inflightData
+	order    []primitive.ObjectID
+
+	batch      [][]byte
+	batchBytes int
+	batchSince time.Time
+}
+
+func newDelivery(conn probeDataConn, outbox *Outbox, cfg DeliveryConfig) *delivery {
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultAckMaxAttempts
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultAckWindow
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = defaultBatchBytes
+	}
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = defaultBatchInterval
+	}
+
+	return &delivery{
+		conn:     conn,
+		outbox:   outbox,
+		cfg:      cfg,
+		inflight: make(map[primitive.ObjectID]*inflightData),
+	}
+}
+
+// send emits a marshalled ProbeData and starts waiting for its ack.
+func (d *delivery) send(payload []byte) error {
+	var head struct {
+		ID primitive.ObjectID `json:"id"`
+	}
+	_ = json.Unmarshal(payload, &head)
+
+	if head.ID.IsZero() || d.cfg.NoAck {
+		// nothing to correlate an ack with, or acks are disabled
+		return d.emit(payload)
+	}
+	if _, ok := d.inflight[head.ID]; ok {
+		return nil
+	}
+	if len(d.inflight) >= d.cfg.Window {
+		return errDeliveryWindowFull
+	}
+
+	err := d.emit(payload)
+	if err != nil {
+		return err
+	}
+
+	d.inflight[head.ID] = &inflightData{
+		payload:   payload,
+		attempts:  1,
+		nextRetry: time.Now().Add(d.cfg.AckTimeout + d.batchDelay()),
+	}
+	d.order = append(d.order, head.ID)
+	return nil
+}
+
+func (d *delivery) ack(id primitive.ObjectID) {
+	if _, ok := d.inflight[id]; !ok {
+		return
+	}
+	delete(d.inflight, id)
+	for i, v := range d.order {
+		if v == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// retry resends every item whose ack is overdue. Items that ran out of
+// attempts, or everything when the websocket is down, go back to the outbox.
+func (d *delivery) retry() {
+	now := time.Now()
+	connected := d.conn.IsConnected()
+	if !connected {
+		// the batch won't go out, its items are spooled below
+		d.flush()
+	}
+
+	for _, id := range append([]primitive.ObjectID(nil), d.order...) {
+		item := d.inflight[id]
+		if !connected || item.attempts >= d.cfg.MaxAttempts {
+			if connected {
+				log.Warnf("ProbeData: %s not acknowledged after %d attempts, spooling", id.Hex(), item.attempts)
+			}
+			d.ack(id)
+			if err := d.outbox.Append(item.payload); err != nil {
+				log.Errorf("ProbeData: unable to spool data %s: %v", id.Hex(), err)
+			}
+			continue
+		}
+		if now.Before(item.nextRetry) {
+			continue
+		}
+
+		if err := d.emit(item.payload); err != nil {
+			continue
+		}
+
+		backoff := d.cfg.AckTimeout << item.attempts
+		if backoff > maxAckBackoff || backoff <= 0 {
+			backoff = maxAckBackoff
+		}
+		item.attempts++
+		item.nextRetry = now.Add(backoff + d.batchDelay())
+		log.Debugf("ProbeData: resent %s (attempt %d)", id.Hex(), item.attempts)
+	}
+}
+
+// emit sends a payload, or adds it to the current batch when the
+// controller takes batches.
+func (d *delivery) emit(payload []byte) error {
+	if d.cfg.BatchSize <= 1 || !d.conn.Upload().Batch {
+		return emitProbeData(d.conn, payload)
+	}
+	if !d.conn.IsConnected() {
+		return errNotConnected
+	}
+
+	if len(d.batch) == 0 {
+		d.batchSince = time.Now()
+	}
+	d.batch = append(d.batch, payload)
+	d.batchBytes += len(payload)
+	if len(d.batch) >= d.cfg.BatchSize || d.batchBytes >= d.cfg.BatchBytes {
+		d.flush()
+	}
+	return nil
+}
+
+// batchDelay is how long a result can wait in a batch before it is sent.
+func (d *delivery) batchDelay() time.Duration {
+	if d.cfg.BatchSize <= 1 || !d.conn.Upload().Batch {
+		return 0
+	}
+	return d.cfg.BatchInterval
+}
+
+// flushDue sends the current batch once it is BatchInterval old.
+func (d *delivery) flushDue() {
+	if len(d.batch) > 0 && time.Since(d.batchSince) >= d.cfg.BatchInterval {
+		d.flush()
+	}
+}
+
+func (d *delivery) flush() {
+	if len(d.batch) == 0 {
+		return
+	}
+	batch := d.batch
+	d.batch, d.batchBytes = nil, 0
+
+	err := emitProbeData(d.conn, batch...)
+	if err == nil || !d.cfg.NoAck {
+		// unacknowledged items are resent or spooled by retry
+		return
+	}
+	for _, p := range batch {
+		if err := d.outbox.Append(p); err != nil {
+			log.Errorf("ProbeData: unable to spool data: %v", err)
+		}
+	}
+}
+
+// windowFull reports whether no more results can be sent until some are
+// acknowledged.
+func (d *delivery) windowFull() bool {
+	return !d.cfg.NoAck && len(d.inflight) >= d.cfg.Window
+}
+
+// pending is the number of results sent or batched but not acknowledged.
+func (d *delivery) pending() int {
+	if d.cfg.NoAck {
+		return len(d.batch)
+	}
+	return len(d.inflight)
+}
+
+// spool hands the batch and every unacknowledged item to the outbox.
+func (d *delivery) spool() {
+	if d.cfg.NoAck {
+		// otherwise the batched items are in flight as well
+		for _, p := range d.batch {
+			if err := d.outbox.Append(p); err != nil {
+				log.Errorf("ProbeData: unable to spool data: %v", err)
+			}
+		}
+	}
+	d.batch, d.batchBytes = nil, 0
+
+	for _, id := range append([]primitive.ObjectID(nil), d.order...) {
+		item := d.inflight[id]
+		d.ack(id)
+		if err := d.outbox.Append(item.payload); err != nil {
+			log.Errorf("ProbeData: unable to spool data %s: %v", id.Hex(), err)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/ws"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn records the probe_post frames instead of sending them.
+type fakeConn struct {
+	mu        sync.Mutex
+	connected bool
+	batch     bool
+	frames    [][]primitive.ObjectID
+}
+
+func (c *fakeConn) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeConn) EmitProbeData(payloads ...[]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return false
+	}
+	var frame []primitive.ObjectID
+	for _, b := range payloads {
+		var p probes.ProbeData
+		json.Unmarshal(b, &p)
+		frame = append(frame, p.ID)
+	}
+	c.frames = append(c.frames, frame)
+	return true
+}
+
+func (c *fakeConn) Upload() ws.Upload {
+	return ws.Upload{Batch: c.batch}
+}
+
+// sent returns the IDs emitted so far, in order, and forgets them.
+func (c *fakeConn) sent() []primitive.ObjectID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []primitive.ObjectID
+	for _, f := range c.frames {
+		ids = append(ids, f...)
+	}
+	c.frames = nil
+	return ids
+}
+
+func newTestDelivery(t *testing.T, conn *fakeConn, cfg DeliveryConfig) *delivery {
+	o, err := NewOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return newDelivery(conn, o, cfg)
+}
+
+func payload(t *testing.T) (primitive.ObjectID, []byte) {
+	id := primitive.NewObjectID()
+	b, err := json.Marshal(probes.ProbeData{ID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, b
+}
+
+// overdue makes every item in flight due for a retry.
+func overdue(d *delivery) {
+	for _, item := range d.inflight {
+		item.nextRetry = time.Now().Add(-time.Second)
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{AckTimeout: time.Minute, MaxAttempts: 10})
+	id, b := payload(t)
+	if err := d.send(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// waits AckTimeout, doubled on every attempt up to maxAckBackoff
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, maxAckBackoff, maxAckBackoff} {
+		overdue(d)
+		d.retry()
+		item := d.inflight[id]
+		if wait := time.Until(item.nextRetry); wait < want-time.Second || wait > want {
+			t.Errorf("attempt %d waits %s for its ack, want %s", item.attempts, wait, want)
+		}
+	}
+	if sent := conn.sent(); len(sent) != 5 {
+		t.Errorf("sent %d times, want 5", len(sent))
+	}
+
+	// not due yet
+	d.retry()
+	if sent := conn.sent(); len(sent) != 0 {
+		t.Errorf("resent %d items before their ack was overdue", len(sent))
+	}
+}
+
+func TestDeliveryRetryOrder(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{})
+	var ids []primitive.ObjectID
+	for i := 0; i < 4; i++ {
+		id, b := payload(t)
+		d.send(b)
+		ids = append(ids, id)
+	}
+	conn.sent()
+
+	d.ack(ids[1])
+	d.ack(primitive.NewObjectID())
+	overdue(d)
+	d.retry()
+	if got, want := conn.sent(), []primitive.ObjectID{ids[0], ids[2], ids[3]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resent %v, want %v", got, want)
+	}
+	if n := d.pending(); n != 3 {
+		t.Errorf("pending() = %d, want 3", n)
+	}
+}
+
+func TestDeliveryMaxAttempts(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{MaxAttempts: 2})
+	_, b := payload(t)
+	d.send(b)
+
+	overdue(d)
+	d.retry()
+	if n := d.outbox.Len(); n != 0 {
+		t.Fatalf("spooled after %d attempts", d.inflight[d.order[0]].attempts)
+	}
+
+	// the next retry spools it instead of sending it a third time
+	overdue(d)
+	d.retry()
+	if sent := conn.sent(); len(sent) != 2 {
+		t.Errorf("sent %d times, want 2", len(sent))
+	}
+	if n, pending := d.outbox.Len(), d.pending(); n != 1 || pending != 0 {
+		t.Errorf("%d spooled and %d pending, want it spooled", n, pending)
+	}
+}
+
+func TestDeliveryDisconnected(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{})
+	for i := 0; i < 3; i++ {
+		_, b := payload(t)
+		d.send(b)
+	}
+
+	conn.connected = false
+	_, b := payload(t)
+	if err := d.send(b); err != errNotConnected {
+		t.Errorf("send() = %v while disconnected", err)
+	}
+
+	// not waiting for acks that won't come
+	d.retry()
+	if n, pending := d.outbox.Len(), d.pending(); n != 3 || pending != 0 {
+		t.Errorf("%d spooled and %d pending, want all 3 spooled", n, pending)
+	}
+}
+
+func TestDeliveryWindow(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{Window: 2})
+	first, b := payload(t)
+	d.send(b)
+	_, b = payload(t)
+	d.send(b)
+	if !d.windowFull() {
+		t.Error("windowFull() = false with 2 items in a window of 2")
+	}
+
+	_, b = payload(t)
+	if err := d.send(b); err != errDeliveryWindowFull {
+		t.Errorf("send() = %v with a full window", err)
+	}
+	if sent := conn.sent(); len(sent) != 2 {
+		t.Errorf("sent %d items, want 2", len(sent))
+	}
+
+	d.ack(first)
+	if err := d.send(b); err != nil {
+		t.Errorf("send() = %v after an ack", err)
+	}
+}
+
+func TestDeliveryNoAck(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{Window: 1, NoAck: true})
+	for i := 0; i < 3; i++ {
+		_, b := payload(t)
+		if err := d.send(b); err != nil {
+			t.Fatalf("send() = %v", err)
+		}
+	}
+	if n := d.pending(); n != 0 || d.windowFull() {
+		t.Errorf("pending() = %d without acks", n)
+	}
+}
+
+func TestDeliveryBatch(t *testing.T) {
+	conn := &fakeConn{connected: true, batch: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{BatchSize: 3, BatchInterval: time.Minute})
+
+	var ids []primitive.ObjectID
+	for i := 0; i < 4; i++ {
+		id, b := payload(t)
+		d.send(b)
+		ids = append(ids, id)
+	}
+	if len(conn.frames) != 1 || !reflect.DeepEqual(conn.frames[0], ids[:3]) {
+		t.Fatalf("sent %v, want a batch of the first 3", conn.frames)
+	}
+	conn.sent()
+
+	// the last one waits for the batch interval
+	d.flushDue()
+	if len(conn.frames) != 0 {
+		t.Fatal("sent a batch before BatchInterval")
+	}
+	d.batchSince = time.Now().Add(-time.Minute)
+	d.flushDue()
+	if got := conn.sent(); !reflect.DeepEqual(got, ids[3:]) {
+		t.Errorf("sent %v once due, want %v", got, ids[3:])
+	}
+
+	// time in the batch doesn't count towards the ack timeout
+	if wait := time.Until(d.inflight[ids[3]].nextRetry); wait < defaultAckTimeout+time.Minute-time.Second {
+		t.Errorf("waiting %s for the ack of a batched item", wait)
+	}
+}
+
+func TestWebSocketSinkAcks(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{Window: 1})
+	wsH := &ws.WebSocketHandler{ProbeAckCh: make(chan primitive.ObjectID)}
+	s := newWebSocketSink(wsH, d.outbox, d)
+	defer s.Close()
+
+	first := probes.ProbeData{ID: primitive.NewObjectID()}
+	second := probes.ProbeData{ID: primitive.NewObjectID()}
+	s.Write(first)
+	s.Write(second)
+	waitFor(t, func() bool { return d.outbox.Len() == 1 })
+	if got := conn.sent(); !reflect.DeepEqual(got, []primitive.ObjectID{first.ID}) {
+		t.Fatalf("sent %v with a window of 1, want the first result", got)
+	}
+
+	// once acknowledged, the spooled one goes out
+	wsH.ProbeAckCh <- first.ID
+	var sent []primitive.ObjectID
+	waitFor(t, func() bool {
+		sent = append(sent, conn.sent()...)
+		return len(sent) > 0
+	})
+	if !reflect.DeepEqual(sent, []primitive.ObjectID{second.ID}) {
+		t.Errorf("sent %v after the ack, want the second result", sent)
+	}
+	wsH.ProbeAckCh <- second.ID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Errorf("Drain() = %v with everything acknowledged", err)
+	}
+	if n := d.outbox.Len(); n != 0 {
+		t.Errorf("%d results spooled", n)
+	}
+}
+
+func TestWebSocketSinkAckTimeout(t *testing.T) {
+	conn := &fakeConn{connected: true}
+	d := newTestDelivery(t, conn, DeliveryConfig{AckTimeout: time.Millisecond, MaxAttempts: 2})
+	s := newWebSocketSink(&ws.WebSocketHandler{}, d.outbox, d)
+	defer s.Close()
+
+	// sent, resent once, then spooled and replayed from the outbox
+	p := probes.ProbeData{ID: primitive.NewObjectID()}
+	s.Write(p)
+	var sent []primitive.ObjectID
+	waitFor(t, func() bool {
+		sent = append(sent, conn.sent()...)
+		return len(sent) >= 3
+	})
+	if want := []primitive.ObjectID{p.ID, p.ID, p.ID}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want the result 3 times", sent)
+	}
+}
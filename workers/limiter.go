@@ -0,0 +1,220 @@
+package workers
+
+import (
+	"context"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimits bound how many probes run at once. Global covers every
+// scheduled run, PerType caps individual types on top of it; 0 means no
+// limit. They are read by InitProbeWorker, use SetConcurrencyLimits to
+// change them afterwards.
+var ConcurrencyLimits = Limits{
+	Global: 4 * runtime.NumCPU(),
+	PerType: map[probes.ProbeType]int{
+		probes.ProbeType_MTR:       runtime.NumCPU(),
+		probes.ProbeType_SPEEDTEST: 1, // parallel speed tests skew each other
+	},
+}
+
+type Limits struct {
+	Global  int
+	PerType map[probes.ProbeType]int
+}
+
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+)
+
+// priorityAging is how long a run waits before it is ranked one priority
+// higher, so a steady stream of short probes can't starve the long ones.
+const priorityAging = time.Minute
+
+// probePriority ranks waiting runs so that long probes queue behind short
+// ones. Triggered runs go first, see acquireTriggered.
+func probePriority(t probes.ProbeType) priority {
+	switch t {
+	case probes.ProbeType_MTR, probes.ProbeType_SPEEDTEST:
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+type waiter struct {
+	typ     probes.ProbeType
+	prio    priority
+	seq     uint64
+	queued  time.Time
+	global  bool // takes a global slot
+	ready   chan struct{}
+	granted bool
+}
+
+// rank is the priority of w after waiting until now, never above
+// priorityHigh.
+func (w *waiter) rank(now time.Time) priority {
+	p := w.prio + priority(now.Sub(w.queued)/priorityAging)
+	if p > priorityHigh {
+		p = priorityHigh
+	}
+	return p
+}
+
+// limiter hands out run slots, highest priority first and in arrival order
+// within a priority. Waiters gain priority the longer they are queued. A waiter whose type is at its limit doesn't hold up
+// waiters of other types.
+type limiter struct {
+	limits Limits
+
+	mu      sync.Mutex
+	running int
+	byType  map[probes.ProbeType]int
+	waiting []*waiter
+	seq     uint64
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits: limits,
+		byType: make(map[probes.ProbeType]int),
+	}
+}
+
+// SetConcurrencyLimits replaces ConcurrencyLimits. Runs already holding a
+// slot keep it, waiting runs are granted slots under the new limits.
+func SetConcurrencyLimits(limits Limits) {
+	ConcurrencyLimits = limits
+	if probeLimiter != nil {
+		probeLimiter.setLimits(limits)
+	}
+}
+
+func (l *limiter) setLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.dispatch()
+}
+
+// acquire waits for a slot for a probe of type t. The returned func frees it.
+func (l *limiter) acquire(ctx context.Context, t probes.ProbeType, prio priority) (func(), time.Duration, error) {
+	return l.wait(ctx, &waiter{typ: t, prio: prio, global: true})
+}
+
+// acquireTriggered waits for a slot for a run triggered from within another
+// probe, eg. an MTR after packet loss. It skips the global limit since the
+// triggering run already holds a global slot and waiting for another could
+// deadlock.
+func (l *limiter) acquireTriggered(t probes.ProbeType) func() {
+	release, _, _ := l.wait(context.Background(), &waiter{typ: t, prio: priorityHigh})
+	return release
+}
+
+func (l *limiter) wait(ctx context.Context, w *waiter) (func(), time.Duration, error) {
+	start := time.Now()
+	w.ready = make(chan struct{})
+
+	l.mu.Lock()
+	l.seq++
+	w.seq = l.seq
+	w.queued = start
+	l.waiting = append(l.waiting, w)
+	l.dispatch()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		l.mu.Lock()
+		granted := w.granted
+		if !granted {
+			l.remove(w)
+		}
+		l.mu.Unlock()
+		if granted {
+			l.release(w)
+		}
+		return func() {}, time.Since(start), ctx.Err()
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(w) }) }, time.Since(start), nil
+}
+
+// dispatch grants slots to waiters in order; l.mu must be held.
+func (l *limiter) dispatch() {
+	now := time.Now()
+	sort.SliceStable(l.waiting, func(i, j int) bool {
+		ri, rj := l.waiting[i].rank(now), l.waiting[j].rank(now)
+		if ri != rj {
+			return ri > rj
+		}
+		return l.waiting[i].seq < l.waiting[j].seq
+	})
+
+	kept := l.waiting[:0]
+	for _, w := range l.waiting {
+		if l.fits(w) {
+			w.granted = true
+			if w.global {
+				l.running++
+			}
+			l.byType[w.typ]++
+			close(w.ready)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	for i := len(kept); i < len(l.waiting); i++ {
+		l.waiting[i] = nil
+	}
+	l.waiting = kept
+}
+
+func (l *limiter) fits(w *waiter) bool {
+	if w.global && l.limits.Global > 0 && l.running >= l.limits.Global {
+		return false
+	}
+	max := l.limits.PerType[w.typ]
+	return max <= 0 || l.byType[w.typ] < max
+}
+
+func (l *limiter) remove(w *waiter) {
+	for i, o := range l.waiting {
+		if o == w {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *limiter) release(w *waiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w.global {
+		l.running--
+	}
+	l.byType[w.typ]--
+	l.dispatch()
+}
+
+// stats describes the queue, with waited being how long the run it is
+// attached to was queued.
+func (l *limiter) stats(waited time.Duration) *probes.QueueStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &probes.QueueStats{
+		Running:  l.running,
+		Queued:   len(l.waiting),
+		WaitedMs: waited.Milliseconds(),
+	}
+}
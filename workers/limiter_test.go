@@ -0,0 +1,165 @@
+package workers
+
+import (
+	"context"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"testing"
+	"time"
+)
+
+// acquireAsync queues a run of type t and returns a channel receiving its
+// release func once it gets a slot. It returns once the run is queued.
+func acquireAsync(t *testing.T, l *limiter, typ probes.ProbeType, prio priority) chan func() {
+	l.mu.Lock()
+	queued := len(l.waiting)
+	l.mu.Unlock()
+
+	got := make(chan func(), 1)
+	go func() {
+		release, _, err := l.acquire(context.Background(), typ, prio)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- release
+	}()
+
+	waitFor(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiting) > queued
+	})
+	return got
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func granted(ch chan func()) (func(), bool) {
+	select {
+	case release := <-ch:
+		return release, true
+	case <-time.After(100 * time.Millisecond):
+		return nil, false
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	release, _, err := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := acquireAsync(t, l, probes.ProbeType_PING, priorityNormal)
+	if _, ok := granted(next); ok {
+		t.Fatal("second run started over the global limit")
+	}
+	release()
+	release() // releasing twice frees one slot
+	nextRelease, ok := granted(next)
+	if !ok {
+		t.Fatal("queued run didn't start once a slot was free")
+	}
+	nextRelease()
+
+	if l.running != 0 {
+		t.Errorf("%d runs still hold a slot", l.running)
+	}
+}
+
+func TestLimiterPerType(t *testing.T) {
+	l := newLimiter(Limits{Global: 4, PerType: map[probes.ProbeType]int{probes.ProbeType_MTR: 1}})
+	release, _, _ := l.acquire(context.Background(), probes.ProbeType_MTR, priorityLow)
+	defer release()
+
+	mtr := acquireAsync(t, l, probes.ProbeType_MTR, priorityLow)
+	ping, _, err := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping()
+	if _, ok := granted(mtr); ok {
+		t.Error("second MTR started over its limit")
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	release, _, _ := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+
+	mtr := acquireAsync(t, l, probes.ProbeType_MTR, priorityLow)
+	ping := acquireAsync(t, l, probes.ProbeType_PING, priorityNormal)
+	release()
+
+	pingRelease, ok := granted(ping)
+	if !ok {
+		t.Fatal("the higher priority run didn't start first")
+	}
+	if _, ok := granted(mtr); ok {
+		t.Fatal("two runs started over the global limit")
+	}
+	pingRelease()
+	if _, ok := granted(mtr); !ok {
+		t.Fatal("the lower priority run never started")
+	}
+}
+
+func TestLimiterAging(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	release, _, _ := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+
+	mtr := acquireAsync(t, l, probes.ProbeType_MTR, priorityLow)
+	l.mu.Lock()
+	l.waiting[0].queued = time.Now().Add(-2 * priorityAging)
+	l.mu.Unlock()
+	ping := acquireAsync(t, l, probes.ProbeType_PING, priorityNormal)
+	release()
+
+	if _, ok := granted(mtr); !ok {
+		t.Fatal("a run queued for long was passed over by a newer one")
+	}
+	if _, ok := granted(ping); ok {
+		t.Fatal("two runs started over the global limit")
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	release, _, _ := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := l.acquire(ctx, probes.ProbeType_PING, priorityNormal)
+	if err != context.DeadlineExceeded {
+		t.Errorf("acquire() = %v, want the context's error", err)
+	}
+	if len(l.waiting) != 0 {
+		t.Errorf("%d runs still queued after cancelling", len(l.waiting))
+	}
+}
+
+func TestLimiterTriggeredSkipsGlobal(t *testing.T) {
+	l := newLimiter(Limits{Global: 1})
+	release, _, _ := l.acquire(context.Background(), probes.ProbeType_PING, priorityNormal)
+	defer release()
+
+	done := make(chan struct{})
+	go func() {
+		l.acquireTriggered(probes.ProbeType_MTR)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a triggered run waited for a global slot")
+	}
+}
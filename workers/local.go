@@ -0,0 +1,35 @@
+package workers
+
+import (
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeProbes feeds the probe worker with the locally defined probes, and
+// then with every list received from the controller combined with them.
+// A controller probe wins when both use the same ID.
+func MergeProbes(local []probes.Probe, controllerCh chan []probes.Probe, workerCh chan []probes.Probe) {
+	go func() {
+		workerCh <- local
+
+		for remote := range controllerCh {
+			merged := append([]probes.Probe(nil), remote...)
+			for _, l := range local {
+				if !containsProbe(remote, l) {
+					merged = append(merged, l)
+				}
+			}
+			log.Infof("Merged %d controller probes with %d local probes", len(remote), len(local))
+			workerCh <- merged
+		}
+	}()
+}
+
+func containsProbe(pp []probes.Probe, p probes.Probe) bool {
+	for _, v := range pp {
+		if v.ID == p.ID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package workers
+
+import (
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func receiveProbes(t *testing.T, ch chan []probes.Probe) []probes.Probe {
+	t.Helper()
+	select {
+	case pp := <-ch:
+		return pp
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for probes")
+		return nil
+	}
+}
+
+func TestMergeProbes(t *testing.T) {
+	shared := primitive.NewObjectID()
+	local := []probes.Probe{
+		{ID: shared, Type: probes.ProbeType_PING},
+		{ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR},
+	}
+	controllerCh := make(chan []probes.Probe)
+	workerCh := make(chan []probes.Probe)
+	MergeProbes(local, controllerCh, workerCh)
+	defer close(controllerCh)
+
+	if pp := receiveProbes(t, workerCh); len(pp) != 2 {
+		t.Fatalf("worker started with %d probes, want the 2 local ones", len(pp))
+	}
+
+	remote := []probes.Probe{
+		{ID: shared, Type: probes.ProbeType_PING, Config: probes.ProbeConfig{Duration: 30}},
+		{ID: primitive.NewObjectID(), Type: probes.ProbeType_SYSTEMINFO},
+	}
+	controllerCh <- remote
+	pp := receiveProbes(t, workerCh)
+	if len(pp) != 3 {
+		t.Fatalf("merged %d probes, want 3", len(pp))
+	}
+	for _, p := range pp {
+		if p.ID == shared && p.Config.Duration != 30 {
+			t.Error("local probe won over the controller probe with the same ID")
+		}
+	}
+}
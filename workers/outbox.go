@@ -0,0 +1,319 @@
+package workers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	outboxSegmentExt         = ".seg"
+	defaultOutboxMaxBytes    = 64 * 1024 * 1024
+	defaultOutboxSegmentSize = 4 * 1024 * 1024
+)
+
+// Outbox is a size-bounded spool of newline delimited records stored in
+// append-only segment files. It buffers probe data while the controller
+// is unreachable; once full, the oldest segments are dropped first.
+type Outbox struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu        sync.Mutex
+	segments  []*outboxSegment // oldest first
+	active    *os.File
+	replaying *outboxSegment // kept from eviction, its records are being sent
+	dropped   uint64
+}
+
+type outboxSegment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// NewOutbox opens (or creates) the spool in dir, picking up any segments
+// left behind by a previous run.
+func NewOutbox(dir string, maxBytes, segmentBytes int64) (*Outbox, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultOutboxMaxBytes
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = defaultOutboxSegmentSize
+	}
+	if segmentBytes > maxBytes {
+		segmentBytes = maxBytes
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), outboxSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), outboxSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		o.segments = append(o.segments, &outboxSegment{
+			seq:     seq,
+			size:    int64(len(b)),
+			records: bytes.Count(b, []byte{'\n'}),
+		})
+	}
+
+	sort.Slice(o.segments, func(i, j int) bool {
+		return o.segments[i].seq < o.segments[j].seq
+	})
+
+	if n := o.Len(); n > 0 {
+		log.Infof("Outbox: found %d spooled records in %s", n, dir)
+	}
+
+	return o, nil
+}
+
+func (o *Outbox) segmentPath(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, outboxSegmentExt))
+}
+
+// Append writes a single record to the newest segment, rolling to a new
+// segment when it is full and evicting the oldest ones over maxBytes.
+func (o *Outbox) Append(record []byte) error {
+	if bytes.IndexByte(record, '\n') >= 0 {
+		return errors.New("outbox record must not contain a newline")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var cur *outboxSegment
+	if len(o.segments) > 0 {
+		cur = o.segments[len(o.segments)-1]
+	}
+
+	if o.active == nil || cur == nil || cur.size >= o.segmentBytes {
+		if o.active != nil {
+			o.active.Close()
+			o.active = nil
+		}
+		var seq uint64 = 1
+		if cur != nil {
+			seq = cur.seq + 1
+		}
+		f, err := os.OpenFile(o.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		o.active = f
+		cur = &outboxSegment{seq: seq}
+		o.segments = append(o.segments, cur)
+	}
+
+	line := make([]byte, 0, len(record)+1)
+	line = append(append(line, record...), '\n')
+	n, err := o.active.Write(line)
+	cur.size += int64(n)
+	if err != nil {
+		return err
+	}
+	cur.records++
+
+	o.evict()
+	return nil
+}
+
+// evict removes the oldest segments until the spool fits in maxBytes. The
+// segment currently being written is never removed, nor the one being
+// replayed.
+func (o *Outbox) evict() {
+	for len(o.segments) > 1 && o.size() > o.maxBytes {
+		i := 0
+		if o.segments[0] == o.replaying {
+			i = 1
+		}
+		if i == len(o.segments)-1 {
+			return
+		}
+		oldest := o.segments[i]
+		err := os.Remove(o.segmentPath(oldest.seq))
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Outbox: unable to remove segment %d: %v", oldest.seq, err)
+			return
+		}
+		o.segments = append(o.segments[:i], o.segments[i+1:]...)
+		o.dropped += uint64(oldest.records)
+		log.Warnf("Outbox: full, dropped %d oldest records (%d dropped total)", oldest.records, o.dropped)
+	}
+}
+
+func (o *Outbox) size() int64 {
+	var total int64
+	for _, s := range o.segments {
+		total += s.size
+	}
+	return total
+}
+
+// Replay hands every spooled record to send, oldest first. Records are
+// removed from disk once sent; on the first send error the remaining
+// records are kept for the next replay and the error is returned.
+func (o *Outbox) Replay(send func([]byte) error) (int, error) {
+	o.mu.Lock()
+	pending := append([]*outboxSegment(nil), o.segments...)
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		o.replaying = nil
+		o.mu.Unlock()
+	}()
+
+	sent := 0
+	for _, seg := range pending {
+		o.mu.Lock()
+		o.replaying = seg
+		if o.active != nil && len(o.segments) > 0 && o.segments[len(o.segments)-1] == seg {
+			// replaying the segment being written, records appended from
+			// now on go to a new one
+			o.active.Close()
+			o.active = nil
+		}
+		o.mu.Unlock()
+
+		path := o.segmentPath(seg.seq)
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			// evicted while we were replaying
+			continue
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		var lines [][]byte
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		scanner.Buffer(make([]byte, 0, 64*1024), int(o.segmentBytes)+1024*1024)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+		corrupt := scanner.Err()
+		if corrupt != nil {
+			log.Errorf("Outbox: segment %d is corrupt, discarding remainder: %v", seg.seq, corrupt)
+		}
+
+		for i, line := range lines {
+			if err := send(line); err != nil {
+				if i > 0 {
+					o.rewrite(seg, lines[i:])
+				}
+				return sent, err
+			}
+			sent++
+		}
+
+		o.mu.Lock()
+		os.Remove(path)
+		if o.removeSegment(seg.seq) && corrupt != nil && seg.records > len(lines) {
+			o.dropped += uint64(seg.records - len(lines))
+		}
+		o.mu.Unlock()
+	}
+
+	return sent, nil
+}
+
+// rewrite replaces a partially replayed segment with its unsent records.
+func (o *Outbox) rewrite(seg *outboxSegment, remaining [][]byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	path := o.segmentPath(seg.seq)
+	tmp := path + ".tmp"
+	buf := bytes.Join(remaining, []byte{'\n'})
+	buf = append(buf, '\n')
+
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		log.Errorf("Outbox: unable to rewrite segment %d: %v", seg.seq, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Errorf("Outbox: unable to rewrite segment %d: %v", seg.seq, err)
+		return
+	}
+	seg.size = int64(len(buf))
+	seg.records = len(remaining)
+}
+
+func (o *Outbox) removeSegment(seq uint64) bool {
+	for i, s := range o.segments {
+		if s.seq == seq {
+			o.segments = append(o.segments[:i], o.segments[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of records currently spooled.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n := 0
+	for _, s := range o.segments {
+		n += s.records
+	}
+	return n
+}
+
+// Dropped returns how many records have been evicted because the spool was
+// full, or discarded because their segment was corrupt.
+func (o *Outbox) Dropped() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
+
+// Close releases the active segment file.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.active == nil {
+		return nil
+	}
+	err := o.active.Close()
+	o.active = nil
+	return err
+}
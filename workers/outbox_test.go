@@ -0,0 +1,217 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/ws"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// record is a 9 byte outbox record, 10 bytes on disk.
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record-%02d", i))
+}
+
+func appendRecords(t *testing.T, o *Outbox, from, to int) {
+	for i := from; i < to; i++ {
+		if err := o.Append(record(i)); err != nil {
+			t.Fatalf("Append(%d) = %v", i, err)
+		}
+	}
+}
+
+// replayAll returns the records replayed by o.
+func replayAll(t *testing.T, o *Outbox) []string {
+	var got []string
+	_, err := o.Replay(func(b []byte) error {
+		got = append(got, string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() = %v", err)
+	}
+	return got
+}
+
+func records(from, to int) []string {
+	var want []string
+	for i := from; i < to; i++ {
+		want = append(want, string(record(i)))
+	}
+	return want
+}
+
+func TestOutboxReopen(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, o, 0, 5)
+	o.Close()
+
+	o, err = NewOutbox(dir, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.Len(); n != 5 {
+		t.Fatalf("Len() = %d after a restart, want 5", n)
+	}
+
+	// appended after the records found on disk
+	appendRecords(t, o, 5, 6)
+	if got := replayAll(t, o); !reflect.DeepEqual(got, records(0, 6)) {
+		t.Errorf("replayed %q", got)
+	}
+	if n := o.Len(); n != 0 {
+		t.Errorf("Len() = %d after replaying everything", n)
+	}
+}
+
+func TestOutboxRejectsNewlines(t *testing.T) {
+	o, err := NewOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if err := o.Append([]byte("a\nb")); err == nil {
+		t.Error("Append() took a record with a newline")
+	}
+}
+
+func TestOutboxEviction(t *testing.T) {
+	// two records per segment, four in the spool
+	o, err := NewOutbox(t.TempDir(), 40, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	appendRecords(t, o, 0, 6)
+	if n, dropped := o.Len(), o.Dropped(); n != 4 || dropped != 2 {
+		t.Errorf("Len(), Dropped() = %d, %d, want 4, 2", n, dropped)
+	}
+	if got := replayAll(t, o); !reflect.DeepEqual(got, records(2, 6)) {
+		t.Errorf("replayed %q, want the newest records", got)
+	}
+}
+
+func TestOutboxEvictionWhileReplaying(t *testing.T) {
+	o, err := NewOutbox(t.TempDir(), 40, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	appendRecords(t, o, 0, 4)
+
+	// records spooled while the oldest segment is sent evict the next one
+	var got []string
+	_, err = o.Replay(func(b []byte) error {
+		got = append(got, string(b))
+		appendRecords(t, o, 3+len(got), 4+len(got))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() = %v", err)
+	}
+	if !reflect.DeepEqual(got, records(0, 2)) {
+		t.Errorf("replayed %q, want the oldest segment", got)
+	}
+	if dropped := o.Dropped(); dropped != 2 {
+		t.Errorf("Dropped() = %d, want the 2 records of the second segment", dropped)
+	}
+	if got := replayAll(t, o); !reflect.DeepEqual(got, records(4, 6)) {
+		t.Errorf("replayed %q next, want the records spooled meanwhile", got)
+	}
+}
+
+func TestOutboxReplayPartial(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir, 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, o, 0, 6)
+
+	errDown := errors.New("down")
+	var got []string
+	sent, err := o.Replay(func(b []byte) error {
+		if len(got) == 4 {
+			return errDown
+		}
+		got = append(got, string(b))
+		return nil
+	})
+	if sent != 4 || err != errDown {
+		t.Fatalf("Replay() = %d, %v, want 4, %v", sent, err, errDown)
+	}
+	if n := o.Len(); n != 2 {
+		t.Errorf("Len() = %d after sending 4 records of 6", n)
+	}
+
+	// the rest of the segment is on disk, nothing was dropped
+	o.Close()
+	o, err = NewOutbox(dir, 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if got := replayAll(t, o); !reflect.DeepEqual(got, records(4, 6)) {
+		t.Errorf("replayed %q after a restart", got)
+	}
+	if dropped := o.Dropped(); dropped != 0 {
+		t.Errorf("Dropped() = %d", dropped)
+	}
+}
+
+func TestOutboxReplayFirstRecordFails(t *testing.T) {
+	o, err := NewOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	appendRecords(t, o, 0, 3)
+
+	sent, err := o.Replay(func([]byte) error { return errDeliveryWindowFull })
+	if sent != 0 || err != errDeliveryWindowFull {
+		t.Fatalf("Replay() = %d, %v", sent, err)
+	}
+	if got := replayAll(t, o); !reflect.DeepEqual(got, records(0, 3)) {
+		t.Errorf("replayed %q", got)
+	}
+}
+
+func TestWebSocketSinkWriteAfterDrain(t *testing.T) {
+	o, err := NewOutbox(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewWebSocketSink(&ws.WebSocketHandler{}, o, DeliveryConfig{})
+	defer s.Close()
+
+	// not connected, the queued result is spooled
+	s.Write(probes.ProbeData{ID: primitive.NewObjectID()})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Drain(ctx)
+
+	done := make(chan error)
+	go func() { done <- s.Write(probes.ProbeData{ID: primitive.NewObjectID()}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write() after Drain = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() after Drain blocked")
+	}
+	if n := o.Len(); n != 2 {
+		t.Errorf("Len() = %d, want both results spooled", n)
+	}
+}
@@ -1,14 +1,15 @@
 package workers
 
 import (
+	"context"
 	_ "encoding/json"
 	"errors"
 	"fmt"
 	"github.com/netwatcherio/netwatcher-agent/probes"
-	"github.com/showwin/speedtest-go/speedtest"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/sync/syncmap"
+	"reflect"
 	"strconv"
 	_ "strconv"
 	"strings"
@@ -77,6 +78,19 @@ func findMatchingMTRProbe(probe probes.Probe) (probes.Probe, error) {
 	return foundProbe, nil
 }
 
+// GetProbe returns the probe a worker is currently running, if any.
+func GetProbe(id primitive.ObjectID) (probes.Probe, bool) {
+	v, ok := checkWorkers.Load(id)
+	if !ok {
+		return probes.Probe{}, false
+	}
+	pw, ok := v.(ProbeWorkerS)
+	if !ok {
+		return probes.Probe{}, false
+	}
+	return pw.Probe, true
+}
+
 func trafficSimConfigChanged(oldProbe, newProbe probes.Probe) bool {
 	// Check if target address/port changed
 	if len(oldProbe.Config.Target) > 0 && len(newProbe.Config.Target) > 0 {
@@ -130,10 +144,37 @@ func stopTrafficSim(probeID primitive.ObjectID, isServer bool) {
 	}
 }
 
-func InitProbeWorker(checkChan chan []probes.Probe, dataChan chan probes.ProbeData, thisAgent primitive.ObjectID) {
+var probeScheduler *scheduler
+var probeLimiter *limiter
+
+// probeDataChan and thisAgentID are kept for restarting workers on request
+var probeDataChan chan probes.ProbeData
+var thisAgentID primitive.ObjectID
+
+// workerCtx is InitProbeWorker's context, every probe stops once it is done.
+var workerCtx = context.Background()
+
+// runningProbes counts the goroutines running probes, for Wait.
+var runningProbes sync.WaitGroup
+
+// InitProbeWorker runs the probes received on checkChan until ctx is done.
+func InitProbeWorker(ctx context.Context, checkChan chan []probes.Probe, dataChan chan probes.ProbeData, thisAgent primitive.ObjectID) {
+	workerCtx = ctx
+	probeDataChan = dataChan
+	thisAgentID = thisAgent
+	probeLimiter = newLimiter(ConcurrencyLimits)
+	probeScheduler = newScheduler(dataChan)
+	go probeScheduler.run(ctx)
+
 	go func(aC chan []probes.Probe, dC chan probes.ProbeData) {
 		for {
-			a := <-aC
+			var a []probes.Probe
+			select {
+			case a = <-aC:
+			case <-ctx.Done():
+				// the scheduled runs and TrafficSim workers stop on their own
+				return
+			}
 
 			var newIds []primitive.ObjectID
 
@@ -153,49 +194,18 @@ func InitProbeWorker(checkChan chan []probes.Probe, dataChan chan probes.ProbeDa
 						StopOnce:  stopOnce,
 						WaitGroup: wg,
 					})
-					startCheckWorker(ad.ID, dataChan, thisAgent)
+					if ad.Type == probes.ProbeType_TRAFFICSIM {
+						startTrafficSimWorker(ad.ID, dataChan, thisAgent)
+					} else {
+						probeScheduler.add(ad)
+					}
 				} else {
 					oldProbeWorker := existingWorker.(ProbeWorkerS)
 
 					// Check if TrafficSim config changed
 					if ad.Type == probes.ProbeType_TRAFFICSIM && trafficSimConfigChanged(oldProbeWorker.Probe, ad) {
 						log.Infof("TrafficSim probe %s configuration changed, restarting", ad.ID.Hex())
-
-						// Stop the old instance
-						if oldProbeWorker.StopChan != nil && oldProbeWorker.StopOnce != nil {
-							oldProbeWorker.StopOnce.Do(func() {
-								close(oldProbeWorker.StopChan)
-							})
-						}
-
-						// Wait for worker to finish
-						if oldProbeWorker.WaitGroup != nil {
-							log.Debugf("Waiting for old TrafficSim worker %s to stop...", ad.ID.Hex())
-							oldProbeWorker.WaitGroup.Wait()
-							log.Debugf("Old TrafficSim worker %s stopped", ad.ID.Hex())
-						}
-
-						// Force stop TrafficSim instance
-						stopTrafficSim(ad.ID, oldProbeWorker.Probe.Config.Server)
-
-						// Wait a bit more for complete cleanup
-						time.Sleep(1 * time.Second)
-
-						// Store the updated probe with new StopChan
-						newStopChan := make(chan struct{})
-						newStopOnce := &sync.Once{}
-						newWg := &sync.WaitGroup{}
-						checkWorkers.Store(ad.ID, ProbeWorkerS{
-							Probe:     ad,
-							ToRemove:  false,
-							StopChan:  newStopChan,
-							StopOnce:  newStopOnce,
-							WaitGroup: newWg,
-						})
-
-						// Start new worker
-						log.Infof("Starting UPDATED worker for probe %s", ad.ID.Hex())
-						startCheckWorker(ad.ID, dataChan, thisAgent)
+						restartTrafficSimWorker(oldProbeWorker, ad, dataChan, thisAgent)
 					} else if ad.Type == probes.ProbeType_TRAFFICSIM && ad.Config.Server {
 						// Just update allowed agents for server
 						var allowedAgentsList []primitive.ObjectID
@@ -214,8 +224,12 @@ func InitProbeWorker(checkChan chan []probes.Probe, dataChan chan probes.ProbeDa
 						checkWorkers.Store(ad.ID, oldProbeWorker)
 					} else {
 						// Update the probe data for non-TrafficSim types
+						changed := !reflect.DeepEqual(oldProbeWorker.Probe.Config, ad.Config)
 						oldProbeWorker.Probe = ad
 						checkWorkers.Store(ad.ID, oldProbeWorker)
+						if changed {
+							probeScheduler.update(ad)
+						}
 					}
 				}
 
@@ -244,7 +258,12 @@ func InitProbeWorker(checkChan chan []probes.Probe, dataChan chan probes.ProbeDa
 						}
 
 						stopTrafficSim(probeWorker.Probe.ID, probeWorker.Probe.Config.Server)
+					} else {
+						probeScheduler.remove(probeWorker.Probe.ID)
 					}
+
+					checkWorkers.Delete(key)
+					forgetProbeState(probeWorker.Probe.ID)
 				}
 				return true
 			})
@@ -252,6 +271,43 @@ func InitProbeWorker(checkChan chan []probes.Probe, dataChan chan probes.ProbeDa
 	}(checkChan, dataChan)
 }
 
+// restartTrafficSimWorker stops the TrafficSim instance of old and starts
+// one for p in its place.
+func restartTrafficSimWorker(old ProbeWorkerS, p probes.Probe, dataChan chan probes.ProbeData, thisAgent primitive.ObjectID) {
+	// Stop the old instance
+	if old.StopChan != nil && old.StopOnce != nil {
+		old.StopOnce.Do(func() {
+			close(old.StopChan)
+		})
+	}
+
+	// Wait for worker to finish
+	if old.WaitGroup != nil {
+		log.Debugf("Waiting for old TrafficSim worker %s to stop...", p.ID.Hex())
+		old.WaitGroup.Wait()
+		log.Debugf("Old TrafficSim worker %s stopped", p.ID.Hex())
+	}
+
+	// Force stop TrafficSim instance
+	stopTrafficSim(p.ID, old.Probe.Config.Server)
+
+	// Wait a bit more for complete cleanup
+	time.Sleep(1 * time.Second)
+
+	// Store the updated probe with new StopChan
+	checkWorkers.Store(p.ID, ProbeWorkerS{
+		Probe:     p,
+		ToRemove:  false,
+		StopChan:  make(chan struct{}),
+		StopOnce:  &sync.Once{},
+		WaitGroup: &sync.WaitGroup{},
+	})
+
+	// Start new worker
+	log.Infof("Starting UPDATED worker for probe %s", p.ID.Hex())
+	startTrafficSimWorker(p.ID, dataChan, thisAgent)
+}
+
 func contains(ids []primitive.ObjectID, id primitive.ObjectID) bool {
 	for _, v := range ids {
 		if v == id {
@@ -261,13 +317,111 @@ func contains(ids []primitive.ObjectID, id primitive.ObjectID) bool {
 	return false
 }
 
-var speedTestRunning = false
-var speedTestRetryCount = 0
+// runProbe runs a periodic probe once, when the concurrency limits allow,
+// and sends its result to dataChan. On demand runs, see RunNow, skip the
+// queue of scheduled runs.
+func runProbe(ctx context.Context, agentCheck probes.Probe, dC chan probes.ProbeData, onDemand bool) error {
+	prio := probePriority(agentCheck.Type)
+	if onDemand {
+		prio = priorityHigh
+	}
+	release, waited, err := probeLimiter.acquire(ctx, agentCheck.Type, prio)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if waited > time.Second {
+		log.Debugf("Probe %s (%s) waited %s for a slot", agentCheck.ID.Hex(), agentCheck.Type, waited.Round(time.Millisecond))
+	}
+
+	var result interface{}
+
+	switch agentCheck.Type {
+	case probes.ProbeType_SYSTEMINFO:
+		log.Info("SystemInfo: Running system hardware usage test")
+		markRunning(agentCheck.ID)
+		result, err = probes.SystemInfo()
+
+	case probes.ProbeType_MTR:
+		log.Info("MTR: Running test for ", agentCheck.Config.Target[0].Target, "...")
+		markRunning(agentCheck.ID)
+		result, err = probes.MtrContext(ctx, &agentCheck, false)
+
+	case probes.ProbeType_SPEEDTEST:
+		// the controller marks a speed test that already ran as "ok", run_now
+		// runs it again on demand
+		if agentCheck.Config.Target[0].Target == "ok" && !onDemand {
+			log.Info("SpeedTest: Target is ok, skipping...")
+			return nil
+		}
+		if t := agentCheck.Config.Target[0].Target; onDemand && (t == "ok" || t == "expired") {
+			// "ok" and "expired" aren't servers, test against the nearest one
+			agentCheck.Config.Target = append([]probes.ProbeTarget{{}}, agentCheck.Config.Target[1:]...)
+		}
+		log.Info("Running speed test for ... ", agentCheck.Config.Target[0].Target)
+		markRunning(agentCheck.ID)
+		result, err = probes.SpeedTestContext(ctx, &agentCheck)
+		if err != nil {
+			markDone(agentCheck.ID, err)
+			return err
+		}
+
+	case probes.ProbeType_SPEEDTEST_SERVERS:
+		// todo ship this off to the backend so we can display "speedtest" servers near the agent, and periodically refresh the options
+		markRunning(agentCheck.ID)
+		result, err = probes.NewSpeedTestClient().FetchServers()
 
-const speedTestRetryMax = 3
+	case probes.ProbeType_PING:
+		log.Infof("Ping: Running test for %v...", agentCheck.Config.Target[0].Target)
+
+		// todo find target that matches ping host for target field, and run mtr against it
+		probe, mtrErr := findMatchingMTRProbe(agentCheck)
+		if mtrErr != nil {
+			log.Error(mtrErr)
+		}
 
-func startCheckWorker(id primitive.ObjectID, dataChan chan probes.ProbeData, thisAgent primitive.ObjectID) {
+		// ping sends its own result once it finishes
+		markRunning(agentCheck.ID)
+		err = probes.PingContext(ctx, &agentCheck, dC, probe, probeLimiter.acquireTriggered)
+		markDone(agentCheck.ID, err)
+		return err
+
+	case probes.ProbeType_NETWORKINFO:
+		log.Info("NetInfo: Checking networking information...")
+		markRunning(agentCheck.ID)
+		result, err = probes.NetworkInfo()
+
+	// todo other checks like port scans etc.
+
+	default:
+		return fmt.Errorf("unknown type of check %q", agentCheck.Type)
+	}
+	markDone(agentCheck.ID, err)
+	if ctx.Err() != nil {
+		// cancelled, a partial result isn't worth sending
+		return ctx.Err()
+	}
+
+	cD := probes.NewProbeData(agentCheck.ID, agentCheck.Type, false, result)
+	cD.Queue = probeLimiter.stats(waited)
+	cD.Error = probes.NewProbeError(err)
+
+	select {
+	case dC <- cD:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// startTrafficSimWorker runs a TrafficSim server or client until the
+// probe's StopChan is closed. Unlike the other probes it is long running,
+// so it isn't driven by the scheduler.
+func startTrafficSimWorker(id primitive.ObjectID, dataChan chan probes.ProbeData, thisAgent primitive.ObjectID) {
+	ctx := workerCtx
+	runningProbes.Add(1)
 	go func(i primitive.ObjectID, dC chan probes.ProbeData) {
+		defer runningProbes.Done()
+
 		// Get the worker and increment its WaitGroup
 		var wg *sync.WaitGroup
 		var stopChan chan struct{}
@@ -296,267 +450,137 @@ func startCheckWorker(id primitive.ObjectID, dataChan chan probes.ProbeData, thi
 			probeWorker := agentCheckW.(ProbeWorkerS)
 
 			if probeWorker.ToRemove {
-				checkWorkers.Delete(i)
 				log.Warn("Check with ID " + i.Hex() + " was marked for removal.")
-				break
+				return
 			}
 
 			agentCheck := probeWorker.Probe
 
-			switch agentCheck.Type {
-			case probes.ProbeType_TRAFFICSIM:
-				// Check for stop signal
-				if stopChan != nil {
-					select {
-					case <-stopChan:
-						log.Infof("TrafficSim worker %s received stop signal", i.Hex())
-						return
-					default:
-					}
-				}
-
-				checkCfg := agentCheck.Config
-				checkAddress := strings.Split(checkCfg.Target[0].Target, ":")
-
-				portNum, err := strconv.Atoi(checkAddress[1])
-				if err != nil {
-					log.Error(err)
-					break
-				}
-
-				probe, err := findMatchingMTRProbe(agentCheck)
-				if err != nil {
-					log.Error(err)
-				}
-
-				if agentCheck.Config.Server {
-					var allowedAgentsList []primitive.ObjectID
-
-					for _, agent := range agentCheck.Config.Target[1:] {
-						allowedAgentsList = append(allowedAgentsList, agent.Agent)
-					}
+			// Check for stop signal
+			select {
+			case <-stopChan:
+				log.Infof("TrafficSim worker %s received stop signal", i.Hex())
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
 
-					trafficSimServerMutex.Lock()
-					if trafficSimServer == nil || !trafficSimServer.Running || trafficSimServer.Errored {
-						trafficSimServer = &probes.TrafficSim{
-							Running:       false,
-							Errored:       false,
-							IsServer:      true,
-							ThisAgent:     thisAgent,
-							OtherAgent:    primitive.ObjectID{},
-							IPAddress:     checkAddress[0],
-							Port:          int64(portNum),
-							AllowedAgents: allowedAgentsList,
-							Probe:         agentCheck.ID,
-						}
+			checkCfg := agentCheck.Config
+			checkAddress := strings.Split(checkCfg.Target[0].Target, ":")
 
-						log.Info("Running & starting traffic sim server...")
-						trafficSimServer.Running = true
-						trafficSimServerMutex.Unlock()
+			portNum, err := strconv.Atoi(checkAddress[1])
+			if err != nil {
+				log.Error(err)
+				return
+			}
 
-						// Start server in a separate goroutine so we can monitor stop signal
-						go trafficSimServer.Start(nil)
+			probe, err := findMatchingMTRProbe(agentCheck)
+			if err != nil {
+				log.Error(err)
+			}
 
-						// Monitor for stop signal
-						if stopChan != nil {
-							<-stopChan
-							log.Infof("Stopping TrafficSim server %s", i.Hex())
-							stopTrafficSim(agentCheck.ID, true)
-						}
-						return
-					} else {
-						// Update the allowed agents list dynamically
-						updateAllowedAgents(trafficSimServer, allowedAgentsList)
-						trafficSimServerMutex.Unlock()
+			if agentCheck.Config.Server {
+				var allowedAgentsList []primitive.ObjectID
 
-						// Continue monitoring for changes
-						time.Sleep(5 * time.Second)
-						continue
-					}
-				} else {
-					// Client logic
-					trafficSimClientsMutex.Lock()
-
-					// Check if this client already exists
-					if existingClient, exists := trafficSimClients[agentCheck.ID]; exists && existingClient.Running {
-						trafficSimClientsMutex.Unlock()
-						time.Sleep(5 * time.Second)
-						continue
-					}
+				for _, agent := range agentCheck.Config.Target[1:] {
+					allowedAgentsList = append(allowedAgentsList, agent.Agent)
+				}
 
-					simClient := &probes.TrafficSim{
-						Running:    false,
-						Errored:    false,
-						Conn:       nil,
-						ThisAgent:  thisAgent,
-						OtherAgent: agentCheck.Config.Target[0].Agent,
-						IPAddress:  checkAddress[0],
-						Port:       int64(portNum),
-						Probe:      agentCheck.ID,
-						DataChan:   dC,
+				trafficSimServerMutex.Lock()
+				if trafficSimServer == nil || !trafficSimServer.Running || trafficSimServer.Errored {
+					trafficSimServer = &probes.TrafficSim{
+						Running:       false,
+						Errored:       false,
+						IsServer:      true,
+						ThisAgent:     thisAgent,
+						OtherAgent:    primitive.ObjectID{},
+						IPAddress:     checkAddress[0],
+						Port:          int64(portNum),
+						AllowedAgents: allowedAgentsList,
+						Probe:         agentCheck.ID,
 					}
 
-					trafficSimClients[agentCheck.ID] = simClient
-					simClient.Running = true
-					trafficSimClientsMutex.Unlock()
-
-					log.Infof("Starting TrafficSim client for probe %s to %s:%d",
-						agentCheck.ID.Hex(), checkAddress[0], portNum)
+					log.Info("Running & starting traffic sim server...")
+					trafficSimServer.Running = true
+					markRunning(agentCheck.ID)
+					trafficSimServerMutex.Unlock()
 
-					// Start client in a separate goroutine so we can monitor stop signal
-					go simClient.Start(&probe)
+					// Start server in a separate goroutine so we can monitor stop signal
+					go trafficSimServer.StartContext(ctx, nil)
 
 					// Monitor for stop signal
 					if stopChan != nil {
-						<-stopChan
-						log.Infof("Stopping TrafficSim client %s", i.Hex())
-						stopTrafficSim(agentCheck.ID, false)
-						// Wait a moment to ensure cleanup completes
-						time.Sleep(200 * time.Millisecond)
+						select {
+						case <-stopChan:
+						case <-ctx.Done():
+						}
+						log.Infof("Stopping TrafficSim server %s", i.Hex())
+						stopTrafficSim(agentCheck.ID, true)
 					}
 					return
-				}
-
-			case probes.ProbeType_SYSTEMINFO:
-				log.Info("SystemInfo: Running system hardware usage test")
-				if agentCheck.Config.Interval <= 0 {
-					agentCheck.Config.Interval = 1
-				}
-
-				mtr, err := probes.SystemInfo()
-				if err != nil {
-					log.Error(err)
-				}
-
-				cD := probes.ProbeData{
-					ProbeID: agentCheck.ID,
-					Data:    mtr,
-				}
-
-				dC <- cD
-				time.Sleep(time.Duration(agentCheck.Config.Interval) * time.Minute)
-				continue
-
-			case probes.ProbeType_MTR:
-				log.Info("MTR: Running test for ", agentCheck.Config.Target[0].Target, "...")
-				mtr, err := probes.Mtr(&agentCheck, false)
-				if err != nil {
-					fmt.Println(err)
-				}
+				} else {
+					// Update the allowed agents list dynamically
+					updateAllowedAgents(trafficSimServer, allowedAgentsList)
+					trafficSimServerMutex.Unlock()
 
-				cD := probes.ProbeData{
-					ProbeID:   agentCheck.ID,
-					Triggered: false,
-					Data:      mtr,
-				}
-				dC <- cD
-				time.Sleep(time.Duration(agentCheck.Config.Interval) * time.Minute)
-				continue
-
-			case probes.ProbeType_SPEEDTEST:
-				// todo make this dynamic and on demand
-				if !speedTestRunning {
-					log.Info("Running speed test for ... ", agentCheck.Config.Target[0].Target)
-					if agentCheck.Config.Target[0].Target == "ok" {
-						log.Info("SpeedTest: Target is ok, skipping...")
-						time.Sleep(10 * time.Second)
-						continue
-					}
-					speedTestRunning = true
-					speedTestResult, err := probes.SpeedTest(&agentCheck)
-					if err != nil {
-						log.Error(err)
-						speedTestRunning = false
-						time.Sleep(30 * time.Second)
-						if speedTestRetryCount >= 3 {
-							agentCheck.Config.Target[0].Target = "ok"
-							log.Warn("SpeedTest: Failed to run test after 3 retries, setting target to 'ok'...")
-						}
-						speedTestRetryCount++
-						continue
+					// Continue monitoring for changes
+					if !sleepContext(ctx, 5*time.Second) {
+						return
 					}
+					continue
+				}
+			} else {
+				// Client logic
+				trafficSimClientsMutex.Lock()
 
-					speedTestRetryCount = 0
-					speedTestRunning = false
-
-					agentCheck.Config.Target[0].Target = "ok"
-
-					cD := probes.ProbeData{
-						ProbeID: agentCheck.ID,
-						Data:    speedTestResult,
+				// Check if this client already exists
+				if existingClient, exists := trafficSimClients[agentCheck.ID]; exists && existingClient.Running {
+					trafficSimClientsMutex.Unlock()
+					if !sleepContext(ctx, 5*time.Second) {
+						return
 					}
-
-					dC <- cD
+					continue
 				}
-				continue
-
-			case probes.ProbeType_SPEEDTEST_SERVERS:
-				// todo make this dynamic and on demand
-				var speedtestClient = speedtest.New()
-				serverList, _ := speedtestClient.FetchServers()
-				//targets, _ := serverList.FindServer([]int{})
-				// todo ship this off to the backend so we can display "speedtest" servers near the agent, and periodically refresh the options
-
-				cD := probes.ProbeData{
-					ProbeID: agentCheck.ID,
-					Data:    serverList,
-				}
-
-				dC <- cD
-				time.Sleep(time.Hour * 12)
-				break
 
-			case probes.ProbeType_PING:
-				log.Infof("Ping: Running test for %v...", agentCheck.Config.Target[0].Target)
-
-				// todo find target that matches ping host for target field, and run mtr against it
-				probe, err := findMatchingMTRProbe(agentCheck)
-				if err != nil {
-					log.Error(err)
+				simClient := &probes.TrafficSim{
+					Running:    false,
+					Errored:    false,
+					Conn:       nil,
+					ThisAgent:  thisAgent,
+					OtherAgent: agentCheck.Config.Target[0].Agent,
+					IPAddress:  checkAddress[0],
+					Port:       int64(portNum),
+					Probe:      agentCheck.ID,
+					DataChan:   dC,
+
+					AcquireTriggered: probeLimiter.acquireTriggered,
 				}
 
-				err = probes.Ping(&agentCheck, dC, probe)
-				if err != nil {
-					log.Error(err)
-					//break
-				}
+				trafficSimClients[agentCheck.ID] = simClient
+				simClient.Running = true
+				markRunning(agentCheck.ID)
+				trafficSimClientsMutex.Unlock()
 
-				//todo make this onyl run once, because when it uploads to the server, it will disable it,
-				//todo preventing it from being in the configuration after
-				//time.Sleep(time.Minute * 5)
-				//}
-				continue
-
-			case probes.ProbeType_NETWORKINFO:
-				log.Info("NetInfo: Checking networking information...")
-				net, err := probes.NetworkInfo()
-				if err != nil {
-					fmt.Println(err)
-				}
+				log.Infof("Starting TrafficSim client for probe %s to %s:%d",
+					agentCheck.ID.Hex(), checkAddress[0], portNum)
 
-				/*m, err := json.Marshal(net)
-				if err != nil {
-					fmt.Print(err)
-				}*/
+				// Start client in a separate goroutine so we can monitor stop signal
+				go simClient.StartContext(ctx, &probe)
 
-				cD := probes.ProbeData{
-					ProbeID: agentCheck.ID,
-					Data:    net,
+				// Monitor for stop signal
+				if stopChan != nil {
+					select {
+					case <-stopChan:
+					case <-ctx.Done():
+					}
+					log.Infof("Stopping TrafficSim client %s", i.Hex())
+					stopTrafficSim(agentCheck.ID, false)
+					// Wait a moment to ensure cleanup completes
+					time.Sleep(200 * time.Millisecond)
 				}
-
-				dC <- cD
-
-				// todo make configurable??
-				time.Sleep(time.Minute * 10)
-				continue
-
-			// todo other checks like port scans etc.
-
-			default:
-				fmt.Println("Unknown type of check...")
-				break
+				return
 			}
-			break
 		}
 	}(id, dataChan)
 }
@@ -570,3 +594,33 @@ func updateAllowedAgents(server *probes.TrafficSim, newAllowedAgents []primitive
 	server.AllowedAgents = newAllowedAgents
 	log.Infof("Updated allowed agents for TrafficSim server: %v", newAllowedAgents)
 }
+
+// sleepContext waits for d, or until ctx is done. It reports whether the
+// wait ran its course.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Wait blocks until every probe stopped after InitProbeWorker's context is
+// done, or until ctx is done.
+func Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		runningProbes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,19 +1,293 @@
 package workers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/netwatcherio/netwatcher-agent/probes"
 	"github.com/netwatcherio/netwatcher-agent/ws"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
-func InitProbeDataWorker(wsH *ws.WebSocketHandler, ch chan probes.ProbeData) {
-	go func(cn *ws.WebSocketHandler, c chan probes.ProbeData) {
-		for p := range ch {
-			marshal, err := json.Marshal(p)
+const (
+	deliveryTickInterval = 1 * time.Second
+	webSocketSinkBuffer  = 1024
+)
+
+var errNotConnected = errors.New("websocket is not connected")
+
+// InitProbeDataWorker fans every ProbeData out to all of the sinks. The
+// returned func stops it once the probes have: the results still on ch are
+// written, sinks that implement Drainer are drained until ctx is done, and
+// every sink is closed.
+func InitProbeDataWorker(ch chan probes.ProbeData, sinks []Sink) func(ctx context.Context) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func(c chan probes.ProbeData) {
+		defer close(done)
+		for {
+			select {
+			case p := <-c:
+				writeProbeData(p, sinks)
+			case <-stop:
+				for {
+					select {
+					case p := <-c:
+						writeProbeData(p, sinks)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}(ch)
+
+	return func(ctx context.Context) {
+		close(stop)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warnf("ProbeData: shutdown deadline passed while writing the last results")
+		}
+
+		for _, s := range sinks {
+			if d, ok := s.(Drainer); ok {
+				err := d.Drain(ctx)
+				if err != nil {
+					log.Warnf("ProbeData: sink %s not drained: %v", s.Name(), err)
+				}
+			}
+			err := s.Close()
 			if err != nil {
-				return
+				log.Errorf("ProbeData: unable to close sink %s: %v", s.Name(), err)
+			}
+		}
+	}
+}
+
+func writeProbeData(p probes.ProbeData, sinks []Sink) {
+	if p.Queue == nil && probeLimiter != nil {
+		// results sent by the probes themselves, like ping, carry
+		// the queue as it is now
+		p.Queue = probeLimiter.stats(0)
+	}
+	recordResult(p)
+	for _, s := range sinks {
+		err := s.Write(p)
+		if err != nil {
+			log.Errorf("ProbeData: sink %s failed for probe %s: %v", s.Name(), p.ProbeID.Hex(), err)
+		}
+	}
+}
+
+// WebSocketSink forwards probe data to the controller. Every item is kept
+// until the controller acknowledges it; anything that can't be delivered
+// is spooled to the outbox and replayed, in order, once the websocket
+// reconnects.
+type WebSocketSink struct {
+	wsH    *ws.WebSocketHandler
+	outbox *Outbox
+	queue  chan probes.ProbeData
+
+	drainCh   chan drainRequest
+	drainOnce sync.Once
+	drainErr  error
+
+	// once the delivery loop stops reading the queue, results are
+	// spooled straight to the outbox
+	stopping chan struct{}
+	stopMu   sync.RWMutex
+	stopped  bool
+}
+
+type drainRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// NewWebSocketSink starts the delivery loop for wsH.
+func NewWebSocketSink(wsH *ws.WebSocketHandler, outbox *Outbox, cfg DeliveryConfig) *WebSocketSink {
+	return newWebSocketSink(wsH, outbox, newDelivery(wsH, outbox, cfg))
+}
+
+// newWebSocketSink starts the delivery loop, taking the acks and
+// connections from wsH and sending through d.
+func newWebSocketSink(wsH *ws.WebSocketHandler, outbox *Outbox, d *delivery) *WebSocketSink {
+	s := &WebSocketSink{
+		wsH:    wsH,
+		outbox: outbox,
+		queue:  make(chan probes.ProbeData, webSocketSinkBuffer),
+
+		drainCh:  make(chan drainRequest),
+		stopping: make(chan struct{}),
+	}
+	go s.run(d)
+	return s
+}
+
+func (s *WebSocketSink) Name() string {
+	return "websocket"
+}
+
+func (s *WebSocketSink) Write(p probes.ProbeData) error {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+
+	if !s.stopped {
+		select {
+		case s.queue <- p:
+			return nil
+		case <-s.stopping:
+		}
+	}
+	return s.spool(p)
+}
+
+// spool keeps a result for the next start, once the sink was drained.
+func (s *WebSocketSink) spool(p probes.ProbeData) error {
+	marshal, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.outbox.Append(marshal)
+}
+
+// Drain delivers the queued results and waits for the controller to
+// acknowledge everything on the wire, until ctx is done. What is left is
+// spooled to the outbox. The sink stops delivering afterwards, results
+// written from then on are spooled.
+func (s *WebSocketSink) Drain(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		req := drainRequest{ctx: ctx, done: make(chan error)}
+		s.drainCh <- req
+		s.drainErr = <-req.done
+	})
+	return s.drainErr
+}
+
+// Close spools whatever hasn't been delivered, unless the sink was drained
+// already, and closes the outbox.
+func (s *WebSocketSink) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = s.Drain(ctx)
+	return s.outbox.Close()
+}
+
+func (s *WebSocketSink) run(d *delivery) {
+	tick := deliveryTickInterval
+	if d.cfg.BatchSize > 1 && d.cfg.BatchInterval < tick {
+		tick = d.cfg.BatchInterval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-s.queue:
+			s.write(d, p)
+
+		case id := <-s.wsH.ProbeAckCh:
+			d.ack(id)
+
+		case <-s.wsH.ConnectedCh:
+			replayOutbox(s.outbox, d)
+
+		case <-ticker.C:
+			d.flushDue()
+			d.retry()
+			replayOutbox(s.outbox, d)
+
+		case req := <-s.drainCh:
+			close(s.stopping)
+			err := s.drain(d, req.ctx)
+
+			// results queued while draining are spooled after it
+			s.stopMu.Lock()
+			s.stopped = true
+			s.stopMu.Unlock()
+			for len(s.queue) > 0 {
+				p := <-s.queue
+				if err := s.spool(p); err != nil {
+					log.Errorf("ProbeData: unable to spool data for probe %s: %v", p.ProbeID.Hex(), err)
+				}
 			}
-			wsH.GetConnection().Emit("probe_post", marshal)
+
+			req.done <- err
+			return
 		}
-	}(wsH, ch)
+	}
+}
+
+func (s *WebSocketSink) write(d *delivery, p probes.ProbeData) {
+	marshal, err := json.Marshal(p)
+	if err != nil {
+		log.Errorf("ProbeData: unable to marshal data for probe %s: %v", p.ProbeID.Hex(), err)
+		return
+	}
+
+	// keep ordering intact by never jumping ahead of spooled data
+	if s.outbox.Len() == 0 && d.send(marshal) == nil {
+		return
+	}
+
+	err = s.outbox.Append(marshal)
+	if err != nil {
+		log.Errorf("ProbeData: unable to spool data for probe %s: %v", p.ProbeID.Hex(), err)
+	}
+}
+
+// drain delivers everything while the websocket stays up and ctx allows,
+// then spools the rest.
+func (s *WebSocketSink) drain(d *delivery, ctx context.Context) error {
+	for len(s.queue) > 0 {
+		s.write(d, <-s.queue)
+	}
+
+	ticker := time.NewTicker(deliveryTickInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil && d.conn.IsConnected() && (d.pending() > 0 || s.outbox.Len() > 0) {
+		d.flush()
+		replayOutbox(s.outbox, d)
+		if d.pending() == 0 && s.outbox.Len() == 0 {
+			break
+		}
+
+		select {
+		case id := <-s.wsH.ProbeAckCh:
+			d.ack(id)
+		case <-ticker.C:
+			d.retry()
+		case <-ctx.Done():
+		}
+	}
+
+	d.spool()
+	if n := s.outbox.Len(); n > 0 {
+		log.Infof("Outbox: %d records spooled until the next start", n)
+	}
+	return ctx.Err()
+}
+
+func replayOutbox(outbox *Outbox, d *delivery) {
+	if outbox.Len() == 0 || !d.conn.IsConnected() || d.windowFull() {
+		return
+	}
+
+	sent, err := outbox.Replay(d.send)
+	if sent > 0 {
+		log.Infof("Outbox: replayed %d spooled records", sent)
+	}
+	if err != nil && err != errDeliveryWindowFull {
+		log.Warnf("Outbox: replay interrupted, %d records remaining: %v", outbox.Len(), err)
+	}
+}
+
+func emitProbeData(conn probeDataConn, b ...[]byte) error {
+	if !conn.EmitProbeData(b...) {
+		return errNotConnected
+	}
+	return nil
 }
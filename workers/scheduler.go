@@ -0,0 +1,359 @@
+package workers
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduleJitter is the fraction of a probe's interval its runs are moved
+// by at random, so agents started together don't probe in lockstep.
+var (
+	jitterMu       sync.RWMutex
+	scheduleJitter = 0.1
+)
+
+// SetScheduleJitter changes the fraction of a probe's interval its runs
+// are moved by, from the next run on.
+func SetScheduleJitter(f float64) {
+	jitterMu.Lock()
+	scheduleJitter = f
+	jitterMu.Unlock()
+}
+
+const (
+	// minRunGap stops back-to-back probes from spinning when a run returns
+	// straight away.
+	minRunGap = time.Second
+	// retryDelay is the wait before a failed run is retried.
+	retryDelay = 30 * time.Second
+	// oneShotRetryMax is how often a probe that only runs once is retried.
+	oneShotRetryMax = 3
+	// maxFirstRunDelay bounds how long a new probe waits for its first
+	// run, however long its interval.
+	maxFirstRunDelay = 30 * time.Second
+)
+
+// defaultIntervals apply to probes without an interval configured. PING
+// isn't listed, it runs back to back since each run lasts Duration seconds.
+var defaultIntervals = map[probes.ProbeType]time.Duration{
+	probes.ProbeType_SYSTEMINFO:        time.Minute,
+	probes.ProbeType_NETWORKINFO:       10 * time.Minute,
+	probes.ProbeType_MTR:               5 * time.Minute,
+	probes.ProbeType_SPEEDTEST_SERVERS: 12 * time.Hour,
+}
+
+// probeInterval returns the time between the starts of two runs of p, and
+// whether it runs repeatedly at all. A speed test without an interval only
+// runs once.
+func probeInterval(p probes.Probe) (time.Duration, bool) {
+	switch {
+	case p.Config.IntervalSeconds > 0:
+		return time.Duration(p.Config.IntervalSeconds) * time.Second, true
+	case p.Config.Interval > 0:
+		return time.Duration(p.Config.Interval) * time.Minute, true
+	case p.Type == probes.ProbeType_SPEEDTEST:
+		return 0, false
+	}
+	return defaultIntervals[p.Type], true
+}
+
+// jitter returns a random offset within ±scheduleJitter of d.
+func jitter(d time.Duration) time.Duration {
+	jitterMu.RLock()
+	span := time.Duration(float64(d) * scheduleJitter)
+	jitterMu.RUnlock()
+	if span <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(2*span))) - span
+}
+
+// firstRunDelay returns a random wait within the jitter window of interval,
+// at most maxFirstRunDelay, before a new probe's first run.
+func firstRunDelay(interval time.Duration) time.Duration {
+	jitterMu.RLock()
+	window := time.Duration(float64(interval) * scheduleJitter)
+	jitterMu.RUnlock()
+	if window > maxFirstRunDelay {
+		window = maxFirstRunDelay
+	}
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+type scheduleEntry struct {
+	id        primitive.ObjectID
+	next      time.Time
+	lastStart time.Time
+	running   bool
+	retries   int
+	cancel    context.CancelFunc
+	index     int // position in the queue, -1 while running
+}
+
+// scheduleQueue is a min-heap of entries ordered by their next run.
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// scheduler starts the periodic probes from a single timer. Runs of the
+// same probe never overlap; the next run is planned from the start of the
+// last one so slow runs don't push the schedule back.
+type scheduler struct {
+	dataChan chan probes.ProbeData
+
+	mu      sync.Mutex
+	queue   scheduleQueue
+	entries map[primitive.ObjectID]*scheduleEntry
+	wake    chan struct{}
+}
+
+func newScheduler(dataChan chan probes.ProbeData) *scheduler {
+	return &scheduler{
+		dataChan: dataChan,
+		entries:  make(map[primitive.ObjectID]*scheduleEntry),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// add schedules a new probe. Its first run is spread over the jitter
+// window, up to maxFirstRunDelay, so a restart doesn't fire every probe at
+// once without holding back probes with long intervals.
+func (s *scheduler) add(p probes.Probe) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[p.ID]; ok {
+		return
+	}
+
+	interval, _ := probeInterval(p)
+	e := &scheduleEntry{id: p.ID, next: time.Now().Add(firstRunDelay(interval))}
+	s.entries[p.ID] = e
+	heap.Push(&s.queue, e)
+	markNextRun(p.ID, e.next)
+	s.notify()
+}
+
+// update replans a waiting probe after its config changed. One-shot
+// probes that finished, or gave up, are scheduled again.
+func (s *scheduler) update(p probes.Probe) {
+	s.mu.Lock()
+	e, ok := s.entries[p.ID]
+	if !ok {
+		s.mu.Unlock()
+		if _, exists := GetProbe(p.ID); exists {
+			s.add(p)
+		}
+		return
+	}
+	defer s.mu.Unlock()
+
+	if e.running || e.lastStart.IsZero() {
+		return
+	}
+
+	interval, repeat := probeInterval(p)
+	if !repeat {
+		return
+	}
+	next := e.lastStart.Add(interval)
+	if next.Equal(e.next) {
+		return
+	}
+	if now := time.Now(); next.Before(now) {
+		next = now
+	}
+	e.next = next
+	heap.Fix(&s.queue, e.index)
+	markNextRun(p.ID, e.next)
+	s.notify()
+}
+
+// remove unschedules a probe, cancelling it if it's running.
+func (s *scheduler) remove(id primitive.ObjectID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return
+	}
+	delete(s.entries, id)
+	if e.running {
+		e.cancel()
+	} else if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+	s.notify()
+}
+
+// cancel aborts the current run of a probe without unscheduling it. It
+// reports whether the probe was running.
+func (s *scheduler) cancel(id primitive.ObjectID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || !e.running {
+		return false
+	}
+	e.cancel()
+	return true
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts due probes until ctx is done.
+func (s *scheduler) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+			e := heap.Pop(&s.queue).(*scheduleEntry)
+			s.start(ctx, e)
+		}
+		wait := time.Hour
+		if len(s.queue) > 0 {
+			wait = s.queue[0].next.Sub(now)
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// start runs e in its own goroutine; s.mu must be held.
+func (s *scheduler) start(ctx context.Context, e *scheduleEntry) {
+	p, ok := GetProbe(e.id)
+	if !ok {
+		delete(s.entries, e.id)
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	e.running = true
+	e.cancel = cancel
+	e.lastStart = time.Now()
+
+	runningProbes.Add(1)
+	go func() {
+		defer runningProbes.Done()
+		err := runProbe(runCtx, p, s.dataChan, false)
+		cancel()
+		if ctx.Err() != nil {
+			// shutting down
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			// cancelled on request, the next run is planned as usual
+			log.Infof("Probe %s (%s) was cancelled", p.ID.Hex(), p.Type)
+			err = nil
+		} else if err != nil {
+			log.Errorf("Probe %s (%s): %v", p.ID.Hex(), p.Type, err)
+		}
+		s.finished(e, err)
+	}()
+}
+
+// finished plans the next run of e.
+func (s *scheduler) finished(e *scheduleEntry, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.running = false
+	if s.entries[e.id] != e {
+		// removed while running
+		return
+	}
+
+	// the probe may have been updated while it ran
+	p, ok := GetProbe(e.id)
+	if !ok {
+		delete(s.entries, e.id)
+		return
+	}
+
+	now := time.Now()
+	interval, repeat := probeInterval(p)
+	switch {
+	case err != nil && !repeat:
+		if e.retries >= oneShotRetryMax {
+			log.Warnf("Probe %s failed %d times, giving up until it is updated", p.ID.Hex(), e.retries+1)
+			delete(s.entries, e.id)
+			markNextRun(e.id, time.Time{})
+			return
+		}
+		e.retries++
+		e.next = now.Add(retryDelay)
+	case !repeat:
+		delete(s.entries, e.id)
+		markNextRun(e.id, time.Time{})
+		return
+	default:
+		e.retries = 0
+		e.next = e.lastStart.Add(interval + jitter(interval))
+		if err != nil && interval < retryDelay {
+			// don't hammer a target that keeps failing straight away
+			e.next = now.Add(retryDelay)
+		}
+		if min := now.Add(minRunGap); e.next.Before(min) {
+			e.next = min
+		}
+	}
+
+	heap.Push(&s.queue, e)
+	markNextRun(e.id, e.next)
+	s.notify()
+}
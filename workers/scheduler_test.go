@@ -0,0 +1,218 @@
+package workers
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+// storeProbe makes p known to the scheduler, as the probe worker does.
+func storeProbe(t *testing.T, p probes.Probe) {
+	checkWorkers.Store(p.ID, ProbeWorkerS{Probe: p})
+	t.Cleanup(func() {
+		checkWorkers.Delete(p.ID)
+		forgetProbeState(p.ID)
+	})
+}
+
+func noJitter(t *testing.T) {
+	SetScheduleJitter(0)
+	t.Cleanup(func() { SetScheduleJitter(0.1) })
+}
+
+func TestProbeInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      probes.Probe
+		want   time.Duration
+		repeat bool
+	}{
+		{"seconds", probes.Probe{Type: probes.ProbeType_PING, Config: probes.ProbeConfig{IntervalSeconds: 30, Interval: 5}}, 30 * time.Second, true},
+		{"minutes", probes.Probe{Type: probes.ProbeType_MTR, Config: probes.ProbeConfig{Interval: 5}}, 5 * time.Minute, true},
+		{"default", probes.Probe{Type: probes.ProbeType_NETWORKINFO}, 10 * time.Minute, true},
+		{"back to back", probes.Probe{Type: probes.ProbeType_PING}, 0, true},
+		{"one-shot speed test", probes.Probe{Type: probes.ProbeType_SPEEDTEST}, 0, false},
+	}
+	for _, tt := range tests {
+		got, repeat := probeInterval(tt.p)
+		if got != tt.want || repeat != tt.repeat {
+			t.Errorf("%s: probeInterval() = %s, %v, want %s, %v", tt.name, got, repeat, tt.want, tt.repeat)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if j := jitter(time.Minute); j < -6*time.Second || j >= 6*time.Second {
+			t.Fatalf("jitter(1m) = %s, want within 10%%", j)
+		}
+	}
+	noJitter(t)
+	if j := jitter(time.Minute); j != 0 {
+		t.Errorf("jitter(1m) = %s with jitter turned off", j)
+	}
+}
+
+func TestFirstRunDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := firstRunDelay(time.Minute); d < 0 || d >= 6*time.Second {
+			t.Fatalf("firstRunDelay(1m) = %s, want within 10%%", d)
+		}
+		// 10% of 12h would be 1.2h
+		if d := firstRunDelay(12 * time.Hour); d < 0 || d >= maxFirstRunDelay {
+			t.Fatalf("firstRunDelay(12h) = %s, want under %s", d, maxFirstRunDelay)
+		}
+	}
+	if d := firstRunDelay(0); d != 0 {
+		t.Errorf("firstRunDelay(0) = %s", d)
+	}
+	noJitter(t)
+	if d := firstRunDelay(12 * time.Hour); d != 0 {
+		t.Errorf("firstRunDelay(12h) = %s with jitter turned off", d)
+	}
+}
+
+func TestSchedulerAddRemove(t *testing.T) {
+	s := newScheduler(nil)
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR, Config: probes.ProbeConfig{Interval: 5}}
+	storeProbe(t, p)
+
+	s.add(p)
+	s.add(p)
+	if len(s.queue) != 1 || len(s.entries) != 1 {
+		t.Fatalf("adding a probe twice queued %d entries", len(s.queue))
+	}
+	if wait := time.Until(s.queue[0].next); wait < 0 || wait > maxFirstRunDelay {
+		t.Errorf("first run in %s, want within the jitter window", wait)
+	}
+
+	// long intervals don't hold back the first run
+	long := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SPEEDTEST_SERVERS}
+	storeProbe(t, long)
+	s.add(long)
+	if wait := time.Until(s.entries[long.ID].next); wait < 0 || wait > maxFirstRunDelay {
+		t.Errorf("first run of a 12h probe in %s, want within %s", wait, maxFirstRunDelay)
+	}
+	s.remove(long.ID)
+
+	s.remove(p.ID)
+	if len(s.queue) != 0 || len(s.entries) != 0 {
+		t.Errorf("%d entries queued after removing the probe", len(s.queue))
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	noJitter(t)
+	s := newScheduler(nil)
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR, Config: probes.ProbeConfig{Interval: 5}}
+	storeProbe(t, p)
+	s.add(p)
+
+	// replanned from the start of the last run
+	e := s.entries[p.ID]
+	e.lastStart = time.Now().Add(-time.Minute)
+	p.Config.Interval = 2
+	s.update(p)
+	if want := e.lastStart.Add(2 * time.Minute); !e.next.Equal(want) {
+		t.Errorf("next run at %s after the update, want %s", e.next, want)
+	}
+
+	// an interval that has already passed runs now
+	p.Config.Interval = 0
+	p.Config.IntervalSeconds = 10
+	s.update(p)
+	if d := time.Until(e.next); d > 0 {
+		t.Errorf("next run in %s, want straight away", d)
+	}
+}
+
+func TestSchedulerUpdateReschedules(t *testing.T) {
+	s := newScheduler(nil)
+
+	// a one-shot probe that gave up is scheduled again once updated
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SPEEDTEST}
+	storeProbe(t, p)
+	s.update(p)
+	if _, ok := s.entries[p.ID]; !ok {
+		t.Error("updated probe that wasn't scheduled wasn't added")
+	}
+
+	// a probe that was removed in the meantime isn't
+	gone := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SPEEDTEST}
+	s.update(gone)
+	if _, ok := s.entries[gone.ID]; ok {
+		t.Error("updating a removed probe scheduled it")
+	}
+}
+
+// finish runs the bookkeeping of a run of e that started at start and
+// ended with err.
+func finish(s *scheduler, e *scheduleEntry, start time.Time, err error) {
+	s.mu.Lock()
+	if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+	e.running = true
+	e.lastStart = start
+	s.mu.Unlock()
+	s.finished(e, err)
+}
+
+func TestSchedulerFinished(t *testing.T) {
+	noJitter(t)
+	s := newScheduler(nil)
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_MTR, Config: probes.ProbeConfig{Interval: 5}}
+	storeProbe(t, p)
+	s.add(p)
+	e := s.entries[p.ID]
+
+	start := time.Now().Add(-time.Minute)
+	finish(s, e, start, nil)
+	if want := start.Add(5 * time.Minute); !e.next.Equal(want) || e.index < 0 {
+		t.Errorf("next run at %s, want %s", e.next, want)
+	}
+
+	// a probe failing straight away backs off
+	p.Config.Interval = 0
+	p.Config.IntervalSeconds = 1
+	storeProbe(t, p)
+	finish(s, e, time.Now(), errors.New("unreachable"))
+	if d := time.Until(e.next); d < retryDelay-time.Second {
+		t.Errorf("failing probe runs again in %s, want %s", d, retryDelay)
+	}
+
+	// removed while running
+	checkWorkers.Delete(p.ID)
+	finish(s, e, time.Now(), nil)
+	if _, ok := s.entries[p.ID]; ok {
+		t.Error("removed probe is still scheduled")
+	}
+}
+
+func TestSchedulerOneShot(t *testing.T) {
+	s := newScheduler(nil)
+	p := probes.Probe{ID: primitive.NewObjectID(), Type: probes.ProbeType_SPEEDTEST}
+	storeProbe(t, p)
+	s.add(p)
+	e := s.entries[p.ID]
+
+	for i := 0; i < oneShotRetryMax; i++ {
+		finish(s, e, time.Now(), errors.New("no server"))
+		if s.entries[p.ID] != e || e.retries != i+1 {
+			t.Fatalf("failed one-shot probe wasn't retried, attempt %d", i+1)
+		}
+	}
+	finish(s, e, time.Now(), errors.New("no server"))
+	if _, ok := s.entries[p.ID]; ok {
+		t.Errorf("one-shot probe still scheduled after %d failures", oneShotRetryMax+1)
+	}
+
+	s.add(p)
+	finish(s, s.entries[p.ID], time.Now(), nil)
+	if _, ok := s.entries[p.ID]; ok {
+		t.Error("one-shot probe still scheduled after it ran")
+	}
+}
@@ -0,0 +1,265 @@
+package workers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSinkFileMaxBytes   = 100 * 1024 * 1024
+	defaultSinkFileMaxAge     = 24 * time.Hour
+	defaultSinkFileMaxBackups = 5
+	sinkFileTimeFormat        = "20060102T150405.000000000"
+)
+
+// Sink is a destination for probe data. Write is called from the data
+// worker for every ProbeData and should not block for long.
+type Sink interface {
+	Name() string
+	Write(p probes.ProbeData) error
+	Close() error
+}
+
+// Drainer is implemented by sinks that hold on to data until it has been
+// delivered. Drain is called on shutdown, before Close.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// WriterSink writes every ProbeData as a line of JSON to an io.Writer.
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+	enc  *json.Encoder
+}
+
+// NewWriterSink returns a sink writing JSON lines to w, eg. os.Stdout.
+func NewWriterSink(name string, w io.Writer) *WriterSink {
+	return &WriterSink{name: name, w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *WriterSink) Name() string {
+	return s.name
+}
+
+func (s *WriterSink) Write(p probes.ProbeData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(p)
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSinkConfig controls when a FileSink starts a new file.
+type FileSinkConfig struct {
+	Path       string
+	MaxBytes   int64         // rotate once the file grows past this size
+	MaxAge     time.Duration // rotate once the file is older than this
+	MaxBackups int           // rotated files to keep, the oldest are removed
+}
+
+// FileSink writes newline delimited JSON to a file, rotating it by size
+// and age. Rotated files are renamed to <path>.<timestamp>.
+type FileSink struct {
+	cfg    FileSinkConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewFileSink opens (appending to) the file at cfg.Path.
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSinkFileMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultSinkFileMaxAge
+	}
+	if cfg.MaxBackups <= 0 {
+		cfg.MaxBackups = defaultSinkFileMaxBackups
+	}
+
+	s := &FileSink{cfg: cfg}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	err := os.MkdirAll(filepath.Dir(s.cfg.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	s.opened = time.Now()
+	if s.size > 0 {
+		// appending to the file of an earlier run, it was started when its
+		// first record was written
+		s.opened = firstRecordTime(s.cfg.Path, info.ModTime())
+	}
+	return nil
+}
+
+// firstRecordTime returns when the first ProbeData in the file at path was
+// created, or def if it can't be read.
+func firstRecordTime(path string, def time.Time) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return def
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return def
+	}
+	var head struct {
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	if json.Unmarshal(line, &head) != nil || head.CreatedAt.IsZero() {
+		return def
+	}
+	return head.CreatedAt
+}
+
+func (s *FileSink) Name() string {
+	return "file:" + s.cfg.Path
+}
+
+func (s *FileSink) Write(p probes.ProbeData) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > 0 && (s.size+int64(len(b)) > s.cfg.MaxBytes || time.Since(s.opened) > s.cfg.MaxAge) {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	s.file.Close()
+
+	stamp := time.Now().Format(sinkFileTimeFormat)
+	rotated := fmt.Sprintf("%s.%s", s.cfg.Path, stamp)
+	for i := 1; ; i++ {
+		// never overwrite a backup, even with a coarse clock
+		if _, err := os.Stat(rotated); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", s.cfg.Path, stamp, i)
+	}
+	err := os.Rename(s.cfg.Path, rotated)
+	if err != nil {
+		log.Errorf("FileSink: unable to rotate %s: %v", s.cfg.Path, err)
+	}
+
+	backups := s.backups()
+	for len(backups) > s.cfg.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+
+	return s.open()
+}
+
+// backups returns the files rotate renamed the sink's file to, oldest
+// first. Other files sharing the prefix, like <path>.bak, are left alone.
+func (s *FileSink) backups() []string {
+	type backup struct {
+		path  string
+		stamp string
+		n     int // the suffix after the time, when it was taken
+	}
+
+	matches, _ := filepath.Glob(s.cfg.Path + ".*")
+	var backups []backup
+	for _, m := range matches {
+		b := backup{path: m}
+		stamp, n, found := strings.Cut(strings.TrimPrefix(m, s.cfg.Path+"."), "-")
+		if _, err := time.Parse(sinkFileTimeFormat, stamp); err != nil {
+			continue
+		}
+		if found {
+			i, err := strconv.Atoi(n)
+			if err != nil || i < 1 {
+				continue
+			}
+			b.n = i
+		}
+		b.stamp = stamp
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].stamp != backups[j].stamp {
+			return backups[i].stamp < backups[j].stamp
+		}
+		return backups[i].n < backups[j].n
+	})
+
+	paths := make([]string, len(backups))
+	for i, b := range backups {
+		paths[i] = b.path
+	}
+	return paths
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// ParseSinkNames splits a comma separated SINKS setting.
+func ParseSinkNames(v string) []string {
+	var names []string
+	for _, n := range strings.Split(v, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
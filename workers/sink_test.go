@@ -0,0 +1,173 @@
+package workers
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readSinkFile returns the Schema of every record in a file written by a
+// FileSink, the tests number records with it.
+func readSinkFile(t *testing.T, path string) []int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var p probes.ProbeData
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		got = append(got, p.Schema)
+	}
+	return got
+}
+
+func TestFileSinkRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "probes.jsonl")
+	// files next to the sink's that it didn't rotate
+	others := []string{path + ".bak", path + ".20240101", path + ".20240101T000000.000000000-x", filepath.Join(filepath.Dir(path), "probes.jsonl-old")}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	for _, o := range others {
+		if err := os.WriteFile(o, []byte("keep\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every record after the first goes to a new file
+	s, err := NewFileSink(FileSinkConfig{Path: path, MaxBytes: 1, MaxBackups: 3})
+	if err != nil {
+		t.Fatalf("NewFileSink() = %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 6; i++ {
+		if err := s.Write(probes.ProbeData{Schema: i}); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+	}
+
+	if got := readSinkFile(t, path); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("current file holds %v, want the last record", got)
+	}
+	backups := s.backups()
+	if len(backups) != 3 {
+		t.Fatalf("kept backups %q, want 3", backups)
+	}
+	for i, b := range backups {
+		if got := readSinkFile(t, b); !reflect.DeepEqual(got, []int{i + 2}) {
+			t.Errorf("backup %s holds %v, want record %d", b, got, i+2)
+		}
+	}
+	for _, o := range others {
+		if _, err := os.Stat(o); err != nil {
+			t.Errorf("pruning removed %s: %v", o, err)
+		}
+	}
+}
+
+func TestFileSinkRotateUnique(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.jsonl")
+	s, err := NewFileSink(FileSinkConfig{Path: path, MaxBytes: 1, MaxBackups: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := s.Write(probes.ProbeData{Schema: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no rotation overwrote another, however fast they came
+	backups := s.backups()
+	if len(backups) != n-1 {
+		t.Fatalf("%d backups after %d rotations", len(backups), n-1)
+	}
+	for i, b := range backups {
+		if got := readSinkFile(t, b); !reflect.DeepEqual(got, []int{i}) {
+			t.Errorf("backup %s holds %v, want record %d", b, got, i)
+		}
+	}
+}
+
+func TestFileSinkBackupOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.jsonl")
+	stamp := "20240101T000000.000000000"
+	want := []string{
+		path + ".20231231T235959.999999999",
+		path + "." + stamp,
+		path + "." + stamp + "-1",
+		path + "." + stamp + "-2",
+		path + "." + stamp + "-10",
+	}
+	for _, b := range want {
+		os.WriteFile(b, nil, 0644)
+	}
+	os.WriteFile(path+"."+stamp+"-0", nil, 0644)
+
+	s := &FileSink{cfg: FileSinkConfig{Path: path}}
+	if got := s.backups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("backups() = %q, want %q", got, want)
+	}
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probes.jsonl")
+	started := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	b, _ := json.Marshal(probes.ProbeData{Schema: 0, CreatedAt: started})
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the earlier run's file is as old as its first record, not the file
+	s, err := NewFileSink(FileSinkConfig{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.opened.Equal(started) {
+		t.Errorf("opened at %s, want %s", s.opened, started)
+	}
+	if err := s.Write(probes.ProbeData{Schema: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSinkFile(t, path); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("current file holds %v, want it rotated by age", got)
+	}
+
+	// without a readable record it falls back to the modification time
+	other := filepath.Join(t.TempDir(), "probes.jsonl")
+	os.WriteFile(other, []byte("not json\n"), 0644)
+	modTime := time.Now().Add(-time.Minute)
+	if got := firstRecordTime(other, modTime); !got.Equal(modTime) {
+		t.Errorf("firstRecordTime() = %s, want the modification time", got)
+	}
+	if got := firstRecordTime(filepath.Join(t.TempDir(), "missing"), modTime); !got.Equal(modTime) {
+		t.Errorf("firstRecordTime() = %s for a missing file", got)
+	}
+}
+
+func TestParseSinkNames(t *testing.T) {
+	tests := map[string][]string{
+		"":                         nil,
+		" , ,":                     nil,
+		"websocket":                {"websocket"},
+		"WebSocket, stdout ,,file": {"websocket", "stdout", "file"},
+	}
+	for v, want := range tests {
+		if got := ParseSinkNames(v); !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseSinkNames(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
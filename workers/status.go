@@ -0,0 +1,194 @@
+package workers
+
+import (
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/sync/syncmap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusResultsLimit is how many of the latest results are kept per probe
+// for the status API.
+var statusResultsLimit atomic.Int64
+
+func init() {
+	statusResultsLimit.Store(10)
+}
+
+// SetStatusResultsLimit changes how many results are kept per probe for
+// the status API.
+func SetStatusResultsLimit(n int) {
+	statusResultsLimit.Store(int64(n))
+}
+
+// ProbeStatus describes what a probe worker has been doing.
+type ProbeStatus struct {
+	Probe     probes.Probe       `json:"probe"`
+	Running   bool               `json:"running"`
+	LastRun   *time.Time         `json:"last_run,omitempty"`
+	LastError string             `json:"last_error,omitempty"`
+	ErrorAt   *time.Time         `json:"error_at,omitempty"`
+	NextRun   *time.Time         `json:"next_run,omitempty"`
+	Results   []probes.ProbeData `json:"results"`
+}
+
+// TrafficSimStatus lists the TrafficSim instances running on this agent.
+type TrafficSimStatus struct {
+	Server  *TrafficSimInstance  `json:"server,omitempty"`
+	Clients []TrafficSimInstance `json:"clients"`
+}
+
+type TrafficSimInstance struct {
+	Probe         primitive.ObjectID   `json:"probe"`
+	Address       string               `json:"address"`
+	Port          int64                `json:"port"`
+	Running       bool                 `json:"running"`
+	Errored       bool                 `json:"errored"`
+	OtherAgent    primitive.ObjectID   `json:"other_agent,omitempty"`
+	AllowedAgents []primitive.ObjectID `json:"allowed_agents,omitempty"`
+	LastResponse  *time.Time           `json:"last_response,omitempty"`
+}
+
+type probeState struct {
+	mu        sync.Mutex
+	running   bool
+	lastRun   time.Time
+	lastError string
+	errorAt   time.Time
+	nextRun   time.Time
+	results   []probes.ProbeData
+}
+
+var probeStates syncmap.Map
+
+func stateOf(id primitive.ObjectID) *probeState {
+	v, _ := probeStates.LoadOrStore(id, &probeState{})
+	return v.(*probeState)
+}
+
+func markRunning(id primitive.ObjectID) {
+	s := stateOf(id)
+	s.mu.Lock()
+	s.running = true
+	s.lastRun = time.Now()
+	s.mu.Unlock()
+}
+
+func markDone(id primitive.ObjectID, err error) {
+	s := stateOf(id)
+	s.mu.Lock()
+	s.running = false
+	if err != nil {
+		s.lastError = err.Error()
+		s.errorAt = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+func markNextRun(id primitive.ObjectID, at time.Time) {
+	s := stateOf(id)
+	s.mu.Lock()
+	s.nextRun = at
+	s.mu.Unlock()
+}
+
+func recordResult(p probes.ProbeData) {
+	s := stateOf(p.ProbeID)
+	s.mu.Lock()
+	s.results = append(s.results, p)
+	if over := len(s.results) - int(statusResultsLimit.Load()); over > 0 {
+		s.results = s.results[over:]
+	}
+	s.mu.Unlock()
+}
+
+func forgetProbeState(id primitive.ObjectID) {
+	probeStates.Delete(id)
+}
+
+// ProbeStatuses returns the state of every probe worker, ordered by ID.
+func ProbeStatuses() []ProbeStatus {
+	var out []ProbeStatus
+
+	checkWorkers.Range(func(key, value interface{}) bool {
+		pw, ok := value.(ProbeWorkerS)
+		if !ok || pw.ToRemove {
+			return true
+		}
+
+		st := ProbeStatus{Probe: pw.Probe}
+		if v, ok := probeStates.Load(pw.Probe.ID); ok {
+			s := v.(*probeState)
+			s.mu.Lock()
+			st.Running = s.running
+			st.LastRun = timeOrNil(s.lastRun)
+			st.LastError = s.lastError
+			st.ErrorAt = timeOrNil(s.errorAt)
+			st.NextRun = timeOrNil(s.nextRun)
+			st.Results = append([]probes.ProbeData(nil), s.results...)
+			s.mu.Unlock()
+		}
+		out = append(out, st)
+		return true
+	})
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Probe.ID.Hex() < out[j].Probe.ID.Hex()
+	})
+	return out
+}
+
+// TrafficSimStatuses returns the TrafficSim server and clients currently tracked.
+func TrafficSimStatuses() TrafficSimStatus {
+	var st TrafficSimStatus
+
+	trafficSimServerMutex.Lock()
+	if trafficSimServer != nil {
+		inst := trafficSimInstance(trafficSimServer)
+		st.Server = &inst
+	}
+	trafficSimServerMutex.Unlock()
+
+	trafficSimClientsMutex.Lock()
+	for _, c := range trafficSimClients {
+		st.Clients = append(st.Clients, trafficSimInstance(c))
+	}
+	trafficSimClientsMutex.Unlock()
+
+	sort.Slice(st.Clients, func(i, j int) bool {
+		return st.Clients[i].Probe.Hex() < st.Clients[j].Probe.Hex()
+	})
+	return st
+}
+
+// trafficSimInstance copies what the status API shows of ts, under its lock
+// as the TrafficSim updates it while running.
+func trafficSimInstance(ts *probes.TrafficSim) TrafficSimInstance {
+	ts.Mutex.Lock()
+	defer ts.Mutex.Unlock()
+
+	inst := TrafficSimInstance{
+		Probe:        ts.Probe,
+		Address:      ts.IPAddress,
+		Port:         ts.Port,
+		Running:      ts.Running,
+		Errored:      ts.Errored,
+		OtherAgent:   ts.OtherAgent,
+		LastResponse: timeOrNil(ts.LastResponse),
+	}
+	if len(ts.AllowedAgents) > 0 {
+		inst.AllowedAgents = append([]primitive.ObjectID(nil), ts.AllowedAgents...)
+	}
+	return inst
+}
+
+// timeOrNil leaves times that were never set out of the JSON.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,266 @@
+package ws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gobwas/ws"
+	"github.com/kataras/neffos"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// tokenRefreshBefore is how long before it expires a token is replaced,
+	// so a reconnect never has to wait for a login. Short lived tokens are
+	// replaced once 4/5 of their lifetime has passed instead.
+	tokenRefreshBefore = 5 * time.Minute
+	// tokenRetryInterval is how often a failed refresh is retried while the
+	// current token is still valid
+	tokenRetryInterval = time.Minute
+	// badLoginDelay is how long to wait before logging in again after the
+	// controller rejected the ID or PIN
+	badLoginDelay = 10 * time.Minute
+)
+
+var (
+	// ErrBadLogin is returned when the controller rejects the agent's credentials.
+	ErrBadLogin = errors.New("the controller rejected the agent ID, PIN or secret")
+	// ErrUnreachable is returned when the controller can't be reached or
+	// fails to answer a login.
+	ErrUnreachable = errors.New("the controller is unreachable")
+)
+
+// getBearerToken returns the cached token, logging in only when there is
+// none or it is due to be refreshed. A token that is due but not expired is
+// still used while the controller can't be reached.
+func (wsH *WebSocketHandler) getBearerToken() (string, error) {
+	wsH.tokenMu.Lock()
+	token, refreshAt, expires := wsH.token, wsH.tokenRefreshAt, wsH.tokenExpires
+	wsH.tokenMu.Unlock()
+
+	if token != "" && (expires.IsZero() || time.Now().Before(refreshAt)) {
+		return token, nil
+	}
+	newToken, err := wsH.login()
+	if errors.Is(err, ErrUnreachable) && token != "" && time.Now().Before(expires) {
+		return token, nil
+	}
+	return newToken, err
+}
+
+// login fetches a new token from the controller and caches it. Once the
+// agent has enrolled it logs in with its secret, falling back to the PIN
+// only if the secret is refused and a PIN is configured again.
+func (wsH *WebSocketHandler) login() (string, error) {
+	wsH.loginMu.Lock()
+	defer wsH.loginMu.Unlock()
+
+	id := wsH.loadIdentity()
+	if id != nil {
+		resp, err := wsH.requestToken(agentLogin{Secret: id.Secret, ID: wsH.ID, AgentVersion: wsH.AgentVersion})
+		if err == nil {
+			wsH.setToken(resp.Token)
+			return resp.Token, nil
+		}
+		if !errors.Is(err, ErrBadLogin) || wsH.Pin == "" {
+			return "", err
+		}
+		log.Warnf("The controller refused the enrolled credential, enrolling again with the PIN: %v", err)
+	}
+
+	resp, err := wsH.requestToken(agentLogin{PIN: wsH.Pin, ID: wsH.ID, AgentVersion: wsH.AgentVersion})
+	if err != nil {
+		return "", err
+	}
+	wsH.setToken(resp.Token)
+	if resp.Secret != "" {
+		wsH.enroll(resp)
+	} else if id != nil {
+		// the controller no longer knows the secret and didn't issue a new one
+		wsH.identity = nil
+		os.Remove(wsH.IdentityPath)
+	}
+	return resp.Token, nil
+}
+
+// requestToken posts a login to the controller, telling a refused login
+// apart from one that didn't get through.
+func (wsH *WebSocketHandler) requestToken(req agentLogin) (agentLoginResp, error) {
+	loginC := NewClient(wsH.RestClientConfig)
+
+	var agentLoginR = agentLoginResp{}
+	err := loginC.Request("POST", "/agent/login", &req, &agentLoginR)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 &&
+			apiErr.StatusCode != http.StatusRequestTimeout && apiErr.StatusCode != http.StatusTooManyRequests {
+			wsH.clearToken()
+			return agentLoginR, fmt.Errorf("%w: %d %s", ErrBadLogin, apiErr.StatusCode, strings.TrimSpace(apiErr.Body))
+		}
+		return agentLoginR, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	if agentLoginR.Token == "" {
+		return agentLoginR, fmt.Errorf("%w: the login response has no token", ErrUnreachable)
+	}
+	return agentLoginR, nil
+}
+
+// loadIdentity returns the saved identity of this agent, if it enrolled.
+func (wsH *WebSocketHandler) loadIdentity() *Identity {
+	if wsH.identity != nil || wsH.IdentityPath == "" {
+		return wsH.identity
+	}
+
+	id, err := LoadIdentity(wsH.IdentityPath)
+	if err != nil {
+		log.Errorf("Failed to read the agent identity, logging in with the PIN: %v", err)
+		return nil
+	}
+	if id == nil || id.Secret == "" {
+		return nil
+	}
+	if id.ID != wsH.ID {
+		log.Warnf("The saved identity is for agent %s, not %s, logging in with the PIN", id.ID, wsH.ID)
+		return nil
+	}
+	wsH.identity = id
+	return id
+}
+
+// enroll saves the secret the controller issued, after which the PIN is
+// no longer needed.
+func (wsH *WebSocketHandler) enroll(resp agentLoginResp) {
+	if wsH.IdentityPath == "" {
+		return
+	}
+
+	agent := resp.Data
+	agent.Pin = ""
+	id := &Identity{
+		ID:         wsH.ID,
+		Secret:     resp.Secret,
+		Agent:      agent,
+		EnrolledAt: time.Now(),
+	}
+	err := id.Save(wsH.IdentityPath)
+	if err != nil {
+		log.Errorf("Failed to save the agent identity, the PIN is still needed: %v", err)
+		return
+	}
+
+	log.Infof("Enrolled with the controller, the PIN is no longer needed")
+	wsH.identity = id
+	wsH.Pin = ""
+	if wsH.Enrolled != nil {
+		wsH.Enrolled()
+	}
+}
+
+// setToken caches token and schedules its refresh ahead of its expiry.
+func (wsH *WebSocketHandler) setToken(token string) {
+	expires := tokenExpiry(token)
+
+	wsH.tokenMu.Lock()
+	defer wsH.tokenMu.Unlock()
+	wsH.token = token
+	wsH.tokenExpires = expires
+	wsH.tokenRefreshAt = expires
+	if wsH.refreshTimer != nil {
+		wsH.refreshTimer.Stop()
+		wsH.refreshTimer = nil
+	}
+
+	lifetime := time.Until(expires)
+	if lifetime > 0 {
+		wsH.tokenRefreshAt = expires.Add(-min(tokenRefreshBefore, lifetime/5))
+		log.Debugf("Logged in to the controller, token expires at %s", expires.Format(time.RFC3339))
+		wsH.refreshTimer = time.AfterFunc(time.Until(wsH.tokenRefreshAt), wsH.refreshToken)
+	}
+}
+
+// clearToken drops the cached token so the next connection logs in again.
+func (wsH *WebSocketHandler) clearToken() {
+	wsH.tokenMu.Lock()
+	defer wsH.tokenMu.Unlock()
+	wsH.token = ""
+	wsH.tokenExpires = time.Time{}
+	wsH.tokenRefreshAt = time.Time{}
+	if wsH.refreshTimer != nil {
+		wsH.refreshTimer.Stop()
+		wsH.refreshTimer = nil
+	}
+}
+
+// refreshToken replaces the token before it expires. While the controller
+// can't be reached it keeps trying until the old token runs out.
+func (wsH *WebSocketHandler) refreshToken() {
+	wsH.tokenMu.Lock()
+	old := wsH.token
+	wsH.tokenMu.Unlock()
+
+	_, err := wsH.login()
+	if err == nil || errors.Is(err, ErrBadLogin) {
+		if err != nil {
+			log.Errorf("Failed to refresh the controller token: %v", err)
+		}
+		return
+	}
+
+	wsH.tokenMu.Lock()
+	defer wsH.tokenMu.Unlock()
+	left := time.Until(wsH.tokenExpires)
+	if wsH.token != old || old == "" || left <= 0 {
+		// replaced or dropped meanwhile
+		return
+	}
+	log.Warnf("Failed to refresh the controller token, retrying in %s: %v", tokenRetryInterval, err)
+	wsH.refreshTimer = time.AfterFunc(min(tokenRetryInterval, left), wsH.refreshToken)
+}
+
+// tokenExpiry reads the exp claim of a JWT. It returns the zero time for
+// tokens that aren't JWTs or don't expire, which are kept until rejected.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// isUnauthorized reports whether the controller refused a connection because
+// of its token, with the status of the websocket handshake or a REST call,
+// or the code it closed the websocket with.
+func isUnauthorized(err error) bool {
+	var statusErr ws.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr == http.StatusUnauthorized || statusErr == http.StatusForbidden
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+	}
+	var closeErr neffos.CloseError
+	if errors.As(err, &closeErr) {
+		// 4000 + the HTTP status is the usual application close code
+		switch closeErr.Code {
+		case http.StatusUnauthorized, http.StatusForbidden, 4000 + http.StatusUnauthorized, 4000 + http.StatusForbidden:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package ws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gobwas/ws"
+	"github.com/kataras/neffos"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// jwt returns an unsigned token with the given claims.
+func jwt(t *testing.T, claims map[string]interface{}) string {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(b) + ".sig"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	payload := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+
+	tests := map[string]struct {
+		token string
+		want  time.Time
+	}{
+		"exp":            {jwt(t, map[string]interface{}{"exp": exp.Unix(), "sub": "agent"}), exp},
+		"padded payload": {"e30." + payload + ".sig", exp},
+		"no exp":         {jwt(t, map[string]interface{}{"sub": "agent"}), time.Time{}},
+		"not a jwt":      {"opaque-session-token", time.Time{}},
+		"two parts":      {"e30.e30", time.Time{}},
+		"bad base64":     {"e30.!!!.sig", time.Time{}},
+		"bad json":       {"e30." + base64.RawURLEncoding.EncodeToString([]byte("{exp")) + ".sig", time.Time{}},
+		"string exp":     {jwt(t, map[string]interface{}{"exp": "tomorrow"}), time.Time{}},
+	}
+	for name, tt := range tests {
+		if got := tokenExpiry(tt.token); !got.Equal(tt.want) {
+			t.Errorf("%s: tokenExpiry() = %s, want %s", name, got, tt.want)
+		}
+	}
+}
+
+func TestSetToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		refresh  time.Duration // before expiry, 0 for no refresh
+	}{
+		{"long lived", time.Hour, tokenRefreshBefore},
+		{"short lived", 10 * time.Minute, 2 * time.Minute},
+		{"expired", -time.Minute, 0},
+	}
+	for _, tt := range tests {
+		wsH := &WebSocketHandler{}
+		exp := time.Now().Add(tt.lifetime).Truncate(time.Second)
+		wsH.setToken(jwt(t, map[string]interface{}{"exp": exp.Unix()}))
+
+		if !wsH.tokenExpires.Equal(exp) {
+			t.Errorf("%s: expires at %s, want %s", tt.name, wsH.tokenExpires, exp)
+		}
+		if want := exp.Add(-tt.refresh); wsH.tokenRefreshAt.Sub(want).Abs() > time.Second {
+			t.Errorf("%s: refreshed at %s, want %s", tt.name, wsH.tokenRefreshAt, want)
+		}
+		if scheduled := wsH.refreshTimer != nil; scheduled != (tt.refresh > 0) {
+			t.Errorf("%s: refresh scheduled = %v", tt.name, scheduled)
+		}
+		wsH.clearToken()
+	}
+
+	// kept until refused
+	wsH := &WebSocketHandler{}
+	wsH.setToken("opaque")
+	if !wsH.tokenExpires.IsZero() || wsH.refreshTimer != nil {
+		t.Error("scheduled a refresh for a token without an expiry")
+	}
+	if token, err := wsH.getBearerToken(); token != "opaque" || err != nil {
+		t.Errorf("getBearerToken() = %q, %v, want the cached token", token, err)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{http.StatusOK, `{"token":"t"}`, nil},
+		{http.StatusOK, `{}`, ErrUnreachable},
+		{http.StatusUnauthorized, "bad pin", ErrBadLogin},
+		{http.StatusForbidden, "", ErrBadLogin},
+		{http.StatusNotFound, "", ErrBadLogin},
+		{http.StatusRequestTimeout, "", ErrUnreachable},
+		{http.StatusTooManyRequests, "", ErrUnreachable},
+		{http.StatusInternalServerError, "", ErrUnreachable},
+		{http.StatusBadGateway, "", ErrUnreachable},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/agent/login" {
+				t.Errorf("%s %s, want POST /agent/login", r.Method, r.URL.Path)
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		wsH := &WebSocketHandler{RestClientConfig: RestClientConfig{APIHost: srv.URL, HTTPTimeout: 5 * time.Second}}
+		wsH.setToken("cached")
+
+		resp, err := wsH.requestToken(agentLogin{ID: "agent", PIN: "123456"})
+		srv.Close()
+		if !errors.Is(err, tt.want) || (tt.want == nil && resp.Token != "t") {
+			t.Errorf("%d: requestToken() = %q, %v, want %v", tt.status, resp.Token, err, tt.want)
+		}
+		// a refused login drops the token it was refreshing
+		if cleared := wsH.token == ""; cleared != (tt.want == ErrBadLogin) {
+			t.Errorf("%d: token cleared = %v", tt.status, cleared)
+		}
+	}
+
+	// nothing listening
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	wsH := &WebSocketHandler{RestClientConfig: RestClientConfig{APIHost: srv.URL, HTTPTimeout: 5 * time.Second}}
+	if _, err := wsH.requestToken(agentLogin{}); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("requestToken() = %v without a controller, want %v", err, ErrUnreachable)
+	}
+}
+
+func TestIsUnauthorized(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want bool
+	}{
+		"handshake 401":    {ws.StatusError(http.StatusUnauthorized), true},
+		"handshake 403":    {fmt.Errorf("dial: %w", ws.StatusError(http.StatusForbidden)), true},
+		"handshake 502":    {ws.StatusError(http.StatusBadGateway), false},
+		"rest 401":         {&APIError{StatusCode: http.StatusUnauthorized}, true},
+		"rest 500":         {&APIError{StatusCode: http.StatusInternalServerError}, false},
+		"close 4401":       {fmt.Errorf("error connecting to namespace agent: %w", neffos.CloseError{Code: 4401}), true},
+		"close 1000":       {neffos.CloseError{Code: 1000}, false},
+		"unauthorized msg": {errors.New("unauthorized"), false},
+		"timeout":          {errors.New("i/o timeout"), false},
+	}
+	for name, tt := range tests {
+		if got := isUnauthorized(tt.err); got != tt.want {
+			t.Errorf("%s: isUnauthorized(%v) = %v", name, tt.err, got)
+		}
+	}
+}
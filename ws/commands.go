@@ -0,0 +1,99 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12/websocket"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Commands the controller can send, each answered with a command_response
+// event carrying the same id.
+const (
+	CommandRunNow        = "run_now"        // run a probe now and return its result
+	CommandCancel        = "cancel"         // abort a running probe
+	CommandRestartWorker = "restart_worker" // restart the worker of a probe, or all of them
+	CommandDumpState     = "dump_state"     // return the agent's current state
+	CommandSetLogLevel   = "set_log_level"  // change the log level
+
+	eventTypeWS_CommandResponse = "command_response"
+)
+
+var commandEvents = []string{CommandRunNow, CommandCancel, CommandRestartWorker, CommandDumpState, CommandSetLogLevel}
+
+// Command is a request from the controller.
+type Command struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"-"` // the event it arrived as
+	ProbeID primitive.ObjectID `json:"probe_id,omitempty"`
+	Probe   *probes.Probe      `json:"probe,omitempty"` // one-off probe for run_now instead of a configured one
+	Level   string             `json:"level,omitempty"`
+}
+
+// CommandResponse answers a Command.
+type CommandResponse struct {
+	ID      string      `json:"id"`
+	Command string      `json:"command"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// CommandFunc carries out a command and returns the data to answer with.
+type CommandFunc func(ctx context.Context, cmd Command) (interface{}, error)
+
+// commandEvent handles one of the command events. Commands run in their
+// own goroutine, so a long run_now doesn't hold up the other events.
+func (wsH *WebSocketHandler) commandEvent(name string) *WebSocketEvent {
+	return &WebSocketEvent{
+		Namespace: namespace,
+		EventType: EventTypeWS(name),
+		Func: func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			body, err := wsH.open(name, MessageCommand, msg.Body)
+			if err != nil {
+				log.Errorf("unable to read %s: %v", name, err)
+				return nil
+			}
+			var cmd Command
+			err = json.Unmarshal(body, &cmd)
+			if err != nil {
+				log.Errorf("unable to parse %s: %v", name, err)
+				return nil
+			}
+			cmd.Name = name
+
+			go wsH.runCommand(cmd)
+			return nil
+		},
+	}
+}
+
+func (wsH *WebSocketHandler) runCommand(cmd Command) {
+	log.Infof("Running %s command %s from the controller", cmd.Name, cmd.ID)
+
+	resp := CommandResponse{ID: cmd.ID, Command: cmd.Name}
+	f, ok := wsH.Commands[cmd.Name]
+	if !ok {
+		resp.Error = fmt.Sprintf("%s is not supported by this agent", cmd.Name)
+	} else {
+		data, err := f(wsH.context(), cmd)
+		resp.Data = data
+		resp.OK = err == nil
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorf("unable to encode the response to %s: %v", cmd.Name, err)
+		return
+	}
+	// the connection may have been replaced while the command ran
+	if !wsH.Emit(eventTypeWS_CommandResponse, MessageCommandResult, b) {
+		log.Warnf("Dropping the response to %s command %s, not connected", cmd.Name, cmd.ID)
+	}
+}
@@ -0,0 +1,220 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// ProtocolVersion is the newest version of the message envelope this
+// agent speaks. Controllers that don't answer agent_hello get the raw
+// bodies older agents sent.
+const ProtocolVersion = 1
+
+// helloTimeout is how long to wait for agent_hello_ack before falling back
+// to raw bodies.
+const helloTimeout = 3 * time.Second
+
+// Message types carried in an Envelope.
+const (
+	MessageHello         = "hello"          // agent_hello, the agent's Capabilities
+	MessageHelloAck      = "hello_ack"      // agent_hello_ack, the controller's HelloAck
+	MessageProbeRequest  = "probe_request"  // probe_get from the agent, no payload
+	MessageProbes        = "probes"         // probe_get from the controller, a list of probes.Probe
+	MessageProbeData     = "probe_data"     // probe_post, a probes.ProbeData
+	MessageProbeAck      = "probe_ack"      // probe_post_ack
+	MessageAgentUpdate   = "agent_update"   // agent_update, an update.Release
+	MessageCommand       = "command"        // any of the command events, a Command
+	MessageCommandResult = "command_result" // command_response, a CommandResponse
+
+	eventTypeWS_AgentHello    = "agent_hello"
+	eventTypeWS_AgentHelloAck = "agent_hello_ack"
+)
+
+// Envelope wraps every message once the controller has agreed on a
+// protocol version.
+type Envelope struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	Agent     string          `json:"agent,omitempty"` // the agent's ID, sent and received
+	Seq       uint64          `json:"seq"`             // increases with every message the sender emits
+	Timestamp time.Time       `json:"ts"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// Capabilities is what the agent tells the controller when it connects,
+// so the controller doesn't send it probes or commands it can't handle.
+type Capabilities struct {
+	Protocols    []int                    `json:"protocols"` // envelope versions the agent speaks
+	AgentVersion string                   `json:"version"`
+	Probes       map[probes.ProbeType]int `json:"probes"` // probe types the agent runs and their result schema versions
+	Commands     []string                 `json:"commands"`
+	Encodings    []string                 `json:"encodings"`    // probe_post encodings besides json
+	Compressions []string                 `json:"compressions"` // probe_post compressions, preferred first
+	Batch        bool                     `json:"batch"`        // whether the agent can send probe_batch frames
+}
+
+// HelloAck is the controller's answer to agent_hello.
+type HelloAck struct {
+	Protocol int `json:"protocol"` // the version both sides use from now on
+	Upload       // the probe_post format, plain JSON unless set
+}
+
+// Protocol returns the envelope version agreed with the controller, 0
+// while it hasn't answered agent_hello.
+func (wsH *WebSocketHandler) Protocol() int {
+	return int(wsH.protocol.Load())
+}
+
+func (wsH *WebSocketHandler) capabilities() Capabilities {
+	var commands []string
+	for name := range wsH.Commands {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+
+	return Capabilities{
+		Protocols:    []int{ProtocolVersion},
+		AgentVersion: wsH.AgentVersion,
+		Probes:       probes.ResultSchemas,
+		Commands:     commands,
+		Encodings:    wsH.UploadOptions.Encodings,
+		Compressions: wsH.UploadOptions.Compressions,
+		Batch:        wsH.UploadOptions.Batch,
+	}
+}
+
+// seal wraps payload in an Envelope of the given version.
+func (wsH *WebSocketHandler) seal(version int, msgType string, payload []byte) ([]byte, error) {
+	return json.Marshal(Envelope{
+		Version:   version,
+		Type:      msgType,
+		Agent:     wsH.ID,
+		Seq:       wsH.seq.Add(1),
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// Emit sends a message on the agent namespace, in an envelope when the
+// controller agreed on one and as the bare payload otherwise. It reports
+// whether the message was written.
+func (wsH *WebSocketHandler) Emit(event, msgType string, payload []byte) bool {
+	if !wsH.IsConnected() {
+		return false
+	}
+
+	if v := wsH.Protocol(); v > 0 {
+		b, err := wsH.seal(v, msgType, payload)
+		if err != nil {
+			log.Errorf("unable to wrap %s: %v", event, err)
+			return false
+		}
+		payload = b
+	}
+	return wsH.GetConnection().Emit(event, payload)
+}
+
+// open returns the payload of a message from the controller. Bodies that
+// aren't envelopes come from controllers that predate them and are
+// returned as they are.
+func (wsH *WebSocketHandler) open(event, msgType string, body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return body, nil
+	}
+	var env Envelope
+	if json.Unmarshal(body, &env) != nil || env.Version == 0 {
+		return body, nil
+	}
+
+	if env.Version > ProtocolVersion {
+		return nil, fmt.Errorf("%s uses protocol version %d, this agent speaks up to %d", event, env.Version, ProtocolVersion)
+	}
+	if env.Type != msgType {
+		return nil, fmt.Errorf("%s carries a %q message, expected %q", event, env.Type, msgType)
+	}
+	if env.Agent != "" && wsH.ID != "" && env.Agent != wsH.ID {
+		return nil, fmt.Errorf("%s is addressed to agent %s", event, env.Agent)
+	}
+	return env.Payload, nil
+}
+
+// hello offers the controller the agent's capabilities and waits for it to
+// pick a protocol version. Controllers that know about envelopes answer
+// with agent_hello_ack, older ones ignore it.
+func (wsH *WebSocketHandler) hello() {
+	wsH.protocol.Store(0)
+	wsH.upload.Store(nil)
+	select {
+	case <-wsH.helloAckCh:
+	default:
+	}
+
+	caps, err := json.Marshal(wsH.capabilities())
+	if err != nil {
+		log.Errorf("unable to encode the agent's capabilities: %v", err)
+		return
+	}
+	b, err := wsH.seal(ProtocolVersion, MessageHello, caps)
+	if err != nil {
+		log.Errorf("unable to encode agent_hello: %v", err)
+		return
+	}
+	wsH.GetConnection().Emit(eventTypeWS_AgentHello, b)
+
+	select {
+	case <-wsH.helloAckCh:
+	case <-time.After(helloTimeout):
+		log.Infof("The controller didn't answer agent_hello, sending messages without envelopes")
+	}
+}
+
+func (wsH *WebSocketHandler) helloAck(body []byte) error {
+	payload, err := wsH.open(eventTypeWS_AgentHelloAck, MessageHelloAck, body)
+	if err != nil {
+		return err
+	}
+	var ack HelloAck
+	err = json.Unmarshal(payload, &ack)
+	if err != nil {
+		return err
+	}
+	if ack.Protocol < 1 || ack.Protocol > ProtocolVersion {
+		return fmt.Errorf("the controller chose protocol version %d, this agent speaks 1 to %d", ack.Protocol, ProtocolVersion)
+	}
+
+	err = wsH.checkUpload(ack.Upload)
+	if err != nil {
+		return err
+	}
+
+	wsH.upload.Store(&ack.Upload)
+	wsH.protocol.Store(int32(ack.Protocol))
+	log.Infof("Using protocol version %d with the controller", ack.Protocol)
+	if !ack.Upload.plain() || ack.Upload.Batch {
+		log.Infof("Sending probe data as %s, compression %q, batched %v", ack.Upload.encoding(), ack.Upload.Compression, ack.Upload.Batch)
+	}
+	select {
+	case wsH.helloAckCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// supportedProbes drops the probes this agent can't run, in case the
+// controller didn't take its capabilities into account.
+func supportedProbes(pp []probes.Probe) []probes.Probe {
+	supported := pp[:0]
+	for _, p := range pp {
+		if !probes.Supported(p.Type) {
+			log.Warnf("Ignoring probe %s, type %q isn't supported by this agent", p.ID.Hex(), p.Type)
+			continue
+		}
+		supported = append(supported, p)
+	}
+	return supported
+}
@@ -2,12 +2,21 @@ package ws
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/kataras/iris/v12/websocket"
 	"github.com/kataras/neffos"
 	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/netwatcherio/netwatcher-agent/proxy"
+	"github.com/netwatcherio/netwatcher-agent/update"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,16 +30,43 @@ type WebSocketHandler struct {
 	Pin              string
 	ID               string
 	HostWS           string
-	Events           []*WebSocketEvent `json:"events"`
-	connection       *websocket.NSConn
+	Events           []*WebSocketEvent                `json:"events"`
+	connection       atomic.Pointer[websocket.NSConn] // replaced on every reconnect
 	Namespaces       *websocket.Namespaces
 	RestClientConfig RestClientConfig
+	TLSConfig        *tls.Config // for both the login and the websocket, nil for the defaults
 	ProbeGetCh       chan []probes.Probe
+	ConnectedCh      chan struct{} // signalled every time the namespace connects
+	ProbeAckCh       chan primitive.ObjectID
+	UpdateCh         chan update.Release // releases the controller advertises
+	Commands         map[string]CommandFunc
+	UploadOptions    UploadOptions // probe_post formats offered to the controller
 	AgentVersion     string
+	IdentityPath     string // where the credential from enrolling is kept, the PIN is always used when empty
+	Enrolled         func() // called once the PIN is no longer needed
+
+	protocol       atomic.Int32 // envelope version agreed in agent_hello_ack, 0 for raw bodies
+	seq            atomic.Uint64
+	upload         atomic.Pointer[Upload]
+	helloAckCh     chan struct{}
+	ctx            context.Context // from InitWS, no reconnecting once it is done
+	loginMu        sync.Mutex
+	identity       *Identity
+	tokenMu        sync.Mutex
+	token          string
+	tokenExpires   time.Time // zero when the token doesn't say
+	tokenRefreshAt time.Time
+	refreshTimer   *time.Timer
 }
 
 func (wsH *WebSocketHandler) GetConnection() *websocket.NSConn {
-	return wsH.connection
+	return wsH.connection.Load()
+}
+
+// IsConnected reports whether the namespace connection is currently usable.
+func (wsH *WebSocketHandler) IsConnected() bool {
+	conn := wsH.connection.Load()
+	return conn != nil && conn.Conn != nil && !conn.Conn.IsClosed()
 }
 
 type EventTypeWS string
@@ -42,48 +78,65 @@ type WebSocketEvent struct {
 }
 
 const (
-	eventTypeWS_ProbeGet  = "probe_get"
-	eventTypeWS_ProbeData = "probe_data"
-	eventTypeWS_AgentGet  = "agent_get"
+	eventTypeWS_ProbeGet     = "probe_get"
+	eventTypeWS_ProbeData    = "probe_data"
+	eventTypeWS_AgentGet     = "agent_get"
+	eventTypeWS_ProbePostAck = "probe_post_ack"
+	eventTypeWS_AgentUpdate  = "agent_update"
 )
 
-func (wsH *WebSocketHandler) InitWS() error {
+// InitWS logs in and connects to the controller, retrying until it
+// succeeds or ctx is done. The connection is re-established whenever it
+// drops, until ctx is done.
+func (wsH *WebSocketHandler) InitWS(ctx context.Context) error {
+	wsH.ctx = ctx
 	clientCfg := RestClientConfig{
 		APIHost:     wsH.Host,
 		HTTPTimeout: 10 * time.Second,
 		DialTimeout: 5 * time.Second,
 		TLSTimeout:  5 * time.Second,
+		TLSConfig:   wsH.TLSConfig,
 	}
 	wsH.RestClientConfig = clientCfg
+	wsH.helloAckCh = make(chan struct{}, 1)
 
 	wsH.connectWithRetry(nil)
-	return nil
+	return ctx.Err()
 }
-func (wsH *WebSocketHandler) getBearerToken() (string, error) {
-
-	// todo have it reuse the token unless expired
-
-	loginC := NewClient(wsH.RestClientConfig)
 
-	loginReq := agentLogin{
-		PIN:          wsH.Pin,
-		ID:           wsH.ID,
-		AgentVersion: wsH.AgentVersion,
+// Close disconnects from the controller once InitWS's context is done, for
+// shutting down.
+func (wsH *WebSocketHandler) Close() {
+	wsH.tokenMu.Lock()
+	if wsH.refreshTimer != nil {
+		wsH.refreshTimer.Stop()
 	}
+	wsH.tokenMu.Unlock()
 
-	var agentLoginR = agentLoginResp{}
-
-	// initialize the apiClient from api
-	// todo make this a loop that checks periodically as well as handles the errors and retries
-	err := loginC.Request("POST", "/agent/login", &loginReq, &agentLoginR)
+	if conn := wsH.connection.Load(); conn != nil && conn.Conn != nil {
+		conn.Conn.Close()
+	}
+}
 
-	if err != nil {
-		log.Error(err)
-		return "", err
+// context returns InitWS's context.
+func (wsH *WebSocketHandler) context() context.Context {
+	if wsH.ctx == nil {
+		return context.Background()
 	}
+	return wsH.ctx
+}
 
-	bearerToken := agentLoginR.Token
-	return bearerToken, nil
+// sleep waits for d, or until InitWS's context is done. It reports whether
+// the wait ran its course.
+func (wsH *WebSocketHandler) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-wsH.context().Done():
+		return false
+	}
 }
 
 func (wsH *WebSocketHandler) loadNamespaces() websocket.Namespaces {
@@ -114,6 +167,10 @@ func (wsH *WebSocketHandler) inboundEvents() {
 		EventType: EventTypeWS(websocket.OnNamespaceDisconnect),
 		Func: func(c *websocket.NSConn, msg websocket.Message) error {
 			log.Printf("disconnected from namespace: %s", msg.Namespace)
+			if wsH.context().Err() != nil {
+				// shutting down
+				return nil
+			}
 			wsH.connectWithRetry(nil)
 			//todo handle and reconnect if disconnects?
 			return nil
@@ -125,14 +182,19 @@ func (wsH *WebSocketHandler) inboundEvents() {
 		Func: func(nsConn *websocket.NSConn, msg websocket.Message) error {
 
 			log.Printf("%s", string(msg.Body))
+			body, err := wsH.open(eventTypeWS_ProbeGet, MessageProbes, msg.Body)
+			if err != nil {
+				log.Errorf("unable to read probe_get: %v", err)
+				return nil
+			}
 			var pp []probes.Probe
-			err := json.Unmarshal(msg.Body, &pp)
+			err = json.Unmarshal(body, &pp)
 			if err != nil {
 				return err
 			}
 			log.Info("Loaded probes into memory...")
 
-			wsH.ProbeGetCh <- pp
+			wsH.ProbeGetCh <- supportedProbes(pp)
 
 			/*for _, pro := range pp {
 				log.Infof("Sending probe to channel for loading/processing - Type: %s, Target: %s", pro.Type, pro.Config.Target)
@@ -141,17 +203,95 @@ func (wsH *WebSocketHandler) inboundEvents() {
 			return nil
 		},
 	})
+
+	wsH.Events = append(wsH.Events, &WebSocketEvent{
+		Namespace: namespace,
+		EventType: eventTypeWS_ProbePostAck,
+		Func: func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			body, err := wsH.open(eventTypeWS_ProbePostAck, MessageProbeAck, msg.Body)
+			if err != nil {
+				log.Errorf("unable to read probe_post_ack: %v", err)
+				return nil
+			}
+			var ack probePostAck
+			err = json.Unmarshal(body, &ack)
+			if err != nil {
+				log.Errorf("unable to parse probe_post_ack: %v", err)
+				return nil
+			}
+
+			if !ack.ID.IsZero() {
+				wsH.probeAcked(ack.ID)
+			}
+			for _, id := range ack.IDs {
+				wsH.probeAcked(id)
+			}
+			return nil
+		},
+	})
+
+	wsH.Events = append(wsH.Events, &WebSocketEvent{
+		Namespace: namespace,
+		EventType: eventTypeWS_AgentUpdate,
+		Func: func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			body, err := wsH.open(eventTypeWS_AgentUpdate, MessageAgentUpdate, msg.Body)
+			if err != nil {
+				log.Errorf("unable to read agent_update: %v", err)
+				return nil
+			}
+			var r update.Release
+			err = json.Unmarshal(body, &r)
+			if err != nil {
+				log.Errorf("unable to parse agent_update: %v", err)
+				return nil
+			}
+
+			if wsH.UpdateCh != nil {
+				select {
+				case wsH.UpdateCh <- r:
+				default:
+					log.Warnf("Ignoring agent_update for %s, an update is already queued", r.Version)
+				}
+			}
+			return nil
+		},
+	})
+
+	wsH.Events = append(wsH.Events, &WebSocketEvent{
+		Namespace: namespace,
+		EventType: eventTypeWS_AgentHelloAck,
+		Func: func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			err := wsH.helloAck(msg.Body)
+			if err != nil {
+				log.Errorf("unable to use agent_hello_ack, sending messages without envelopes: %v", err)
+			}
+			return nil
+		},
+	})
+
+	for _, name := range commandEvents {
+		wsH.Events = append(wsH.Events, wsH.commandEvent(name))
+	}
+}
+
+// probePostAck is sent by the controller once it has stored a ProbeData,
+// or the results of a probe_batch.
+type probePostAck struct {
+	ID  primitive.ObjectID   `json:"id"`
+	IDs []primitive.ObjectID `json:"ids,omitempty"`
 }
 
 type agentLogin struct {
-	PIN          string `json:"pin"`
+	PIN          string `json:"pin,omitempty"`
+	Secret       string `json:"secret,omitempty"` // replaces the PIN once enrolled
 	ID           string `json:"id"`
 	AgentVersion string `json:"version"`
 }
 
 type agentLoginResp struct {
-	Token string `json:"token"`
-	Data  Agent  `json:"data"`
+	Token  string `json:"token"`
+	Secret string `json:"secret,omitempty"` // issued by controllers that enroll agents
+	Data   Agent  `json:"data"`
 }
 
 type Agent struct {
@@ -177,11 +317,17 @@ func (wsH *WebSocketHandler) connectWithRetry(outgoingMessages chan DataToBeSent
 	maxDelay := 120 * time.Second
 	delay := initialDelay
 
-	for {
+	for wsH.context().Err() == nil {
 		token, err := wsH.getBearerToken()
+		if errors.Is(err, ErrBadLogin) {
+			// retrying straight away won't fix the ID or PIN
+			log.Errorf("Failed to log in to the controller, check the agent ID and PIN, retrying in %s: %v", badLoginDelay, err)
+			wsH.sleep(badLoginDelay)
+			continue
+		}
 		if err != nil {
 			log.Errorf("Error connecting to websocket, retrying in %s: %v", delay, err)
-			time.Sleep(delay)
+			wsH.sleep(delay)
 			if delay < maxDelay {
 				delay *= 2
 			}
@@ -189,43 +335,98 @@ func (wsH *WebSocketHandler) connectWithRetry(outgoingMessages chan DataToBeSent
 		}
 
 		client, err := wsH.connectWS(wsH.HostWS, token)
+		if err == nil {
+			err = wsH.handleConnection(client)
+		}
 		if err == nil {
 			// Connected successfully, reset delay
 			delay = initialDelay
-			wsH.handleConnection(client)
 			return
 		}
 
-		// Connection failed, retry with exponential backoff
+		// the cached token is only replaced when the controller refuses it,
+		// an outage alone doesn't need a new login
+		if isUnauthorized(err) {
+			log.Warnf("The controller refused the token, logging in again: %v", err)
+			wsH.clearToken()
+		}
 
-		// todo, if being backed off for invalid authentication/token, have it re-authenticate to get new token
+		// Connection failed, retry with exponential backoff
 		log.Errorf("Error connecting to websocket, retrying in %s: %v", delay, err)
-		time.Sleep(delay)
+		wsH.sleep(delay)
 		if delay < maxDelay {
 			delay *= 2
 		}
 	}
 }
 
-func (wsH *WebSocketHandler) handleConnection(client *neffos.Client) {
+// probeAcked hands an acknowledgement to the delivery loop without holding
+// up the read loop. An ack dropped because the loop is behind only means
+// the data is resent, and acknowledged again.
+func (wsH *WebSocketHandler) probeAcked(id primitive.ObjectID) {
+	if wsH.ProbeAckCh == nil {
+		return
+	}
+	select {
+	case wsH.ProbeAckCh <- id:
+	default:
+		log.Debugf("Dropping probe_post_ack for %s, too many waiting", id.Hex())
+	}
+}
+
+func (wsH *WebSocketHandler) handleConnection(client *neffos.Client) error {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(dialAndConnectTimeout))
 	defer cancel()
 
 	cc, err := client.Connect(ctx, namespace)
 	if err != nil {
-		log.Error("error connecting to websocket")
+		client.Close()
+		return fmt.Errorf("error connecting to namespace %s: %w", namespace, err)
 	}
 
-	wsH.connection = cc
+	wsH.connection.Store(cc)
+
+	wsH.hello()
 
 	// request initial data
-	wsH.GetConnection().Emit("probe_get", []byte("give me probe information"))
+	wsH.RequestProbes()
+
+	if wsH.ConnectedCh != nil {
+		select {
+		case wsH.ConnectedCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// RequestProbes asks the controller for the probes to run, which it
+// answers with probe_get.
+func (wsH *WebSocketHandler) RequestProbes() bool {
+	if wsH.Protocol() > 0 {
+		return wsH.Emit(eventTypeWS_ProbeGet, MessageProbeRequest, nil)
+	}
+	if !wsH.IsConnected() {
+		return false
+	}
+	return wsH.GetConnection().Emit(eventTypeWS_ProbeGet, []byte("give me probe information"))
 }
 
 func (wsH *WebSocketHandler) connectWS(hostWS string, bearerToken string) (*neffos.Client, error) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(dialAndConnectTimeout))
 	defer cancel()
 
-	dialer := websocket.GobwasDialer(websocket.GobwasDialerOptions{Header: websocket.GobwasHeader{"Authorization": []string{"Bearer " + bearerToken}}})
+	// the websocket isn't an http.Client request, so the proxy is dialed by hand
+	scheme := "http"
+	if strings.HasPrefix(hostWS, "wss://") {
+		scheme = "https"
+	}
+	dialer := websocket.GobwasDialer(websocket.GobwasDialerOptions{
+		Header:    websocket.GobwasHeader{"Authorization": []string{"Bearer " + bearerToken}},
+		TLSConfig: wsH.TLSConfig,
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return proxy.Dial(ctx, scheme, addr)
+		},
+	})
 	return websocket.Dial(ctx, dialer, hostWS, wsH.loadNamespaces())
 }
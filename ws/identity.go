@@ -0,0 +1,60 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Identity is what the agent keeps after enrolling with the controller. The
+// secret replaces the PIN for every later login.
+type Identity struct {
+	ID         string    `json:"id"`
+	Secret     string    `json:"secret"`
+	Agent      Agent     `json:"agent"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+// LoadIdentity reads the identity saved at path. It returns nil without an
+// error when the agent hasn't enrolled yet.
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var id Identity
+	err = json.Unmarshal(b, &id)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// Save writes the identity to path, readable only by the agent's user.
+func (id *Identity) Save(path string) error {
+	b, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
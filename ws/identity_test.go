@@ -0,0 +1,198 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentitySaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "identity.json")
+	if id, err := LoadIdentity(path); id != nil || err != nil {
+		t.Fatalf("LoadIdentity() = %v, %v before enrolling", id, err)
+	}
+
+	want := &Identity{ID: "agent", Secret: "s3cret", Agent: Agent{Name: "edge"}, EnrolledAt: time.Now().UTC().Truncate(time.Second)}
+	if err := want.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	got, err := LoadIdentity(path)
+	if err != nil || got == nil || got.ID != want.ID || got.Secret != want.Secret || got.Agent.Name != want.Agent.Name || !got.EnrolledAt.Equal(want.EnrolledAt) {
+		t.Fatalf("LoadIdentity() = %+v, %v, want %+v", got, err, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm != 0600 {
+		t.Errorf("identity saved with mode %o, want 0600", perm)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	os.WriteFile(path, []byte("{"), 0600)
+	if _, err := LoadIdentity(path); err == nil {
+		t.Error("LoadIdentity() read a corrupt file")
+	}
+}
+
+// loginServer answers logins, refusing the secrets in refused, and issues
+// secret on PIN logins when it isn't empty.
+type loginServer struct {
+	*httptest.Server
+	secret  string
+	refused map[string]bool
+
+	mu     sync.Mutex
+	logins []agentLogin
+}
+
+func newLoginServer(t *testing.T, secret string) *loginServer {
+	s := &loginServer{secret: secret, refused: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req agentLogin
+		json.NewDecoder(r.Body).Decode(&req)
+		s.mu.Lock()
+		s.logins = append(s.logins, req)
+		s.mu.Unlock()
+
+		resp := agentLoginResp{Token: "token"}
+		switch {
+		case req.Secret != "" && s.refused[req.Secret], req.Secret == "" && req.PIN != "123456":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case req.Secret == "":
+			resp.Secret = s.secret
+			resp.Data = Agent{Name: "edge", Pin: req.PIN}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *loginServer) handler(t *testing.T, pin string) *WebSocketHandler {
+	return &WebSocketHandler{
+		ID:               "agent",
+		Pin:              pin,
+		IdentityPath:     filepath.Join(t.TempDir(), "identity.json"),
+		RestClientConfig: RestClientConfig{APIHost: s.URL, HTTPTimeout: 5 * time.Second},
+	}
+}
+
+// last returns the credential of the latest login.
+func (s *loginServer) last() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.logins) == 0 {
+		return ""
+	}
+	l := s.logins[len(s.logins)-1]
+	if l.Secret != "" {
+		return "secret " + l.Secret
+	}
+	return "pin " + l.PIN
+}
+
+func TestEnroll(t *testing.T) {
+	srv := newLoginServer(t, "issued")
+	wsH := srv.handler(t, "123456")
+	enrolled := 0
+	wsH.Enrolled = func() { enrolled++ }
+
+	if _, err := wsH.login(); err != nil {
+		t.Fatalf("login() = %v", err)
+	}
+	id, err := LoadIdentity(wsH.IdentityPath)
+	if err != nil || id == nil || id.Secret != "issued" || id.ID != "agent" {
+		t.Fatalf("saved identity %+v, %v", id, err)
+	}
+	if id.Agent.Pin != "" {
+		t.Error("the PIN was saved with the identity")
+	}
+	if wsH.Pin != "" || enrolled != 1 {
+		t.Errorf("PIN %q kept, Enrolled called %d times after enrolling", wsH.Pin, enrolled)
+	}
+
+	// from now on, and after a restart, the secret is used
+	if _, err := wsH.login(); err != nil || srv.last() != "secret issued" {
+		t.Errorf("login() = %v with %s, want the secret", err, srv.last())
+	}
+	restarted := srv.handler(t, "")
+	restarted.IdentityPath = wsH.IdentityPath
+	if _, err := restarted.login(); err != nil || srv.last() != "secret issued" {
+		t.Errorf("login() = %v with %s after a restart, want the secret", err, srv.last())
+	}
+}
+
+func TestEnrollWithoutSecret(t *testing.T) {
+	// controllers that don't enroll keep taking the PIN
+	srv := newLoginServer(t, "")
+	wsH := srv.handler(t, "123456")
+	if _, err := wsH.login(); err != nil {
+		t.Fatalf("login() = %v", err)
+	}
+	if _, err := os.Stat(wsH.IdentityPath); !os.IsNotExist(err) || wsH.Pin == "" {
+		t.Errorf("enrolled without a secret: %v", err)
+	}
+}
+
+func TestLoginSecretRefused(t *testing.T) {
+	srv := newLoginServer(t, "reissued")
+	srv.refused["old"] = true
+
+	// the PIN was configured again, the agent enrolls again
+	wsH := srv.handler(t, "123456")
+	(&Identity{ID: "agent", Secret: "old"}).Save(wsH.IdentityPath)
+	if _, err := wsH.login(); err != nil || srv.last() != "pin 123456" {
+		t.Fatalf("login() = %v with %s, want the PIN", err, srv.last())
+	}
+	if id, _ := LoadIdentity(wsH.IdentityPath); id == nil || id.Secret != "reissued" {
+		t.Errorf("saved identity %+v, want the new secret", id)
+	}
+
+	// without a PIN it gives up
+	wsH = srv.handler(t, "")
+	(&Identity{ID: "agent", Secret: "old"}).Save(wsH.IdentityPath)
+	if _, err := wsH.login(); !errors.Is(err, ErrBadLogin) {
+		t.Errorf("login() = %v, want %v", err, ErrBadLogin)
+	}
+}
+
+func TestLoginSecretForgotten(t *testing.T) {
+	// the controller took the PIN but no longer issues secrets
+	srv := newLoginServer(t, "")
+	srv.refused["old"] = true
+	wsH := srv.handler(t, "123456")
+	(&Identity{ID: "agent", Secret: "old"}).Save(wsH.IdentityPath)
+
+	if _, err := wsH.login(); err != nil {
+		t.Fatalf("login() = %v", err)
+	}
+	if _, err := os.Stat(wsH.IdentityPath); !os.IsNotExist(err) {
+		t.Errorf("identity the controller doesn't know was kept: %v", err)
+	}
+}
+
+func TestLoginIdentityMismatch(t *testing.T) {
+	// the config now names another agent, its PIN is used
+	srv := newLoginServer(t, "issued")
+	wsH := srv.handler(t, "123456")
+	(&Identity{ID: "other-agent", Secret: "other"}).Save(wsH.IdentityPath)
+
+	if _, err := wsH.login(); err != nil || srv.last() != "pin 123456" {
+		t.Fatalf("login() = %v with %s, want the PIN", err, srv.last())
+	}
+	if id, _ := LoadIdentity(wsH.IdentityPath); id == nil || id.ID != "agent" || id.Secret != "issued" {
+		t.Errorf("saved identity %+v, want this agent's", id)
+	}
+}
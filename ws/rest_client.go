@@ -2,9 +2,11 @@ package ws
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/netwatcherio/netwatcher-agent/proxy"
 	"io/ioutil"
 	"log"
 	"net"
@@ -24,6 +26,7 @@ type RestClientConfig struct {
 	HTTPTimeout time.Duration
 	DialTimeout time.Duration
 	TLSTimeout  time.Duration
+	TLSConfig   *tls.Config // nil for the defaults
 }
 
 // NewClientConfig constructs a RestClientConfig object with the environment variables set as default
@@ -38,6 +41,17 @@ func NewClientConfig() RestClientConfig {
 	}
 }
 
+// APIError is returned when the API answers with an error status
+type APIError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: %d - %s \n%s", e.StatusCode, e.Status, e.Body)
+}
+
 // RestClient object
 type RestClient struct {
 	config RestClientConfig
@@ -107,6 +121,8 @@ func (c RestClient) Request(method, endpoint string, data, response interface{})
 				Timeout: c.config.DialTimeout,
 			}).Dial,
 			TLSHandshakeTimeout: c.config.TLSTimeout,
+			TLSClientConfig:     c.config.TLSConfig,
+			Proxy:               proxy.HTTP,
 		},
 	}
 	resp, err := netClient.Do(req)
@@ -119,6 +135,11 @@ func (c RestClient) Request(method, endpoint string, data, response interface{})
 		return err
 	}
 
+	// Return HTTP errors
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return &APIError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+
 	// Get data?
 	if response != nil {
 		if len(body) > 0 {
@@ -136,11 +157,6 @@ func (c RestClient) Request(method, endpoint string, data, response interface{})
 		log.Printf("\n" + string(prettyJSON.Bytes()))
 	}
 
-	// Return HTTP errors
-	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		return fmt.Errorf("API error: %d - %s \n%s", resp.StatusCode, resp.Status, string(body))
-	}
-
 	// Done!
 	return nil
 }
@@ -0,0 +1,68 @@
+package ws
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configures the TLS connections to the controller, for
+// self-hosted controllers behind an internal CA or requiring client
+// certificates.
+type TLSOptions struct {
+	CAFile     string // PEM bundle trusted instead of the system roots
+	CertFile   string // client certificate, PEM
+	KeyFile    string // key of the client certificate, PEM
+	ServerName string // name the controller's certificate is checked against instead of the host
+	MinVersion string // 1.0, 1.1, 1.2 or 1.3
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config builds the tls.Config used by both the REST client and the
+// websocket dialer.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.MinVersion != "" {
+		v, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid minimum TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("a client certificate needs both a certificate and a key file")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
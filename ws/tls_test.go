@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) string {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTLSServer starts a TLS server and writes its certificate to a CA
+// bundle the client can trust.
+func newTLSServer(t *testing.T, configure func(*tls.Config)) (*httptest.Server, string) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{}
+	if configure != nil {
+		configure(srv.TLS)
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	ca := writePEM(t, filepath.Join(t.TempDir(), "ca.pem"), "CERTIFICATE", srv.Certificate().Raw)
+	return srv, ca
+}
+
+// clientCertificate issues a client certificate from a new CA, returning
+// the CA and the certificate and key files.
+func clientCertificate(t *testing.T) (*x509.CertPool, string, string) {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, writePEM(t, filepath.Join(dir, "agent.pem"), "CERTIFICATE", der), writePEM(t, filepath.Join(dir, "agent.key"), "EC PRIVATE KEY", keyDER)
+}
+
+func get(t *testing.T, url string, o TLSOptions) error {
+	cfg, err := o.Config()
+	if err != nil {
+		t.Fatalf("Config() = %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestTLSOptionsCA(t *testing.T) {
+	srv, ca := newTLSServer(t, nil)
+
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca}); err != nil {
+		t.Errorf("trusting the server's CA: %v", err)
+	}
+	if err := get(t, srv.URL, TLSOptions{}); err == nil {
+		t.Error("connected to a server signed by an unknown CA")
+	}
+}
+
+func TestTLSOptionsServerName(t *testing.T) {
+	// the certificate of httptest is valid for example.com
+	srv, ca := newTLSServer(t, nil)
+
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca, ServerName: "example.com"}); err != nil {
+		t.Errorf("checking the certificate against example.com: %v", err)
+	}
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca, ServerName: "controller.example.net"}); err == nil {
+		t.Error("connected to a server whose certificate doesn't match ServerName")
+	}
+}
+
+func TestTLSOptionsClientCertificate(t *testing.T) {
+	pool, cert, key := clientCertificate(t)
+	srv, ca := newTLSServer(t, func(cfg *tls.Config) {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = pool
+	})
+
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca, CertFile: cert, KeyFile: key}); err != nil {
+		t.Errorf("connecting with a client certificate: %v", err)
+	}
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca}); err == nil {
+		t.Error("connected without the client certificate the server requires")
+	}
+}
+
+func TestTLSOptionsMinVersion(t *testing.T) {
+	srv, ca := newTLSServer(t, func(cfg *tls.Config) {
+		cfg.MaxVersion = tls.VersionTLS12
+	})
+
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca}); err != nil {
+		t.Errorf("connecting with TLS 1.2: %v", err)
+	}
+	if err := get(t, srv.URL, TLSOptions{CAFile: ca, MinVersion: "1.3"}); err == nil {
+		t.Error("connected with TLS 1.2 to a server when 1.3 is required")
+	}
+}
+
+func TestTLSOptionsInvalid(t *testing.T) {
+	_, cert, _ := clientCertificate(t)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0600)
+
+	tests := map[string]TLSOptions{
+		"min version":      {MinVersion: "1.4"},
+		"missing CA file":  {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"empty CA file":    {CAFile: empty},
+		"certificate only": {CertFile: cert},
+		"key mismatch":     {CertFile: cert, KeyFile: cert},
+	}
+	for name, o := range tests {
+		if _, err := o.Config(); err == nil {
+			t.Errorf("%s: Config() succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Encodings and compressions of probe_post frames.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// MessageProbeBatch is a probe_post frame carrying a list of
+	// probes.ProbeData.
+	MessageProbeBatch = "probe_batch"
+
+	eventTypeWS_ProbePost = "probe_post"
+)
+
+// UploadOptions are the probe_post formats the agent offers in agent_hello,
+// the controller picks from them in agent_hello_ack.
+type UploadOptions struct {
+	Encodings    []string // json is always understood
+	Compressions []string // in order of preference
+	Batch        bool     // whether the agent would send several results per frame
+}
+
+// Validate checks that every format offered is one the agent can produce.
+func (o UploadOptions) Validate() error {
+	for _, e := range o.Encodings {
+		if e != EncodingJSON && e != EncodingMsgpack {
+			return fmt.Errorf("unknown encoding %q, expected json or msgpack", e)
+		}
+	}
+	for _, c := range o.Compressions {
+		if c != CompressionGzip && c != CompressionZstd {
+			return fmt.Errorf("unknown compression %q, expected zstd or gzip", c)
+		}
+	}
+	return nil
+}
+
+// Upload is the probe_post format agreed with the controller.
+type Upload struct {
+	Encoding    string `json:"encoding,omitempty"`    // json when empty
+	Compression string `json:"compression,omitempty"` // none when empty
+	Batch       bool   `json:"batch,omitempty"`       // the controller takes probe_batch frames
+}
+
+func (u Upload) encoding() string {
+	if u.Encoding == "" {
+		return EncodingJSON
+	}
+	return u.Encoding
+}
+
+func (u Upload) plain() bool {
+	return u.encoding() == EncodingJSON && u.Compression == ""
+}
+
+// binaryEnvelope is an Envelope in msgpack, its payload encoded along with
+// it instead of as raw JSON.
+type binaryEnvelope struct {
+	Version   int         `json:"v"`
+	Type      string      `json:"type"`
+	Agent     string      `json:"agent,omitempty"`
+	Seq       uint64      `json:"seq"`
+	Timestamp time.Time   `json:"ts"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+func init() {
+	// object ids go out as their hex string, like they do in JSON
+	msgpack.Register(primitive.ObjectID{}, func(e *msgpack.Encoder, v reflect.Value) error {
+		return e.EncodeString(v.Interface().(primitive.ObjectID).Hex())
+	}, nil)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// Upload returns the probe_post format agreed with the controller.
+func (wsH *WebSocketHandler) Upload() Upload {
+	if u := wsH.upload.Load(); u != nil && wsH.Protocol() > 0 {
+		return *u
+	}
+	return Upload{}
+}
+
+// checkUpload makes sure the controller picked a format the agent offered.
+func (wsH *WebSocketHandler) checkUpload(u Upload) error {
+	if u.Encoding != "" && u.Encoding != EncodingJSON && !contains(wsH.UploadOptions.Encodings, u.Encoding) {
+		return fmt.Errorf("the controller chose the %q encoding, which this agent didn't offer", u.Encoding)
+	}
+	if u.Compression != "" && !contains(wsH.UploadOptions.Compressions, u.Compression) {
+		return fmt.Errorf("the controller chose %q compression, which this agent didn't offer", u.Compression)
+	}
+	if u.Batch && !wsH.UploadOptions.Batch {
+		return fmt.Errorf("the controller asked for batches, which this agent didn't offer")
+	}
+	return nil
+}
+
+// EmitProbeData sends marshalled probes.ProbeData in a probe_post frame,
+// in the format agreed with the controller. Several results can only be
+// sent at once when the controller takes batches. It reports whether the
+// frame was written.
+func (wsH *WebSocketHandler) EmitProbeData(payloads ...[]byte) bool {
+	if len(payloads) == 0 {
+		return true
+	}
+	u := wsH.Upload()
+	if len(payloads) > 1 && !u.Batch {
+		return false
+	}
+	if u.plain() && !u.Batch {
+		return wsH.Emit(eventTypeWS_ProbePost, MessageProbeData, payloads[0])
+	}
+	if !wsH.IsConnected() {
+		return false
+	}
+
+	b, err := wsH.encodeProbeData(u, payloads)
+	if err != nil {
+		log.Errorf("unable to encode probe_post: %v", err)
+		return false
+	}
+	if u.plain() {
+		return wsH.GetConnection().Emit(eventTypeWS_ProbePost, b)
+	}
+	return wsH.GetConnection().EmitBinary(eventTypeWS_ProbePost, b)
+}
+
+func (wsH *WebSocketHandler) encodeProbeData(u Upload, payloads [][]byte) ([]byte, error) {
+	msgType := MessageProbeData
+	if u.Batch {
+		msgType = MessageProbeBatch
+	}
+
+	var b []byte
+	var err error
+	switch u.encoding() {
+	case EncodingJSON:
+		payload := payloads[0]
+		if u.Batch {
+			payload = append([]byte("["), bytes.Join(payloads, []byte(","))...)
+			payload = append(payload, ']')
+		}
+		b, err = wsH.seal(wsH.Protocol(), msgType, payload)
+
+	case EncodingMsgpack:
+		// decoding the JSON first gives the results their typed structs
+		data := make([]probes.ProbeData, len(payloads))
+		for i, p := range payloads {
+			err = json.Unmarshal(p, &data[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		env := binaryEnvelope{
+			Version:   wsH.Protocol(),
+			Type:      msgType,
+			Agent:     wsH.ID,
+			Seq:       wsH.seq.Add(1),
+			Timestamp: time.Now(),
+			Payload:   data[0],
+		}
+		if u.Batch {
+			env.Payload = data
+		}
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		enc.UseCompactInts(true)
+		err = enc.Encode(env)
+		b = buf.Bytes()
+
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", u.Encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return compress(u.Compression, b)
+}
+
+func compress(algorithm string, b []byte) ([]byte, error) {
+	switch algorithm {
+	case "":
+		return b, nil
+
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		if err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case CompressionZstd:
+		zstdOnce.Do(func() {
+			zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		})
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package ws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/klauspost/compress/zstd"
+	"github.com/netwatcherio/netwatcher-agent/probes"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestUploadOptionsValidate(t *testing.T) {
+	valid := []UploadOptions{
+		{},
+		{Encodings: []string{EncodingJSON, EncodingMsgpack}, Compressions: []string{CompressionZstd, CompressionGzip}, Batch: true},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", o, err)
+		}
+	}
+
+	invalid := []UploadOptions{
+		{Encodings: []string{"cbor"}},
+		{Compressions: []string{CompressionGzip, "brotli"}},
+		{Encodings: []string{"JSON"}},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", o)
+		}
+	}
+}
+
+// decompress undoes compress.
+func decompress(t *testing.T, algorithm string, b []byte) []byte {
+	t.Helper()
+	switch algorithm {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err = io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case CompressionZstd:
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		b, err = zr.DecodeAll(b, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// decodeProbeData decodes a probe_post frame into its envelope fields and
+// the results it carries, as generic maps.
+func decodeProbeData(t *testing.T, u Upload, b []byte) (map[string]interface{}, []map[string]interface{}) {
+	t.Helper()
+	b = decompress(t, u.Compression, b)
+
+	var env map[string]interface{}
+	var err error
+	if u.encoding() == EncodingMsgpack {
+		err = msgpack.Unmarshal(b, &env)
+	} else {
+		err = json.Unmarshal(b, &env)
+	}
+	if err != nil {
+		t.Fatalf("%+v: decoding %q: %v", u, b, err)
+	}
+
+	var results []map[string]interface{}
+	switch payload := env["payload"].(type) {
+	case map[string]interface{}:
+		results = append(results, payload)
+	case []interface{}:
+		for _, p := range payload {
+			results = append(results, p.(map[string]interface{}))
+		}
+	default:
+		t.Fatalf("%+v: payload is a %T", u, payload)
+	}
+	return env, results
+}
+
+func TestEncodeProbeData(t *testing.T) {
+	data := []probes.ProbeData{
+		{ProbeID: primitive.NewObjectID(), Type: probes.ProbeType_PING, Schema: 1, CreatedAt: time.Now().UTC()},
+		{ProbeID: primitive.NewObjectID(), Type: probes.ProbeType_MTR, Schema: 2, Triggered: true, CreatedAt: time.Now().UTC()},
+	}
+	payloads := make([][]byte, len(data))
+	for i, d := range data {
+		b, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads[i] = b
+	}
+
+	for _, encoding := range []string{"", EncodingJSON, EncodingMsgpack} {
+		for _, compression := range []string{"", CompressionGzip, CompressionZstd} {
+			for _, batch := range []bool{false, true} {
+				u := Upload{Encoding: encoding, Compression: compression, Batch: batch}
+				wsH := &WebSocketHandler{ID: "agent"}
+				wsH.protocol.Store(ProtocolVersion)
+
+				sent := payloads[:1]
+				wantType := MessageProbeData
+				if batch {
+					sent = payloads
+					wantType = MessageProbeBatch
+				}
+				b, err := wsH.encodeProbeData(u, sent)
+				if err != nil {
+					t.Errorf("%+v: encodeProbeData() = %v", u, err)
+					continue
+				}
+
+				env, results := decodeProbeData(t, u, b)
+				if env["type"] != wantType || env["agent"] != "agent" {
+					t.Errorf("%+v: envelope %v, want a %s from agent", u, env, wantType)
+				}
+				if len(results) != len(sent) {
+					t.Errorf("%+v: %d results, want %d", u, len(results), len(sent))
+					continue
+				}
+				for i, r := range results {
+					if r["probe"] != data[i].ProbeID.Hex() || r["type"] != string(data[i].Type) || r["triggered"] != data[i].Triggered {
+						t.Errorf("%+v: result %d = %v, want %+v", u, i, r, data[i])
+					}
+				}
+			}
+		}
+	}
+
+	wsH := &WebSocketHandler{}
+	if _, err := wsH.encodeProbeData(Upload{Encoding: "cbor"}, payloads[:1]); err == nil {
+		t.Error("encodeProbeData() succeeded with an unknown encoding")
+	}
+	if _, err := wsH.encodeProbeData(Upload{Compression: "brotli"}, payloads[:1]); err == nil {
+		t.Error("encodeProbeData() succeeded with an unknown compression")
+	}
+}
+
+// ack returns an agent_hello_ack choosing protocol and u.
+func ack(t *testing.T, protocol int, u Upload) []byte {
+	t.Helper()
+	payload, err := json.Marshal(HelloAck{Protocol: protocol, Upload: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(Envelope{Version: protocol, Type: MessageHelloAck, Timestamp: time.Now(), Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHelloAckUpload(t *testing.T) {
+	offered := UploadOptions{Encodings: []string{EncodingMsgpack}, Compressions: []string{CompressionZstd}, Batch: true}
+
+	tests := []struct {
+		name    string
+		offered UploadOptions
+		chosen  Upload
+		ok      bool
+	}{
+		{"plain", offered, Upload{}, true},
+		{"json", UploadOptions{}, Upload{Encoding: EncodingJSON}, true},
+		{"all offered", offered, Upload{Encoding: EncodingMsgpack, Compression: CompressionZstd, Batch: true}, true},
+		{"encoding not offered", UploadOptions{}, Upload{Encoding: EncodingMsgpack}, false},
+		{"compression not offered", offered, Upload{Compression: CompressionGzip}, false},
+		{"batch not offered", UploadOptions{Encodings: offered.Encodings}, Upload{Batch: true}, false},
+	}
+	for _, tt := range tests {
+		wsH := &WebSocketHandler{UploadOptions: tt.offered}
+		err := wsH.helloAck(ack(t, ProtocolVersion, tt.chosen))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: helloAck() = %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			// an answer the agent can't use leaves it sending raw bodies
+			if wsH.Protocol() != 0 || wsH.Upload() != (Upload{}) {
+				t.Errorf("%s: protocol %d, upload %+v after a refused answer", tt.name, wsH.Protocol(), wsH.Upload())
+			}
+			continue
+		}
+		if wsH.Protocol() != ProtocolVersion || wsH.Upload() != tt.chosen {
+			t.Errorf("%s: protocol %d, upload %+v, want %+v", tt.name, wsH.Protocol(), wsH.Upload(), tt.chosen)
+		}
+	}
+
+	// a controller on an unknown protocol gets nothing
+	wsH := &WebSocketHandler{UploadOptions: offered}
+	if err := wsH.helloAck(ack(t, ProtocolVersion+1, Upload{})); err == nil || wsH.Protocol() != 0 {
+		t.Errorf("helloAck() = %v, protocol %d for a newer protocol", err, wsH.Protocol())
+	}
+
+	// a format agreed before a reconnect isn't used until agreed again
+	wsH.upload.Store(&Upload{Encoding: EncodingMsgpack})
+	if u := wsH.Upload(); u != (Upload{}) {
+		t.Errorf("Upload() = %+v without a protocol", u)
+	}
+}